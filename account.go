@@ -0,0 +1,489 @@
+package main
+
+import (
+	"archive/zip"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const EmailTokenTTL = 24 * time.Hour
+const MinPasswordLength = 8
+
+var errEmailTaken = errors.New("email is already in use")
+
+// CheckPassword compares a plaintext password with the user's stored hash
+func (s *TransactionService) CheckPassword(userID, password string) error {
+	hash, err := s.userRepo.GetPasswordHash(userID)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve user: %v", err)
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+}
+
+func (s *TransactionService) ChangePassword(userID, currentPassword, newPassword string) error {
+	err := s.CheckPassword(userID, currentPassword)
+	if err != nil {
+		return err
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to process password: %v", err)
+	}
+
+	return s.userRepo.UpdatePassword(userID, string(hashedPassword))
+}
+
+// RequestEmailChange parks the new address as pending and mails a one-time token to it.
+// The email on the account only changes once the token comes back through ConfirmEmailChange.
+// Like ChangePassword it needs the current password, so a stolen access token can't take over the account.
+func (s *TransactionService) RequestEmailChange(userID, currentPassword, newEmail string) error {
+	err := s.CheckPassword(userID, currentPassword)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.userRepo.GetUserByEmail(newEmail)
+	if err == nil {
+		return errEmailTaken
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("failed to check email: %v", err)
+	}
+
+	raw := make([]byte, 32)
+	_, err = rand.Read(raw)
+	if err != nil {
+		return fmt.Errorf("failed to generate token: %v", err)
+	}
+	token := hex.EncodeToString(raw)
+
+	err = s.userRepo.SetPendingEmail(userID, newEmail, hashToken(token), s.clock.Now().Add(EmailTokenTTL))
+	if err != nil {
+		return fmt.Errorf("failed to save pending email: %v", err)
+	}
+
+	body := fmt.Sprintf("Use this code to confirm your new RoundUp email address: %s\nIt expires in %d hours.", token, int(EmailTokenTTL.Hours()))
+	err = s.mailer.Send(newEmail, "Confirm your new email address", body)
+	if err != nil {
+		return fmt.Errorf("failed to send verification email: %v", err)
+	}
+
+	return nil
+}
+
+func (s *TransactionService) ConfirmEmailChange(token string) (string, error) {
+	return s.userRepo.ConfirmPendingEmail(hashToken(token))
+}
+
+// only token hashes are stored, so a leaked database can't be used to confirm emails
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// UserDataExport is everything we store about a user
+type UserDataExport struct {
+	ExportedAt         time.Time           `json:"exported_at"`
+	User               User                `json:"user"`
+	Goals              []Goal              `json:"goals"`
+	RoundupEvents      []RoundupEvent      `json:"roundup_events"`
+	Budgets            []Budget            `json:"budgets"`
+	Subscriptions      []Subscription      `json:"subscriptions"`
+	Notifications      []Notification      `json:"notifications"`
+	Transactions       []Transaction       `json:"transactions"`
+	Wallet             *Wallet             `json:"wallet"`
+	WalletTransactions []WalletTransaction `json:"wallet_transactions"`
+	PushDevices        []PushDevice        `json:"push_devices"`
+	Webhooks           []Webhook           `json:"webhooks"` // without their secrets
+	WebhookDeliveries  []WebhookDelivery   `json:"webhook_deliveries"`
+}
+
+func (s *TransactionService) ExportUserData(userID string) (*UserDataExport, error) {
+	user, err := s.userRepo.FindByID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve user: %v", err)
+	}
+
+	goals, err := s.goalRepo.GetGoalsByUserID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve goals: %v", err)
+	}
+
+	transactions, err := s.repo.GetTransactionsByUserID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve transactions: %v", err)
+	}
+
+	roundupEvents, err := s.eventRepo.GetRoundupEventsByUserID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve roundup history: %v", err)
+	}
+
+	budgets, err := s.budgetRepo.GetBudgetsByUserID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve budgets: %v", err)
+	}
+
+	subscriptions, err := s.subRepo.GetSubscriptionsByUserID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve subscriptions: %v", err)
+	}
+
+	notifications, err := s.notifRepo.ListNotifications(userID, NotificationFilter{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve notifications: %v", err)
+	}
+
+	devices, err := s.notifRepo.GetDevices(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve push devices: %v", err)
+	}
+
+	webhooks, err := s.hookRepo.GetWebhooksByUserID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve webhooks: %v", err)
+	}
+	for i := range webhooks {
+		webhooks[i].Secret = ""
+	}
+
+	deliveries, err := s.hookRepo.GetDeliveriesByUserID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve webhook deliveries: %v", err)
+	}
+
+	wallet, err := s.walletRepo.GetWalletByUserID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get wallet: %v", err)
+	}
+
+	walletTransactions, err := s.walletRepo.GetWalletTransactions(wallet.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get wallet transactions: %v", err)
+	}
+
+	return &UserDataExport{
+		ExportedAt:         s.clock.Now(),
+		User:               *user,
+		Goals:              goals,
+		RoundupEvents:      roundupEvents,
+		Budgets:            budgets,
+		Subscriptions:      subscriptions,
+		Notifications:      notifications,
+		Transactions:       transactions,
+		Wallet:             wallet,
+		WalletTransactions: walletTransactions,
+		PushDevices:        devices,
+		Webhooks:           webhooks,
+		WebhookDeliveries:  deliveries,
+	}, nil
+}
+
+// DeleteAccount anonymizes the user. The wallet has to be empty first,
+// otherwise we would be erasing the owner of money we still hold.
+func (s *TransactionService) DeleteAccount(userID string) error {
+	wallet, err := s.walletRepo.GetWalletByUserID(userID)
+	if err != nil {
+		return fmt.Errorf("failed to get wallet: %v", err)
+	}
+
+	if wallet.Balance > 0 {
+		return fmt.Errorf("wallet balance of ₹%.2f must be withdrawn before deleting the account", wallet.Balance)
+	}
+
+	err = s.userRepo.AnonymizeUser(userID)
+	if err != nil {
+		return fmt.Errorf("failed to delete user data: %v", err)
+	}
+
+	return nil
+}
+
+func exportUserDataHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	export, err := txnService.ExportUserData(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to export user data: " + err.Error()})
+		return
+	}
+
+	switch c.DefaultQuery("format", "json") {
+	case "json":
+		c.Header("Content-Disposition", `attachment; filename="roundup-export.json"`)
+		c.JSON(http.StatusOK, export)
+	case "zip":
+		c.Header("Content-Disposition", `attachment; filename="roundup-export.zip"`)
+		c.Header("Content-Type", "application/zip")
+		c.Status(http.StatusOK)
+		err = writeExportZip(c.Writer, export)
+		if err != nil {
+			fmt.Println(err)
+		}
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid format. Use json or zip"})
+	}
+}
+
+// writeExportZip writes one JSON file per kind of record
+func writeExportZip(w http.ResponseWriter, export *UserDataExport) error {
+	files := []struct {
+		name string
+		data interface{}
+	}{
+		{"user.json", export.User},
+		{"goals.json", export.Goals},
+		{"roundup_events.json", export.RoundupEvents},
+		{"budgets.json", export.Budgets},
+		{"subscriptions.json", export.Subscriptions},
+		{"notifications.json", export.Notifications},
+		{"transactions.json", export.Transactions},
+		{"wallet.json", export.Wallet},
+		{"wallet_transactions.json", export.WalletTransactions},
+		{"push_devices.json", export.PushDevices},
+		{"webhooks.json", export.Webhooks},
+		{"webhook_deliveries.json", export.WebhookDeliveries},
+	}
+
+	archive := zip.NewWriter(w)
+	for _, file := range files {
+		f, err := archive.Create(file.name)
+		if err != nil {
+			return err
+		}
+
+		encoder := json.NewEncoder(f)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(file.data)
+		if err != nil {
+			return err
+		}
+	}
+
+	return archive.Close()
+}
+
+func deleteAccountHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	var req struct {
+		Password string `json:"password" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+
+	err := txnService.CheckPassword(uid, req.Password)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid password"})
+		return
+	}
+
+	err = txnService.DeleteAccount(uid)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Failed to delete account: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account deleted successfully"})
+}
+
+func getProfileHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	user, err := txnService.userRepo.FindByID(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find user"})
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+func updateProfileHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	// fields left out of the request are not changed
+	var req struct {
+		Name            *string `json:"name"`
+		Email           *string `json:"email"`
+		CurrentPassword string  `json:"current_password"` // required to change the email
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+
+	user, err := txnService.userRepo.FindByID(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find user"})
+		return
+	}
+
+	name := user.Name
+	if req.Name != nil {
+		name = strings.TrimSpace(*req.Name)
+		if name == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Name cannot be empty"})
+			return
+		}
+	}
+
+	response := gin.H{"message": "Profile updated successfully", "user": user}
+
+	// the email change goes first, so a wrong password doesn't leave the name half updated
+	if req.Email != nil && !strings.EqualFold(strings.TrimSpace(*req.Email), user.Email) {
+		email := strings.TrimSpace(*req.Email)
+		if !strings.Contains(email, "@") {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid email address"})
+			return
+		}
+
+		if req.CurrentPassword == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Current password is required to change the email"})
+			return
+		}
+
+		err = txnService.RequestEmailChange(uid, req.CurrentPassword, email)
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
+			return
+		}
+		if errors.Is(err, errEmailTaken) {
+			c.JSON(http.StatusConflict, gin.H{"error": "Email is already in use"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change email"})
+			return
+		}
+
+		response["message"] = "Profile updated. Check your new email address to confirm the change"
+	}
+
+	if name != user.Name {
+		user.Name = name
+		err = txnService.userRepo.Update(user)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update profile"})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func verifyEmailHandler(c *gin.Context) {
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+
+	_, err := txnService.ConfirmEmailChange(req.Token)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Email updated successfully"})
+}
+
+func changePasswordHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	var req struct {
+		CurrentPassword string `json:"current_password" binding:"required"`
+		NewPassword     string `json:"new_password" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+
+	if len(req.NewPassword) < MinPasswordLength {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Password must be at least %d characters", MinPasswordLength)})
+		return
+	}
+
+	err := txnService.ChangePassword(uid, req.CurrentPassword, req.NewPassword)
+	if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Current password is incorrect"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change password"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Password changed successfully"})
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Admin handlers. All of these sit behind authMiddleware and requireRole(RoleAdmin)
+func adminListUsersHandler(c *gin.Context) {
+	users, err := txnService.userRepo.ListUsers()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list users"})
+		return
+	}
+
+	c.JSON(http.StatusOK, users)
+}
+
+func adminGetUserWalletHandler(c *gin.Context) {
+	uid := c.Param("id")
+
+	wallet, err := txnService.walletRepo.GetWalletByUserID(uid)
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Wallet not found"})
+		return
+	}
+
+	transactions, err := txnService.walletRepo.GetWalletTransactions(wallet.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get wallet transactions: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"wallet":       wallet,
+		"transactions": transactions,
+	})
+}
+
+func adminGetUserTransactionsHandler(c *gin.Context) {
+	uid := c.Param("id")
+
+	transactions, err := txnService.repo.GetTransactionsByUserID(uid)
+	if err != nil {
+		fmt.Println(err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve transactions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, transactions)
+}
+
+// adminFreezeUserHandler freezes or unfreezes a user. Admins can't freeze themselves or each other,
+// so a single admin account can't lock the others out.
+func adminFreezeUserHandler(c *gin.Context) {
+	uid := c.Param("id")
+
+	var req struct {
+		Frozen *bool `json:"frozen" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+
+	if caller, _ := c.Get("userID"); caller == uid {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "You can't change the status of your own account"})
+		return
+	}
+
+	if *req.Frozen {
+		role, _, err := txnService.userRepo.GetAccess(uid)
+		if errors.Is(err, sql.ErrNoRows) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update account status"})
+			return
+		}
+		if role == RoleAdmin {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Admin accounts can't be frozen"})
+			return
+		}
+	}
+
+	err := txnService.userRepo.SetFrozen(uid, *req.Frozen)
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update account status"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Account status updated successfully", "frozen": *req.Frozen})
+}
+
+func adminUpdateMerchantCategoryHandler(c *gin.Context) {
+	merchant := c.Param("merchant")
+
+	var req struct {
+		Category string `json:"category" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+
+	category, ok := canonicalCategory(req.Category)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown category"})
+		return
+	}
+
+	updated, err := txnService.repo.UpdateCategoryByMerchant(merchant, category)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update merchant category"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Merchant category updated successfully", "updated": updated})
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const DefaultAnalyticsDays = 30
+const MaxAnalyticsDays = 366 // longest range a single request may aggregate
+const DefaultTopMerchants = 10
+const MaxTopMerchants = 100
+
+// analyticsRange reads the ?from= and ?to= dates (YYYY-MM-DD, both inclusive), defaulting to
+// the last DefaultAnalyticsDays. Queries run up to midnight after the to date. Ranges longer than
+// MaxAnalyticsDays are refused, so one request can't aggregate a user's whole history.
+func analyticsRange(c *gin.Context) (time.Time, time.Time, error) {
+	today := txnService.clock.Now().UTC().Truncate(24 * time.Hour)
+	from := today.AddDate(0, 0, -DefaultAnalyticsDays+1)
+	to := today
+
+	var err error
+	if s := c.Query("from"); s != "" {
+		from, err = time.Parse("2006-01-02", s)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("Invalid from date. Use YYYY-MM-DD")
+		}
+	}
+	if s := c.Query("to"); s != "" {
+		to, err = time.Parse("2006-01-02", s)
+		if err != nil {
+			return time.Time{}, time.Time{}, errors.New("Invalid to date. Use YYYY-MM-DD")
+		}
+	}
+
+	if to.Before(from) {
+		return time.Time{}, time.Time{}, errors.New("from must not be after to")
+	}
+	if to.Sub(from) >= MaxAnalyticsDays*24*time.Hour {
+		return time.Time{}, time.Time{}, fmt.Errorf("the range can be at most %d days", MaxAnalyticsDays)
+	}
+
+	return from, to, nil
+}
+
+// analyticsPeriod reads ?period=, which defaults to month
+func analyticsPeriod(c *gin.Context) (string, error) {
+	period := c.DefaultQuery("period", PeriodMonth)
+	if period != PeriodDay && period != PeriodWeek && period != PeriodMonth {
+		return "", errors.New("period must be day, week or month")
+	}
+	return period, nil
+}
+
+func spendingAnalyticsHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	from, to, err := analyticsRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	period, err := analyticsPeriod(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	spending, err := txnService.repo.GetSpendingByCategory(uid, period, from, to.AddDate(0, 0, 1))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve spending"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"from":     from.Format("2006-01-02"),
+		"to":       to.Format("2006-01-02"),
+		"period":   period,
+		"spending": spending,
+	})
+}
+
+func merchantAnalyticsHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	from, to, err := analyticsRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	limit := DefaultTopMerchants
+	if s := c.Query("limit"); s != "" {
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > MaxTopMerchants {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and " + strconv.Itoa(MaxTopMerchants)})
+			return
+		}
+	}
+
+	merchants, err := txnService.repo.GetTopMerchants(uid, from, to.AddDate(0, 0, 1), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve merchants"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"from":      from.Format("2006-01-02"),
+		"to":        to.Format("2006-01-02"),
+		"merchants": merchants,
+	})
+}
+
+func roundupAnalyticsHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	from, to, err := analyticsRange(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	period, err := analyticsPeriod(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	totals, err := txnService.repo.GetRoundupTotals(uid, period, from, to.AddDate(0, 0, 1))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve roundup totals"})
+		return
+	}
+
+	total := 0.0
+	for _, t := range totals {
+		total += t.Total
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"from":     from.Format("2006-01-02"),
+		"to":       to.Format("2006-01-02"),
+		"period":   period,
+		"total":    total,
+		"roundups": totals,
+	})
+}
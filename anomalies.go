@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const AnomalyBaselineDays = 90
+const MinCategoryBaseline = 5       // category transactions needed before amounts are judged
+const AnomalyZScore = 3             // standard deviations above the mean that count as unusual
+const NewMerchantAlertAmount = 5000 // smaller payments to new merchants are normal
+const MinHourBaseline = 20          // transactions needed before the hour of day is judged
+
+// FlagAnomalies compares the transaction with the user's baseline and records any reasons on it.
+// It has to be called before the transaction is saved, so it isn't its own baseline.
+func (s *TransactionService) FlagAnomalies(userID string, transaction *Transaction) error {
+	// only this decides, whatever the client sent
+	transaction.Anomalous = false
+	transaction.AnomalyReasons = nil
+
+	now := s.clock.Now()
+
+	baseline, err := s.repo.GetSpendingBaseline(userID, transaction.Category, transaction.Merchant,
+		transaction.CreatedAt.Hour(), now.AddDate(0, 0, -AnomalyBaselineDays))
+	if err != nil {
+		return fmt.Errorf("failed to retrieve spending baseline: %v", err)
+	}
+
+	reasons := detectAnomalies(*transaction, *baseline)
+	if len(reasons) == 0 {
+		return nil
+	}
+
+	transaction.Anomalous = true
+	transaction.AnomalyReasons = reasons
+	return nil
+}
+
+// anomalyAlert is raised for a flagged transaction once it is saved, so the alert never
+// points at a transaction that doesn't exist
+func anomalyAlert(transaction Transaction, now time.Time) AnomalyAlert {
+	return AnomalyAlert{
+		UserID:        transaction.UserID,
+		TransactionID: transaction.ID,
+		Amount:        transaction.Amount,
+		Merchant:      transaction.Merchant,
+		Category:      transaction.Category,
+		Reasons:       transaction.AnomalyReasons,
+		CreatedAt:     now,
+	}
+}
+
+// detectAnomalies returns why a transaction stands out from the baseline, if it does
+func detectAnomalies(transaction Transaction, baseline SpendingBaseline) []string {
+	var reasons []string
+
+	if baseline.CategoryCount >= MinCategoryBaseline && baseline.CategoryStdDev > 0 {
+		z := (transaction.Amount - baseline.CategoryMean) / baseline.CategoryStdDev
+		if z >= AnomalyZScore {
+			reasons = append(reasons, AnomalyAmount)
+		}
+	}
+
+	if !baseline.MerchantSeen && transaction.Merchant != "" && transaction.Amount >= NewMerchantAlertAmount {
+		reasons = append(reasons, AnomalyNewMerchant)
+	}
+
+	if baseline.TotalCount >= MinHourBaseline && baseline.HourCount == 0 {
+		reasons = append(reasons, AnomalyUnusualHour)
+	}
+
+	return reasons
+}
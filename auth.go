@@ -2,7 +2,6 @@ package main
 
 import (
 	"errors"
-	"os"
 
 	"net/http"
 
@@ -14,6 +13,7 @@ import (
 type CustomClaims struct {
 	jwt.RegisteredClaims
 	UserID string `json:"user_id"`
+	Role   string `json:"role"`
 }
 
 func authMiddleware() gin.HandlerFunc {
@@ -38,18 +38,63 @@ func authMiddleware() gin.HandlerFunc {
 			return
 		}
 
+		// role changes and freezes take effect immediately, even with an unexpired token
+		role, frozen, err := txnService.userRepo.GetAccess(claims.UserID)
+		if err != nil {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+			c.Abort()
+			return
+		}
+
+		if frozen {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Account is frozen"})
+			c.Abort()
+			return
+		}
+
 		// set the claims in context and move on the next request
 		c.Set("userID", claims.UserID)
+		c.Set("role", role)
+		if claims.ExpiresAt != nil {
+			c.Set("tokenExpiresAt", claims.ExpiresAt.Time) // long-lived requests end with the token
+		}
 		c.Next()
 	}
 }
 
+// requireRole must run after authMiddleware and only lets the listed roles through
+func requireRole(roles ...string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		role, exists := c.Get("role")
+		if !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization required"})
+			c.Abort()
+			return
+		}
+
+		r, ok := role.(string)
+		if !ok {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid role format"})
+			c.Abort()
+			return
+		}
+
+		for _, allowed := range roles {
+			if r == allowed {
+				c.Next()
+				return
+			}
+		}
+
+		c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions"})
+		c.Abort()
+	}
+}
+
 func validateToken(tokenString string) (*CustomClaims, error) {
 	// Parse the token with CustomClaims
-	token, err := jwt.ParseWithClaims(tokenString, &CustomClaims{},
-		func(token *jwt.Token) (interface{}, error) {
-			return []byte(os.Getenv("JWT_SECRET")), nil
-		})
+	token, err := jwt.ParseWithClaims(tokenString, &CustomClaims{}, keySet.keyFunc,
+		jwt.WithValidMethods(keySet.validMethods()))
 
 	if err != nil {
 		return nil, err
@@ -62,3 +107,8 @@ func validateToken(tokenString string) (*CustomClaims, error) {
 
 	return nil, errors.New("invalid token claims")
 }
+
+// jwksHandler publishes the verification keys so other services can check our tokens
+func jwksHandler(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"keys": keySet.JWKS()})
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// BacktestResult is what a replay of past transactions produced under one parameter set
+type BacktestResult struct {
+	Params        RoundupParams         `json:"params"`
+	Allocation    string                `json:"goal_allocation"`
+	TotalSpent    float64               `json:"total_spent"`
+	TotalSaved    float64               `json:"total_saved"`
+	AverageBurden float64               `json:"average_burden"` // mean roundup as a percentage of the transaction amount
+	MaxBurden     float64               `json:"max_burden"`
+	Goals         []BacktestGoal        `json:"goals"`
+	Transactions  []BacktestTransaction `json:"transactions"`
+}
+
+type BacktestGoal struct {
+	Name       string     `json:"name"`
+	Amount     float64    `json:"amount"`
+	Saved      float64    `json:"saved"`
+	TargetDate time.Time  `json:"target_date"`
+	HitDate    *time.Time `json:"hit_date"` // nil if the goal was never reached
+}
+
+type BacktestTransaction struct {
+	Date     time.Time `json:"date"`
+	Amount   float64   `json:"amount"`
+	Category string    `json:"category"`
+	Mode     string    `json:"mode"`
+	Pressure float64   `json:"pressure"`
+	Roundup  float64   `json:"roundup"`
+	Burden   float64   `json:"burden"` // roundup as a percentage of the amount
+}
+
+// runBacktest implements `backend backtest [flags]`
+func runBacktest(args []string) error {
+	fs := flag.NewFlagSet("backtest", flag.ContinueOnError)
+	userID := fs.String("user", "", "replay this user's transactions from the database")
+	input := fs.String("input", "", "replay a data export (GET /api/v1/me/export) instead of the database")
+	base := fs.Float64("base", BaseRoundupPercent, "base roundup as a fraction of the amount")
+	minPressure := fs.Float64("min-pressure", MinPressure, "lowest pressure factor")
+	maxPressure := fs.Float64("max-pressure", MaxPressure, "highest pressure factor")
+	recentDays := fs.Int("recent-days", RecentPeriodDays, "days of history used to estimate transaction frequency")
+	allocation := fs.String("allocation", "", "goal allocation strategy, weight or priority (default: the user's)")
+	goalAmount := fs.Float64("goal-amount", 0, "replace the user's goals with a single goal of this amount")
+	goalDate := fs.String("goal-date", "", "target date for -goal-amount, YYYY-MM-DD")
+	asJSON := fs.Bool("json", false, "print the result as JSON")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if (*userID == "") == (*input == "") {
+		return errors.New("exactly one of -user or -input is required")
+	}
+
+	if *recentDays <= 0 {
+		return errors.New("-recent-days must be at least 1")
+	}
+
+	var export *UserDataExport
+	if *input != "" {
+		export, err = loadExport(*input)
+	} else {
+		export, err = loadExportFromDB(*userID)
+	}
+	if err != nil {
+		return err
+	}
+
+	goals := export.Goals
+	if *goalAmount > 0 {
+		targetDate, err := time.Parse("2006-01-02", *goalDate)
+		if err != nil {
+			return errors.New("-goal-date must be set as YYYY-MM-DD when using -goal-amount")
+		}
+		goals = []Goal{{ID: "backtest", Name: "Backtest goal", Amount: *goalAmount, TargetDate: targetDate, Weight: 1}}
+	}
+
+	prefs := export.User.Preferences
+	if *allocation != "" {
+		prefs.GoalAllocation = *allocation
+	}
+
+	params := RoundupParams{
+		BaseRoundupPercent: *base,
+		MinPressure:        *minPressure,
+		MaxPressure:        *maxPressure,
+		RecentPeriodDays:   *recentDays,
+	}
+
+	result := replayTransactions(export.Transactions, prefs, goals, params)
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(result)
+	}
+
+	printBacktest(os.Stdout, result)
+	return nil
+}
+
+func loadExport(path string) (*UserDataExport, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read export: %v", err)
+	}
+
+	var export UserDataExport
+	err = json.Unmarshal(data, &export)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse export: %v", err)
+	}
+	return &export, nil
+}
+
+func loadExportFromDB(userID string) (*UserDataExport, error) {
+	db, err := connectDB()
+	if err != nil {
+		return nil, err
+	}
+	defer db.Close()
+
+	service := &TransactionService{
+		repo:       &PostgresTransactionRepository{db: db},
+		userRepo:   &PostgresUserRepository{db: db},
+		walletRepo: &PostgresWalletRepository{db: db},
+		goalRepo:   &PostgresGoalRepository{db: db},
+		eventRepo:  &PostgresRoundupEventRepository{db: db},
+		budgetRepo: &PostgresBudgetRepository{db: db},
+		subRepo:    &PostgresSubscriptionRepository{db: db},
+		notifRepo:  &PostgresNotificationRepository{db: db},
+		hookRepo:   &PostgresWebhookRepository{db: db},
+		clock:      realClock{},
+	}
+	return service.ExportUserData(userID)
+}
+
+// replayTransactions runs past transactions through calculateRoundup in date order. The clock is
+// each transaction's own timestamp. Goals start from zero savings and only collect roundups made
+// after they were created; abandoned goals are left out.
+func replayTransactions(transactions []Transaction, prefs UserPreferences, goals []Goal, params RoundupParams) BacktestResult {
+	ordered := make([]Transaction, len(transactions))
+	copy(ordered, transactions)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].CreatedAt.Before(ordered[j].CreatedAt)
+	})
+
+	var state []Goal
+	for _, goal := range goals {
+		if goal.Status == GoalAbandoned {
+			continue
+		}
+		goal.CurrentSavings = 0
+		goal.Status = GoalActive
+		state = append(state, goal)
+	}
+
+	// history is rebuilt as the replay goes, the real one already contains these roundups
+	var history []RoundupEvent
+
+	result := BacktestResult{Params: params, Allocation: prefs.GoalAllocation}
+	hitDates := map[string]time.Time{}
+	burdenTotal := 0.0
+	burdenCount := 0
+
+	for _, txn := range ordered {
+		now := txn.CreatedAt
+		result.TotalSpent += txn.Amount
+
+		// mirrors calculateAvgRoundup, but over this user's replayed roundups only
+		averageRoundup := recentRoundupTotal(history, params.RecentPeriodDays, now) / float64(params.RecentPeriodDays)
+		if averageRoundup == 0 {
+			averageRoundup = DefaultAvgTxnRoundup
+		}
+
+		// budgets are not replayed, so neither are budget penalties
+		breakdown := calculateRoundup(txn, prefs, history, 1, filterActiveGoals(goalsCreatedBefore(state, now), now), averageRoundup, now, params)
+
+		row := BacktestTransaction{
+			Date:     now,
+			Amount:   txn.Amount,
+			Category: txn.Category,
+			Mode:     breakdown.Mode,
+			Pressure: breakdown.Pressure,
+			Roundup:  breakdown.Roundup,
+		}
+
+		if txn.Amount > 0 && breakdown.Mode != RoundupModeDisabled {
+			row.Burden = breakdown.Roundup / txn.Amount * 100
+			burdenTotal += row.Burden
+			burdenCount++
+			result.MaxBurden = math.Max(result.MaxBurden, row.Burden)
+		}
+
+		if breakdown.Roundup > 0 {
+			result.TotalSaved += breakdown.Roundup
+			history = append(history, roundupEvents(txn.UserID, txn.ID, breakdown.Roundup, breakdown.Allocations, now)...)
+
+			for _, allocation := range breakdown.Allocations {
+				for i := range state {
+					if state[i].ID != allocation.GoalID {
+						continue
+					}
+					state[i].CurrentSavings += allocation.Amount
+					if state[i].CurrentSavings >= state[i].Amount {
+						state[i].Status = GoalAchieved
+						hitDates[state[i].ID] = now
+					}
+				}
+			}
+		}
+
+		result.Transactions = append(result.Transactions, row)
+	}
+
+	if burdenCount > 0 {
+		result.AverageBurden = burdenTotal / float64(burdenCount)
+	}
+
+	for _, goal := range state {
+		bg := BacktestGoal{
+			Name:       goal.Name,
+			Amount:     goal.Amount,
+			Saved:      goal.CurrentSavings,
+			TargetDate: goal.TargetDate,
+		}
+		if hit, ok := hitDates[goal.ID]; ok {
+			bg.HitDate = &hit
+		}
+		result.Goals = append(result.Goals, bg)
+	}
+
+	return result
+}
+
+func goalsCreatedBefore(goals []Goal, t time.Time) []Goal {
+	var created []Goal
+	for _, goal := range goals {
+		if goal.CreatedAt.Before(t) {
+			created = append(created, goal)
+		}
+	}
+	return created
+}
+
+func printBacktest(out io.Writer, result BacktestResult) {
+	w := tabwriter.NewWriter(out, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(w, "DATE\tAMOUNT\tCATEGORY\tMODE\tPRESSURE\tROUNDUP\tBURDEN")
+	for _, t := range result.Transactions {
+		fmt.Fprintf(w, "%s\t%.2f\t%s\t%s\t%.2f\t%.2f\t%.2f%%\n",
+			t.Date.Format("2006-01-02 15:04"), t.Amount, t.Category, t.Mode, t.Pressure, t.Roundup, t.Burden)
+	}
+	w.Flush()
+
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "Params: base %.3f, pressure %.2f-%.2f, recent period %d days\n",
+		result.Params.BaseRoundupPercent, result.Params.MinPressure, result.Params.MaxPressure, result.Params.RecentPeriodDays)
+	fmt.Fprintf(out, "Total spent: ₹%.2f\n", result.TotalSpent)
+	fmt.Fprintf(out, "Total saved: ₹%.2f\n", result.TotalSaved)
+	fmt.Fprintf(out, "Burden: %.2f%% average, %.2f%% max\n", result.AverageBurden, result.MaxBurden)
+
+	for _, goal := range result.Goals {
+		status := "not reached"
+		if goal.HitDate != nil {
+			status = "reached " + goal.HitDate.Format("2006-01-02")
+		}
+		fmt.Fprintf(out, "Goal '%s': ₹%.2f of ₹%.2f by %s, %s\n",
+			goal.Name, goal.Saved, goal.Amount, goal.TargetDate.Format("2006-01-02"), status)
+	}
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+var errBudgetExists = errors.New("category already has a budget")
+
+// CreateBudget adds a monthly limit for a category. Each category can only have one.
+func (s *TransactionService) CreateBudget(userID, category string, monthlyLimit float64) (*Budget, error) {
+	budgets, err := s.budgetRepo.GetBudgetsByUserID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve budgets: %v", err)
+	}
+
+	for _, budget := range budgets {
+		if budget.Category == category {
+			return nil, errBudgetExists
+		}
+	}
+
+	budget := Budget{
+		ID:           uuid.New().String(),
+		UserID:       userID,
+		Category:     category,
+		MonthlyLimit: monthlyLimit,
+		CreatedAt:    s.clock.Now(),
+	}
+
+	err = s.budgetRepo.CreateBudget(budget)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create budget: %v", err)
+	}
+	return &budget, nil
+}
+
+// GetBudgetStatuses reports every budget of the user against this month's spending
+func (s *TransactionService) GetBudgetStatuses(userID string) ([]BudgetStatus, error) {
+	budgets, err := s.budgetRepo.GetBudgetsByUserID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve budgets: %v", err)
+	}
+
+	spent, err := s.monthToDateSpending(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	now := s.clock.Now()
+	statuses := []BudgetStatus{}
+	for _, budget := range budgets {
+		statuses = append(statuses, budgetStatus(budget, spent[budget.Category], now))
+	}
+	return statuses, nil
+}
+
+// GetBudgetStatus reports one budget against this month's spending
+func (s *TransactionService) GetBudgetStatus(budget Budget) (*BudgetStatus, error) {
+	spent, err := s.monthToDateSpending(budget.UserID)
+	if err != nil {
+		return nil, err
+	}
+
+	status := budgetStatus(budget, spent[budget.Category], s.clock.Now())
+	return &status, nil
+}
+
+// CheckBudget reports the budget for the transaction's category as it will be once the
+// transaction is counted, and whether this transaction is the one that takes it over the limit.
+// It has to be called before the transaction is saved. Returns nil if the category has no budget.
+func (s *TransactionService) CheckBudget(userID string, transaction Transaction) (*BudgetStatus, bool, error) {
+	budgets, err := s.budgetRepo.GetBudgetsByUserID(userID)
+	if err != nil {
+		return nil, false, fmt.Errorf("failed to retrieve budgets: %v", err)
+	}
+
+	for _, budget := range budgets {
+		if budget.Category != transaction.Category {
+			continue
+		}
+
+		spent, err := s.monthToDateSpending(userID)
+		if err != nil {
+			return nil, false, err
+		}
+
+		before := spent[budget.Category]
+		status := budgetStatus(budget, before+transaction.Amount, s.clock.Now())
+		return &status, status.Overspent && before <= budget.MonthlyLimit, nil
+	}
+
+	return nil, false, nil
+}
+
+// budgetPenaltyFor is the roundup multiplier for a transaction in a category that the transaction
+// leaves over budget, or 1 if the user hasn't opted in to penalties or the category is within budget
+func (s *TransactionService) budgetPenaltyFor(userID string, prefs UserPreferences, transaction Transaction) (float64, error) {
+	if !prefs.BudgetPenalty {
+		return 1, nil
+	}
+
+	status, _, err := s.CheckBudget(userID, transaction)
+	if err != nil || status == nil {
+		return 1, err
+	}
+	return budgetPenalty(*status), nil
+}
+
+// budgetPenalty grows with how far over budget the category is: 50% over gives 1.5, up to MaxBudgetPenalty
+func budgetPenalty(status BudgetStatus) float64 {
+	if !status.Overspent || status.MonthlyLimit <= 0 {
+		return 1
+	}
+	overspend := (status.Spent - status.MonthlyLimit) / status.MonthlyLimit
+	return math.Min(1+BudgetPenaltyRate*overspend, MaxBudgetPenalty)
+}
+
+// monthToDateSpending totals the user's spending per category since the start of the month
+func (s *TransactionService) monthToDateSpending(userID string) (map[string]float64, error) {
+	_, _, month := capPeriodStarts(s.clock.Now())
+
+	spending, err := s.repo.GetSpendingByCategory(userID, PeriodMonth, month, month.AddDate(0, 1, 0))
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve spending: %v", err)
+	}
+
+	spent := map[string]float64{}
+	for _, s := range spending {
+		spent[s.Category] += s.Total
+	}
+	return spent, nil
+}
+
+func budgetStatus(budget Budget, spent float64, now time.Time) BudgetStatus {
+	status := BudgetStatus{
+		Budget:    budget,
+		Month:     now.Format("2006-01"),
+		Spent:     spent,
+		Remaining: math.Max(budget.MonthlyLimit-spent, 0),
+		Overspent: spent > budget.MonthlyLimit,
+	}
+	if budget.MonthlyLimit > 0 {
+		status.PercentUsed = spent / budget.MonthlyLimit * 100
+	}
+	return status
+}
+
+func listBudgetsHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	statuses, err := txnService.GetBudgetStatuses(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve budgets"})
+		return
+	}
+
+	c.JSON(http.StatusOK, statuses)
+}
+
+func createBudgetHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	var req struct {
+		Category     string  `json:"category" binding:"required"`
+		MonthlyLimit float64 `json:"monthly_limit" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+
+	category, ok := canonicalCategory(req.Category)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown category"})
+		return
+	}
+
+	if req.MonthlyLimit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "monthly_limit must be positive"})
+		return
+	}
+
+	budget, err := txnService.CreateBudget(uid, category, req.MonthlyLimit)
+	if errors.Is(err, errBudgetExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": "This category already has a budget"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create budget"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Budget added successfully", "budget": budget})
+}
+
+func getBudgetHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	budget, err := txnService.budgetRepo.GetBudgetByID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Budget not found"})
+		return
+	}
+
+	if budget.UserID != uid {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	status, err := txnService.GetBudgetStatus(*budget)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve budget spending"})
+		return
+	}
+
+	c.JSON(http.StatusOK, status)
+}
+
+// updateBudgetHandler changes the limit. To budget a different category, delete and create instead.
+func updateBudgetHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	var req struct {
+		MonthlyLimit float64 `json:"monthly_limit" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+
+	if req.MonthlyLimit <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "monthly_limit must be positive"})
+		return
+	}
+
+	budget, err := txnService.budgetRepo.GetBudgetByID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Budget not found"})
+		return
+	}
+
+	if budget.UserID != uid {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	budget.MonthlyLimit = req.MonthlyLimit
+	err = txnService.budgetRepo.UpdateBudget(*budget)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update budget"})
+		return
+	}
+
+	c.JSON(http.StatusOK, budget)
+}
+
+func deleteBudgetHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	budget, err := txnService.budgetRepo.GetBudgetByID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Budget not found"})
+		return
+	}
+
+	if budget.UserID != uid {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	err = txnService.budgetRepo.DeleteBudget(budget.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete budget"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Budget deleted successfully"})
+}
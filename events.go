@@ -0,0 +1,383 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// event types
+const EventTransactionCreated = "transaction.created"
+const EventRoundupCredited = "roundup.credited"
+const EventWalletCredited = "wallet.credited"
+const EventWalletWithdrawn = "wallet.withdrawn"
+const EventGoalReached = "goal.reached"
+const EventGoalMilestone = "goal.milestone"
+const EventRoundupFailed = "roundup.failed"
+const EventUserRegistered = "user.registered"
+const EventAnomalyDetected = "anomaly.detected"
+
+const MaxEventAttempts = 10
+const OutboxPollInterval = 30 * time.Second
+const OutboxRetryDelay = time.Minute // after a failed dispatch
+const OutboxLease = 5 * time.Minute  // a dispatch owns its event this long, well beyond its subscribers' timeouts
+
+// Event is something that happened which other parts of the app may react to
+type Event interface {
+	EventType() string
+	EventUserID() string
+}
+
+type TransactionCreated struct {
+	Transaction Transaction `json:"transaction"`
+}
+
+func (e TransactionCreated) EventType() string   { return EventTransactionCreated }
+func (e TransactionCreated) EventUserID() string { return e.Transaction.UserID }
+
+type RoundupCredited struct {
+	UserID        string              `json:"user_id"`
+	TransactionID string              `json:"transaction_id"`
+	Amount        float64             `json:"amount"`
+	Allocations   []RoundupAllocation `json:"allocations"`
+}
+
+func (e RoundupCredited) EventType() string   { return EventRoundupCredited }
+func (e RoundupCredited) EventUserID() string { return e.UserID }
+
+// WalletCredited is published for every credit to a wallet, roundups included
+type WalletCredited struct {
+	UserID   string  `json:"user_id"`
+	WalletID string  `json:"wallet_id"`
+	Amount   float64 `json:"amount"`
+	Balance  float64 `json:"balance"` // after the credit
+	Version  int64   `json:"version"` // of the wallet after the credit
+}
+
+func (e WalletCredited) EventType() string   { return EventWalletCredited }
+func (e WalletCredited) EventUserID() string { return e.UserID }
+
+type WalletWithdrawn struct {
+	UserID   string  `json:"user_id"`
+	WalletID string  `json:"wallet_id"`
+	Amount   float64 `json:"amount"`
+	Balance  float64 `json:"balance"` // after the withdrawal
+	Version  int64   `json:"version"` // of the wallet after the withdrawal
+}
+
+func (e WalletWithdrawn) EventType() string   { return EventWalletWithdrawn }
+func (e WalletWithdrawn) EventUserID() string { return e.UserID }
+
+type GoalReached struct {
+	Goal Goal `json:"goal"`
+}
+
+func (e GoalReached) EventType() string   { return EventGoalReached }
+func (e GoalReached) EventUserID() string { return e.Goal.UserID }
+
+// GoalMilestoneReached is published when an active goal's savings pass one of GoalMilestones
+type GoalMilestoneReached struct {
+	Goal    Goal `json:"goal"`
+	Percent int  `json:"percent"`
+}
+
+func (e GoalMilestoneReached) EventType() string   { return EventGoalMilestone }
+func (e GoalMilestoneReached) EventUserID() string { return e.Goal.UserID }
+
+// RoundupFailed is published when a roundup was worked out but could not be credited to the wallet
+type RoundupFailed struct {
+	UserID        string  `json:"user_id"`
+	TransactionID string  `json:"transaction_id"`
+	Amount        float64 `json:"amount"`
+	Reason        string  `json:"reason"`
+}
+
+func (e RoundupFailed) EventType() string   { return EventRoundupFailed }
+func (e RoundupFailed) EventUserID() string { return e.UserID }
+
+type UserRegistered struct {
+	UserID string `json:"user_id"`
+	Name   string `json:"name"`
+	Email  string `json:"email"`
+}
+
+func (e UserRegistered) EventType() string   { return EventUserRegistered }
+func (e UserRegistered) EventUserID() string { return e.UserID }
+
+func (e AnomalyAlert) EventType() string   { return EventAnomalyDetected }
+func (e AnomalyAlert) EventUserID() string { return e.UserID }
+
+// decodeEvent turns a stored outbox payload back into its event type
+func decodeEvent(eventType string, payload []byte) (Event, error) {
+	var event Event
+	switch eventType {
+	case EventTransactionCreated:
+		event = &TransactionCreated{}
+	case EventRoundupCredited:
+		event = &RoundupCredited{}
+	case EventWalletCredited:
+		event = &WalletCredited{}
+	case EventWalletWithdrawn:
+		event = &WalletWithdrawn{}
+	case EventGoalReached:
+		event = &GoalReached{}
+	case EventGoalMilestone:
+		event = &GoalMilestoneReached{}
+	case EventRoundupFailed:
+		event = &RoundupFailed{}
+	case EventUserRegistered:
+		event = &UserRegistered{}
+	case EventAnomalyDetected:
+		event = &AnomalyAlert{}
+	default:
+		return nil, fmt.Errorf("unknown event type %q", eventType)
+	}
+
+	err := json.Unmarshal(payload, event)
+	if err != nil {
+		return nil, err
+	}
+
+	// subscribers type-switch on values, not pointers
+	switch e := event.(type) {
+	case *TransactionCreated:
+		return *e, nil
+	case *RoundupCredited:
+		return *e, nil
+	case *WalletCredited:
+		return *e, nil
+	case *WalletWithdrawn:
+		return *e, nil
+	case *GoalReached:
+		return *e, nil
+	case *GoalMilestoneReached:
+		return *e, nil
+	case *RoundupFailed:
+		return *e, nil
+	case *UserRegistered:
+		return *e, nil
+	default:
+		return *event.(*AnomalyAlert), nil
+	}
+}
+
+// Subscriber handles one event. Returning an error has the event retried later, for this subscriber only.
+type Subscriber func(event Event) error
+
+// StoredSubscriber gets the event as stored in the outbox, for subscribers that pass it on as is
+type StoredSubscriber func(row OutboxEvent) error
+
+type namedSubscriber struct {
+	name         string
+	handle       Subscriber
+	handleStored StoredSubscriber
+}
+
+// EventBus is an in-process publish/subscribe bus. Every event is written to the outbox table in the
+// transaction that makes the change it describes, subscribers see it once that commits, and any
+// a subscriber failed on are retried by RunDispatcher.
+type EventBus struct {
+	outbox      OutboxRepository
+	clock       Clock
+	mu          sync.RWMutex
+	subscribers map[string][]namedSubscriber
+	pending     sync.WaitGroup
+}
+
+func NewEventBus(outbox OutboxRepository, clock Clock) *EventBus {
+	return &EventBus{
+		outbox:      outbox,
+		clock:       clock,
+		subscribers: map[string][]namedSubscriber{},
+	}
+}
+
+// Subscribe registers a handler for one event type. The name identifies the subscriber in the
+// outbox, so it has to stay the same across restarts.
+func (b *EventBus) Subscribe(eventType, name string, handle Subscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[eventType] = append(b.subscribers[eventType], namedSubscriber{name: name, handle: handle})
+}
+
+// SubscribeStored is Subscribe for handlers that want the stored event rather than the decoded one
+func (b *EventBus) SubscribeStored(eventType, name string, handle StoredSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[eventType] = append(b.subscribers[eventType], namedSubscriber{name: name, handleStored: handle})
+}
+
+// Publish stores the event in tx, the database transaction making the change it describes, so the
+// event is kept exactly when the change is. Pass the returned row to Dispatch once tx has committed;
+// until OutboxLease has passed the dispatcher leaves it to that. A nil tx stores the event on its own.
+// Publishing on a nil bus does nothing, so tools that run the service without one don't need to set it up.
+func (b *EventBus) Publish(tx *sql.Tx, event Event) (OutboxEvent, error) {
+	if b == nil {
+		return OutboxEvent{}, nil
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return OutboxEvent{}, fmt.Errorf("failed to encode %s event: %v", event.EventType(), err)
+	}
+
+	now := b.clock.Now()
+	lease := now.Add(OutboxLease)
+	row := OutboxEvent{
+		ID:            uuid.New().String(),
+		Type:          event.EventType(),
+		UserID:        event.EventUserID(),
+		Payload:       payload,
+		CreatedAt:     now,
+		NextAttemptAt: &lease,
+	}
+
+	err = b.outbox.AddEvent(tx, row)
+	if err != nil {
+		return OutboxEvent{}, fmt.Errorf("failed to store %s event: %v", row.Type, err)
+	}
+	return row, nil
+}
+
+// Dispatch hands published events to their subscribers in the background. Call it only once
+// the transaction they were published in has committed.
+func (b *EventBus) Dispatch(rows ...OutboxEvent) {
+	if b == nil {
+		return
+	}
+
+	for _, row := range rows {
+		event, err := decodeEvent(row.Type, row.Payload)
+		if err != nil {
+			log.Printf("Error decoding %s event %s: %v\n", row.Type, row.ID, err)
+			continue
+		}
+
+		b.pending.Add(1)
+		go func(row OutboxEvent) {
+			defer b.pending.Done()
+			b.dispatch(row, event, true)
+		}(row)
+	}
+}
+
+// Wait blocks until the events published so far have been dispatched
+func (b *EventBus) Wait() {
+	b.pending.Wait()
+}
+
+// RunDispatcher retries stored events that have not reached all their subscribers. It never returns.
+func (b *EventBus) RunDispatcher(interval time.Duration) {
+	for range time.Tick(interval) {
+		b.dispatchPending()
+	}
+}
+
+// dispatchPending claims the events that are due, so neither a dispatch still running nor
+// another instance polling at the same time gets them too
+func (b *EventBus) dispatchPending() {
+	now := b.clock.Now()
+	rows, err := b.outbox.ClaimPendingEvents(now, now.Add(OutboxLease), MaxEventAttempts, 100)
+	if err != nil {
+		log.Printf("Error fetching pending events: %v\n", err)
+		return
+	}
+
+	for _, row := range rows {
+		event, err := decodeEvent(row.Type, row.Payload)
+		if err != nil {
+			b.outbox.RecordFailure(row.ID, fmt.Sprintf("failed to decode event: %v", err), now.Add(OutboxRetryDelay))
+			continue
+		}
+		b.dispatch(row, event, false)
+	}
+}
+
+// dispatch delivers an event to every subscriber that hasn't had it yet. Fresh events, just
+// committed, can't have been delivered to anyone.
+func (b *EventBus) dispatch(row OutboxEvent, event Event, fresh bool) {
+	delivered := map[string]bool{}
+	if !fresh {
+		names, err := b.outbox.GetDeliveredSubscribers(row.ID)
+		if err != nil {
+			log.Printf("Error fetching deliveries of event %s: %v\n", row.ID, err)
+			return
+		}
+		for _, name := range names {
+			delivered[name] = true
+		}
+	}
+
+	b.mu.RLock()
+	subscribers := b.subscribers[row.Type]
+	b.mu.RUnlock()
+
+	var failures []string
+	for _, sub := range subscribers {
+		if delivered[sub.name] {
+			continue
+		}
+
+		err := callSubscriber(sub, row, event)
+		if err != nil {
+			log.Printf("Subscriber %s failed on %s event %s: %v\n", sub.name, row.Type, row.ID, err)
+			failures = append(failures, sub.name+": "+err.Error())
+			continue
+		}
+
+		err = b.outbox.RecordDelivery(row.ID, sub.name, b.clock.Now())
+		if err != nil {
+			log.Printf("Error recording delivery of event %s: %v\n", row.ID, err)
+		}
+	}
+
+	if len(failures) > 0 {
+		err := b.outbox.RecordFailure(row.ID, strings.Join(failures, "; "), b.clock.Now().Add(OutboxRetryDelay))
+		if err != nil {
+			log.Printf("Error recording failure of event %s: %v\n", row.ID, err)
+		}
+		return
+	}
+
+	err := b.outbox.MarkDispatched(row.ID, b.clock.Now())
+	if err != nil {
+		log.Printf("Error marking event %s dispatched: %v\n", row.ID, err)
+	}
+}
+
+// callSubscriber turns a panicking subscriber into a failed delivery
+func callSubscriber(sub namedSubscriber, row OutboxEvent, event Event) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	if sub.handleStored != nil {
+		return sub.handleStored(row)
+	}
+	return sub.handle(event)
+}
+
+// unitOfWork is one database transaction. Events published in it are stored in the same
+// transaction and dispatched once it commits, so subscribers never hear of a change that was
+// rolled back and no committed change goes unannounced.
+type unitOfWork struct {
+	tx     *sql.Tx // nil without a database, as in tests
+	bus    *EventBus
+	events []OutboxEvent
+}
+
+func (u *unitOfWork) publish(event Event) error {
+	row, err := u.bus.Publish(u.tx, event)
+	if err != nil {
+		return err
+	}
+	u.events = append(u.events, row)
+	return nil
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"encoding/base64"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
-	"os"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
@@ -37,17 +41,23 @@ func loginHandler(c *gin.Context) {
 		return
 	}
 
+	if user.Frozen {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Account is frozen"})
+		return
+	}
+
 	claims := CustomClaims{
 		UserID: user.ID,
+		Role:   user.Role,
 		RegisteredClaims: jwt.RegisteredClaims{
 			ExpiresAt: jwt.NewNumericDate(time.Now().Add(72 * time.Hour)),
 		},
 	}
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString([]byte(os.Getenv("JWT_SECRET")))
+	tokenString, err := keySet.Sign(claims)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"token": tokenString})
@@ -82,37 +92,24 @@ func registerHandler(c *gin.Context) {
 		Name:      req.Name,
 		Email:     req.Email,
 		Password:  string(hashedPassword),
+		Role:      RoleUser,
 		CreatedAt: time.Now(),
 	}
 
-	err = txnService.userRepo.CreateUser(&newUser)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register user"})
-		return
-	}
-
 	// Insert default pref for the new user
 	defaultPrefs := UserPreferences{
-		RoundupCategories: []string{},
-		GoalName:          "",
-		GoalAmount:        0,
-		TargetDate:        time.Time{},
-		CurrentSavings:    0,
-		RoundupHistory:    []float64{},
-		RoundupDates:      []time.Time{},
+		RoundupCategories:    []string{},
+		GoalAllocation:       AllocationWeight,
+		CurrentSavings:       0,
+		CategoryMultipliers:  map[string]float64{},
+		NotificationChannels: map[string][]string{},
 	}
 
-	err = txnService.userRepo.CreateUserPreferences(newUser.ID, defaultPrefs)
+	// the user, their preferences and wallet are created together
+	err = txnService.RegisterUser(&newUser, defaultPrefs)
 	if err != nil {
 		fmt.Println(err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user preferences"})
-		return
-	}
-
-	// Create wallet for the new user
-	err = txnService.CreateUserWallet(newUser.ID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user wallet"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register user"})
 		return
 	}
 
@@ -185,21 +182,137 @@ func getTransactionsHandler(c *gin.Context) {
 		return
 	}
 
-	transactions, err := txnService.repo.GetTransactionsByUserID(uid)
-
-	for i, j := 0, len(transactions)-1; i < j; i, j = i+1, j-1 {
-		transactions[i], transactions[j] = transactions[j], transactions[i]
+	filter, err := parseTransactionFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
 	}
 
+	// one extra row tells us whether there is another page
+	limit := filter.Limit
+	filter.Limit++
+
+	transactions, err := txnService.repo.ListTransactions(uid, filter)
 	if err != nil {
 		fmt.Println(err)
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to retrieve transactions"})
 		return
 	}
 
+	if len(transactions) > limit {
+		transactions = transactions[:limit]
+		setNextCursor(c, transactions[limit-1].CreatedAt, transactions[limit-1].ID)
+	}
+
+	if transactions == nil {
+		transactions = []Transaction{}
+	}
+
 	c.JSON(http.StatusOK, transactions)
 }
 
+const DefaultPageSize = 50
+const MaxPageSize = 200
+
+// parseTransactionFilter reads the list query parameters: from and to (YYYY-MM-DD, inclusive),
+// category, merchant, min_amount, max_amount, roundup_enabled, cursor and limit
+func parseTransactionFilter(c *gin.Context) (TransactionFilter, error) {
+	filter := TransactionFilter{
+		Category: c.Query("category"),
+		Merchant: c.Query("merchant"),
+		Limit:    DefaultPageSize,
+	}
+
+	if s := c.Query("from"); s != "" {
+		from, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			return filter, errors.New("Invalid from date. Use YYYY-MM-DD")
+		}
+		filter.From = &from
+	}
+
+	if s := c.Query("to"); s != "" {
+		to, err := time.Parse("2006-01-02", s)
+		if err != nil {
+			return filter, errors.New("Invalid to date. Use YYYY-MM-DD")
+		}
+		to = to.AddDate(0, 0, 1) // up to the end of that day
+		filter.To = &to
+	}
+
+	if s := c.Query("min_amount"); s != "" {
+		amount, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return filter, errors.New("min_amount must be a number")
+		}
+		filter.MinAmount = &amount
+	}
+
+	if s := c.Query("max_amount"); s != "" {
+		amount, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return filter, errors.New("max_amount must be a number")
+		}
+		filter.MaxAmount = &amount
+	}
+
+	if s := c.Query("roundup_enabled"); s != "" {
+		enabled, err := strconv.ParseBool(s)
+		if err != nil {
+			return filter, errors.New("roundup_enabled must be true or false")
+		}
+		filter.RoundupEnabled = &enabled
+	}
+
+	if s := c.Query("cursor"); s != "" {
+		cursor, err := decodeCursor(s)
+		if err != nil {
+			return filter, errors.New("Invalid cursor")
+		}
+		filter.After = &cursor
+	}
+
+	if s := c.Query("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > MaxPageSize {
+			return filter, fmt.Errorf("limit must be between 1 and %d", MaxPageSize)
+		}
+		filter.Limit = limit
+	}
+
+	return filter, nil
+}
+
+// setNextCursor tells the client where the next page starts. Lists keep their plain array body,
+// so the cursor goes in the X-Next-Cursor header, which is left out on the last page.
+func setNextCursor(c *gin.Context, createdAt time.Time, id string) {
+	c.Header("X-Next-Cursor", encodeCursor(PageCursor{CreatedAt: createdAt, ID: id}))
+}
+
+// encodeCursor makes an opaque cursor value out of the last item on a page
+func encodeCursor(cursor PageCursor) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(cursor.CreatedAt.Format(time.RFC3339Nano) + "|" + cursor.ID))
+}
+
+func decodeCursor(s string) (PageCursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return PageCursor{}, err
+	}
+
+	parts := strings.SplitN(string(data), "|", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return PageCursor{}, errors.New("malformed cursor")
+	}
+
+	createdAt, err := time.Parse(time.RFC3339Nano, parts[0])
+	if err != nil {
+		return PageCursor{}, err
+	}
+
+	return PageCursor{CreatedAt: createdAt, ID: parts[1]}, nil
+}
+
 func addTransactionHandler(c *gin.Context) {
 	userID, exists := c.Get("userID")
 	if !exists {
@@ -223,7 +336,19 @@ func addTransactionHandler(c *gin.Context) {
 
 	txn.UserID = uid
 	txn.ID = uuid.New().String()
-	txn.CreatedAt = time.Now()
+	txn.CreatedAt = txnService.clock.Now()
+
+	// checked before ProcessRoundup saves the transaction, which it does whether or not a roundup applies.
+	// A failure here shouldn't block the payment.
+	budget, budgetExceeded, err := txnService.CheckBudget(uid, txn)
+	if err != nil {
+		log.Printf("Error checking budget: %v\n", err)
+	}
+
+	err = txnService.FlagAnomalies(uid, &txn)
+	if err != nil {
+		log.Printf("Error checking for anomalies: %v\n", err)
+	}
 
 	roundup, merchantURI, roundupURI, err := txnService.ProcessRoundup(uid, txn)
 	if err != nil {
@@ -233,6 +358,13 @@ func addTransactionHandler(c *gin.Context) {
 
 	txn.Roundup = roundup
 
+	// the saved copy itemises caps and any budget penalty
+	saved, err := txnService.repo.GetTransactionByID(txn.ID)
+	if err == nil {
+		saved.Roundup = roundup
+		txn = *saved
+	}
+
 	response := gin.H{
 		"message":      "Transaction added successfully",
 		"transaction":  txn,
@@ -240,9 +372,121 @@ func addTransactionHandler(c *gin.Context) {
 		"roundup_uri":  roundupURI,
 	}
 
+	if budget != nil {
+		response["budget"] = budget
+		response["budget_exceeded"] = budgetExceeded // this transaction took the category over its limit
+	}
+
 	c.JSON(http.StatusOK, response)
 }
 
+func simulateRoundupHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	// goals, goal_allocation, roundup_categories and category_multipliers fall back to the user's own when left out
+	var req struct {
+		Transactions []struct {
+			Amount   float64 `json:"amount" binding:"required"`
+			Category string  `json:"category"`
+		} `json:"transactions" binding:"required,min=1,dive"`
+		Goals []struct {
+			goalRequest
+			CurrentSavings float64 `json:"current_savings"`
+		} `json:"goals"`
+		GoalAllocation      string             `json:"goal_allocation"`
+		RoundupCategories   []string           `json:"roundup_categories"`
+		CategoryMultipliers map[string]float64 `json:"category_multipliers"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+
+	user, err := txnService.userRepo.FindByID(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find user"})
+		return
+	}
+
+	if req.GoalAllocation != "" && req.GoalAllocation != AllocationWeight && req.GoalAllocation != AllocationPriority {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "goal_allocation must be weight or priority"})
+		return
+	}
+
+	prefs := user.Preferences
+	if req.GoalAllocation != "" {
+		prefs.GoalAllocation = req.GoalAllocation
+	}
+	if req.RoundupCategories != nil {
+		prefs.RoundupCategories = req.RoundupCategories
+	}
+	if req.CategoryMultipliers != nil {
+		prefs.CategoryMultipliers, err = normalizeCategoryMultipliers(req.CategoryMultipliers)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid category_multipliers: " + err.Error()})
+			return
+		}
+	}
+
+	var goals []Goal
+	if req.Goals == nil {
+		// read only, RefreshGoals would save goal transitions and announce milestones from a dry run
+		goals, err = txnService.goalRepo.GetGoalsByUserID(uid)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve goals"})
+			return
+		}
+		goals = filterActiveGoals(goals, txnService.clock.Now())
+	} else {
+		for i, g := range req.Goals {
+			targetDate, err := g.parse()
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Goal %d: %s", i+1, err.Error())})
+				return
+			}
+
+			goals = append(goals, Goal{
+				ID:             fmt.Sprintf("simulated-%d", i+1),
+				Name:           g.Name,
+				Amount:         g.Amount,
+				TargetDate:     targetDate,
+				CurrentSavings: g.CurrentSavings,
+				Priority:       g.Priority,
+				Weight:         g.Weight,
+				Status:         GoalActive,
+			})
+		}
+	}
+
+	var transactions []Transaction
+	for _, t := range req.Transactions {
+		transactions = append(transactions, Transaction{
+			Amount:         t.Amount,
+			Category:       t.Category,
+			RoundupEnabled: true,
+		})
+	}
+
+	results, err := txnService.SimulateRoundups(uid, prefs, goals, transactions)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to simulate roundups"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
 func getTransactionByIDHandler(c *gin.Context) {
 	userID, exists := c.Get("userID")
 	if !exists {
@@ -316,17 +560,45 @@ func updatePreferencesHandler(c *gin.Context) {
 	err := c.BindJSON(&newPrefs)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		return
+	}
+
+	if newPrefs.GoalAllocation == "" {
+		newPrefs.GoalAllocation = AllocationWeight
+	}
+
+	if newPrefs.GoalAllocation != AllocationWeight && newPrefs.GoalAllocation != AllocationPriority {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "goal_allocation must be weight or priority"})
+		return
+	}
+
+	if newPrefs.TransactionRoundupCap < 0 || newPrefs.DailyRoundupCap < 0 || newPrefs.WeeklyRoundupCap < 0 || newPrefs.MonthlyRoundupCap < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Roundup caps cannot be negative"})
+		return
+	}
+
+	newPrefs.CategoryMultipliers, err = normalizeCategoryMultipliers(newPrefs.CategoryMultipliers)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid category_multipliers: " + err.Error()})
+		return
+	}
+
+	newPrefs.NotificationChannels, err = normalizeNotificationChannels(newPrefs.NotificationChannels)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid notification_channels: " + err.Error()})
+		return
 	}
 
-	err = txnService.userRepo.UpdatePreferences(uid, newPrefs)
+	err = txnService.userRepo.UpdatePreferences(nil, uid, newPrefs)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user preferences"})
+		return
 	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "User preferences updates successfully"})
 }
 
-func getGoalHandler(c *gin.Context) {
+func listGoalsHandler(c *gin.Context) {
 	userID, exists := c.Get("userID")
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
@@ -339,28 +611,91 @@ func getGoalHandler(c *gin.Context) {
 		return
 	}
 
-	user, err := txnService.userRepo.FindByID(uid)
+	goals, err := txnService.RefreshGoals(uid)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find user"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve goals"})
 		return
 	}
 
-	type Goal struct {
-		Name   string    `json:"name"`
-		Amount float64   `json:"amount"`
-		Date   time.Time `json:"date"`
+	// optional ?status= filter, e.g. to hide archived goals
+	if status := c.Query("status"); status != "" {
+		filtered := []Goal{}
+		for _, goal := range goals {
+			if goal.Status == status {
+				filtered = append(filtered, goal)
+			}
+		}
+		goals = filtered
 	}
 
-	var goal Goal
+	c.JSON(http.StatusOK, goals)
+}
 
-	goal.Amount = user.Preferences.GoalAmount
-	goal.Date = user.Preferences.TargetDate
-	goal.Name = user.Preferences.GoalName
+func getGoalHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	goal, err := txnService.goalRepo.GetGoalByID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Goal not found"})
+		return
+	}
+
+	if goal.UserID != uid {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
 
 	c.JSON(http.StatusOK, goal)
 }
 
-func addGoalHandler(c *gin.Context) {
+// goalRequest is the payload for creating and updating goals
+type goalRequest struct {
+	Name       string  `json:"name" binding:"required"`
+	Amount     float64 `json:"amount" binding:"required"`
+	TargetDate string  `json:"date" binding:"required"`
+	Priority   int     `json:"priority"`
+	Weight     float64 `json:"weight"`
+	OnComplete string  `json:"on_complete"`
+}
+
+// parse validates the request and returns the target date
+func (req goalRequest) parse() (time.Time, error) {
+	if req.Amount <= 0 {
+		return time.Time{}, errors.New("Amount must be positive")
+	}
+
+	if req.Weight < 0 {
+		return time.Time{}, errors.New("Weight cannot be negative")
+	}
+
+	if req.OnComplete != "" && req.OnComplete != SurplusNextGoal && req.OnComplete != SurplusWallet {
+		return time.Time{}, errors.New("on_complete must be next_goal or wallet")
+	}
+
+	// Parse the target date ensuring the format is YYYY-MM-DD
+	targetDate, err := time.Parse("2006-01-02", req.TargetDate)
+	if err != nil {
+		return time.Time{}, errors.New("Invalid date format. Use YYYY-MM-DD")
+	}
+
+	if !targetDate.After(txnService.clock.Now()) {
+		return time.Time{}, errors.New("Target date must be in the future")
+	}
+
+	return targetDate, nil
+}
+
+func createGoalHandler(c *gin.Context) {
 	userID, exists := c.Get("userID")
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
@@ -373,50 +708,123 @@ func addGoalHandler(c *gin.Context) {
 		return
 	}
 
-	var req struct {
-		GoalName   string  `json:"name" binding:"required"`
-		GoalAmount float64 `json:"amount" binding:"required"`
-		TargetDate string  `json:"date" binding:"required"`
+	var req goalRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
 	}
 
-	err := c.BindJSON(&req)
+	targetDate, err := req.parse()
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	targetDate, err := time.Parse("2006-01-02", req.TargetDate)
+	if req.Weight == 0 {
+		req.Weight = 1
+	}
+
+	if req.OnComplete == "" {
+		req.OnComplete = SurplusWallet
+	}
+
+	goal := Goal{
+		ID:         uuid.New().String(),
+		UserID:     uid,
+		Name:       req.Name,
+		Amount:     req.Amount,
+		TargetDate: targetDate,
+		Priority:   req.Priority,
+		Weight:     req.Weight,
+		Status:     GoalActive,
+		OnComplete: req.OnComplete,
+		CreatedAt:  txnService.clock.Now(),
+	}
+
+	err = txnService.goalRepo.CreateGoal(goal)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date format. Use YYYY-MM-DD"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add goal"})
 		return
 	}
 
-	user, err := txnService.userRepo.FindByID(uid)
+	c.JSON(http.StatusOK, gin.H{"message": "Goal added successfully", "goal": goal})
+}
+
+func updateGoalHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	var req goalRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+
+	targetDate, err := req.parse()
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find user"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	if user.Preferences.GoalAmount > 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Goal already exists. Create PUT request to update it"})
+	goal, err := txnService.goalRepo.GetGoalByID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Goal not found"})
 		return
 	}
 
-	user.Preferences.GoalName = req.GoalName
-	user.Preferences.GoalAmount = req.GoalAmount
-	user.Preferences.TargetDate = targetDate
+	if goal.UserID != uid {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	if goal.Status == GoalArchived {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Archived goals cannot be changed"})
+		return
+	}
 
-	err = txnService.userRepo.Update(user)
+	goal.Name = req.Name
+	goal.Amount = req.Amount
+	goal.TargetDate = targetDate
+	goal.Priority = req.Priority
+	if req.Weight > 0 {
+		goal.Weight = req.Weight
+	}
+	if req.OnComplete != "" {
+		goal.OnComplete = req.OnComplete
+	}
+
+	err = txnService.goalRepo.UpdateGoal(*goal)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add goal"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update goal"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Goal added successfully"})
+	// lowering the amount can complete the goal on the spot
+	_, err = txnService.RefreshGoals(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update goal state"})
+		return
+	}
+
+	goal, err = txnService.goalRepo.GetGoalByID(goal.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve goal"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Goal updated successfully", "goal": goal})
 }
 
-func changeGoalHandler(c *gin.Context) {
-	// Retrieve the userID from the context
+func changeGoalStatusHandler(c *gin.Context) {
 	userID, exists := c.Get("userID")
 	if !exists {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
@@ -429,52 +837,104 @@ func changeGoalHandler(c *gin.Context) {
 		return
 	}
 
-	// Define the request payload with required fields
 	var req struct {
-		GoalName   string  `json:"name" binding:"required"`
-		GoalAmount float64 `json:"amount" binding:"required"`
-		TargetDate string  `json:"date" binding:"required"`
+		Status string `json:"status" binding:"required"`
 	}
 
-	// Bind and validate the JSON payload
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
 		return
 	}
 
-	// Parse the target date ensuring the format is YYYY-MM-DD
-	targetDate, err := time.Parse("2006-01-02", req.TargetDate)
+	goal, err := txnService.goalRepo.GetGoalByID(c.Param("id"))
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid date format. Use YYYY-MM-DD"})
+		c.JSON(http.StatusNotFound, gin.H{"error": "Goal not found"})
 		return
 	}
 
-	// Find the user by ID
-	user, err := txnService.userRepo.FindByID(uid)
+	if goal.UserID != uid {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	err = txnService.ChangeGoalStatus(goal, req.Status)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to find user"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
 
-	// Check if a goal is already set (business logic)
-	if user.Preferences.GoalAmount == 0 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "No goal set. Use addGoalHandler to create one."})
+	c.JSON(http.StatusOK, gin.H{"message": "Goal status updated successfully", "goal": goal})
+}
+
+func getGoalProgressHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
 		return
 	}
 
-	// Update user preferences with the new goal data
-	user.Preferences.GoalName = req.GoalName
-	user.Preferences.GoalAmount = req.GoalAmount
-	user.Preferences.TargetDate = targetDate
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
 
-	// Persist the updated user record
-	err = txnService.userRepo.Update(user)
+	goal, err := txnService.goalRepo.GetGoalByID(c.Param("id"))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update goal"})
+		c.JSON(http.StatusNotFound, gin.H{"error": "Goal not found"})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "Goal updated successfully"})
+	if goal.UserID != uid {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	progress, err := txnService.GetGoalProgress(uid, *goal)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to calculate goal progress: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, progress)
+}
+
+func deleteGoalHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	goal, err := txnService.goalRepo.GetGoalByID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Goal not found"})
+		return
+	}
+
+	if goal.UserID != uid {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	// savings stay on record, funded goals are abandoned or archived instead
+	deleted, err := txnService.goalRepo.DeleteGoal(goal.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete goal"})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusConflict, gin.H{"error": "Goal has savings, abandon or archive it instead"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Goal deleted successfully"})
 }
 
 func getWalletBalanceHandler(c *gin.Context) {
@@ -512,12 +972,31 @@ func getWalletTransactionsHandler(c *gin.Context) {
 		return
 	}
 
-	transactions, err := txnService.GetWalletTransactions(uid)
+	filter, err := parseTransactionFilter(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// one extra row tells us whether there is another page
+	limit := filter.Limit
+	filter.Limit++
+
+	transactions, err := txnService.ListWalletTransactions(uid, filter)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get wallet transactions: " + err.Error()})
 		return
 	}
 
+	if len(transactions) > limit {
+		transactions = transactions[:limit]
+		setNextCursor(c, transactions[limit-1].CreatedAt, transactions[limit-1].ID)
+	}
+
+	if transactions == nil {
+		transactions = []WalletTransaction{}
+	}
+
 	c.JSON(http.StatusOK, transactions)
 }
 
@@ -549,7 +1028,7 @@ func addToWalletHandler(c *gin.Context) {
 		return
 	}
 
-	err := txnService.AddToWallet(uid, req.Amount, req.Description)
+	err := txnService.AddToWallet(uid, req.Amount, req.Description, "")
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add to wallet: " + err.Error()})
 		return
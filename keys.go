@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"math/big"
+	"os"
+	"strings"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Global variable
+var keySet *KeySet
+
+// verificationKey is a public key that tokens may be verified against
+type verificationKey struct {
+	kid    string
+	method jwt.SigningMethod
+	key    crypto.PublicKey
+}
+
+// KeySet holds the active signing key and every key still accepted for verification.
+// Rotating keys means moving the old key to JWT_VERIFICATION_KEYS and configuring a new signing key.
+type KeySet struct {
+	signingKID    string
+	signingMethod jwt.SigningMethod
+	signingKey    crypto.Signer
+	verifyKeys    map[string]verificationKey
+	verifyOrder   []string // keeps the JWKS output stable
+}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`   // RSA modulus
+	E   string `json:"e,omitempty"`   // RSA exponent
+	Crv string `json:"crv,omitempty"` // OKP curve
+	X   string `json:"x,omitempty"`   // OKP public key
+}
+
+// loadKeySet reads the signing key from JWT_PRIVATE_KEY_FILE (with its id in JWT_KEY_ID)
+// and any extra public keys from JWT_VERIFICATION_KEYS, given as "kid=/path/to/key.pem,..."
+func loadKeySet() (*KeySet, error) {
+	keyFile := os.Getenv("JWT_PRIVATE_KEY_FILE")
+	kid := os.Getenv("JWT_KEY_ID")
+	if keyFile == "" || kid == "" {
+		return nil, errors.New("JWT_PRIVATE_KEY_FILE and JWT_KEY_ID must be set")
+	}
+
+	pemBytes, err := os.ReadFile(keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %v", err)
+	}
+
+	ks := &KeySet{
+		signingKID: kid,
+		verifyKeys: map[string]verificationKey{},
+	}
+
+	if rsaKey, err := jwt.ParseRSAPrivateKeyFromPEM(pemBytes); err == nil {
+		ks.signingMethod = jwt.SigningMethodRS256
+		ks.signingKey = rsaKey
+	} else if edKey, err := jwt.ParseEdPrivateKeyFromPEM(pemBytes); err == nil {
+		ks.signingMethod = jwt.SigningMethodEdDSA
+		ks.signingKey = edKey.(crypto.Signer)
+	} else {
+		return nil, errors.New("signing key must be an RSA or Ed25519 private key in PEM format")
+	}
+
+	ks.addVerificationKey(kid, ks.signingMethod, ks.signingKey.Public())
+
+	extra := os.Getenv("JWT_VERIFICATION_KEYS")
+	for _, entry := range strings.Split(extra, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		parts := strings.SplitN(entry, "=", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid JWT_VERIFICATION_KEYS entry %q, expected kid=path", entry)
+		}
+
+		if _, exists := ks.verifyKeys[parts[0]]; exists {
+			return nil, fmt.Errorf("duplicate key id %q", parts[0])
+		}
+
+		pubBytes, err := os.ReadFile(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("failed to read verification key %q: %v", parts[0], err)
+		}
+
+		if rsaPub, err := jwt.ParseRSAPublicKeyFromPEM(pubBytes); err == nil {
+			ks.addVerificationKey(parts[0], jwt.SigningMethodRS256, rsaPub)
+		} else if edPub, err := jwt.ParseEdPublicKeyFromPEM(pubBytes); err == nil {
+			ks.addVerificationKey(parts[0], jwt.SigningMethodEdDSA, edPub)
+		} else {
+			return nil, fmt.Errorf("verification key %q must be an RSA or Ed25519 public key in PEM format", parts[0])
+		}
+	}
+
+	return ks, nil
+}
+
+func (ks *KeySet) addVerificationKey(kid string, method jwt.SigningMethod, key crypto.PublicKey) {
+	ks.verifyKeys[kid] = verificationKey{kid: kid, method: method, key: key}
+	ks.verifyOrder = append(ks.verifyOrder, kid)
+}
+
+// Sign issues a token with the active key and stamps its kid in the header
+func (ks *KeySet) Sign(claims jwt.Claims) (string, error) {
+	token := jwt.NewWithClaims(ks.signingMethod, claims)
+	token.Header["kid"] = ks.signingKID
+	return token.SignedString(ks.signingKey)
+}
+
+// keyFunc picks the verification key named by the token's kid header
+func (ks *KeySet) keyFunc(token *jwt.Token) (interface{}, error) {
+	kid, ok := token.Header["kid"].(string)
+	if !ok || kid == "" {
+		return nil, errors.New("token has no kid header")
+	}
+
+	vk, ok := ks.verifyKeys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+
+	if token.Method.Alg() != vk.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method %q for key %q", token.Method.Alg(), kid)
+	}
+
+	return vk.key, nil
+}
+
+func (ks *KeySet) validMethods() []string {
+	return []string{jwt.SigningMethodRS256.Alg(), jwt.SigningMethodEdDSA.Alg()}
+}
+
+// JWKS returns the public half of every verification key
+func (ks *KeySet) JWKS() []JWK {
+	keys := []JWK{}
+	for _, kid := range ks.verifyOrder {
+		vk := ks.verifyKeys[kid]
+		switch pub := vk.key.(type) {
+		case *rsa.PublicKey:
+			keys = append(keys, JWK{
+				Kty: "RSA",
+				Kid: kid,
+				Use: "sig",
+				Alg: vk.method.Alg(),
+				N:   base64.RawURLEncoding.EncodeToString(pub.N.Bytes()),
+				E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes()),
+			})
+		case ed25519.PublicKey:
+			keys = append(keys, JWK{
+				Kty: "OKP",
+				Kid: kid,
+				Use: "sig",
+				Alg: vk.method.Alg(),
+				Crv: "Ed25519",
+				X:   base64.RawURLEncoding.EncodeToString(pub),
+			})
+		}
+	}
+	return keys
+}
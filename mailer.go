@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"os"
+	"strings"
+	"time"
+)
+
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// LogMailer writes emails to the log instead of sending them. Used until a real provider is configured.
+type LogMailer struct{}
+
+func (m *LogMailer) Send(to, subject, body string) error {
+	log.Printf("Email to %s: %s\n%s", to, subject, body)
+	return nil
+}
+
+// SMTPMailer sends plain text emails through an SMTP server
+type SMTPMailer struct {
+	addr   string    // host:port
+	from   string    // From header, e.g. "RoundUp <no-reply@roundup.app>"
+	sender string    // envelope address
+	auth   smtp.Auth // nil for servers that don't need a login, like a local test server
+}
+
+// newMailer returns an SMTPMailer if SMTP_ADDR is set, with SMTP_FROM as the sender and
+// SMTP_USERNAME and SMTP_PASSWORD as the optional login. Otherwise emails only go to the log.
+func newMailer() (Mailer, error) {
+	addr := os.Getenv("SMTP_ADDR")
+	if addr == "" {
+		return &LogMailer{}, nil
+	}
+
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP_ADDR %q, expected host:port", addr)
+	}
+
+	from, err := mail.ParseAddress(os.Getenv("SMTP_FROM"))
+	if err != nil {
+		return nil, fmt.Errorf("SMTP_FROM must be set to a valid address when SMTP_ADDR is: %v", err)
+	}
+
+	mailer := &SMTPMailer{addr: addr, from: from.String(), sender: from.Address}
+	if username := os.Getenv("SMTP_USERNAME"); username != "" {
+		mailer.auth = smtp.PlainAuth("", username, os.Getenv("SMTP_PASSWORD"), host)
+	}
+	return mailer, nil
+}
+
+func (m *SMTPMailer) Send(to, subject, body string) error {
+	// header values come from our own templates and user emails, but a stray newline would let them add headers
+	if strings.ContainsAny(to+subject, "\r\n") {
+		return fmt.Errorf("email headers cannot contain line breaks")
+	}
+
+	var msg strings.Builder
+	fmt.Fprintf(&msg, "From: %s\r\n", m.from)
+	fmt.Fprintf(&msg, "To: %s\r\n", to)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	err := smtp.SendMail(m.addr, m.auth, m.sender, []string{to}, []byte(msg.String()))
+	if err != nil {
+		return fmt.Errorf("failed to send email: %v", err)
+	}
+	return nil
+}
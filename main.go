@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"fmt"
 	"log"
+	"os"
 
 	"github.com/gin-gonic/gin"
 	_ "github.com/lib/pq"
@@ -14,6 +15,21 @@ var txnService *TransactionService
 
 // main function
 func main() {
+	// offline tools run instead of the server
+	if len(os.Args) > 1 && os.Args[1] == "backtest" {
+		err := runBacktest(os.Args[2:])
+		if err != nil {
+			log.Fatalf("Backtest failed: %v", err)
+		}
+		return
+	}
+
+	var err error
+	keySet, err = loadKeySet()
+	if err != nil {
+		log.Fatalf("Failed to load JWT keys: %v", err)
+	}
+
 	db, err := connectDB()
 	if err != nil {
 		log.Fatalf("Failed to connect to database: %v", err)
@@ -24,19 +40,62 @@ func main() {
 	userRepo := &PostgresUserRepository{db: db}
 	UPIclient := &DummyUPIClient{}
 	walletRepo := &PostgresWalletRepository{db: db}
+	goalRepo := &PostgresGoalRepository{db: db}
+	eventRepo := &PostgresRoundupEventRepository{db: db}
+	budgetRepo := &PostgresBudgetRepository{db: db}
+	subRepo := &PostgresSubscriptionRepository{db: db}
+	notifRepo := &PostgresNotificationRepository{db: db}
+	hookRepo := &PostgresWebhookRepository{db: db}
+	eventBus := NewEventBus(&PostgresOutboxRepository{db: db}, realClock{})
+
+	mailer, err := newMailer()
+	if err != nil {
+		log.Fatalf("Failed to configure email: %v", err)
+	}
+
+	notificationService := NewNotificationService(userRepo, map[string]Notifier{
+		ChannelEmail: &EmailNotifier{mailer: mailer},
+		ChannelPush:  newPushNotifier(notifRepo),
+		ChannelInApp: &InAppNotifier{repo: notifRepo},
+	}, realClock{})
+	notificationService.Subscribe(eventBus)
+
+	streamHub = NewStreamHub(goalRepo)
+	streamHub.Subscribe(eventBus)
+
+	allowLocalhost := webhooksAllowLocalhost()
+	webhookService = NewWebhookService(hookRepo, newWebhookClient(allowLocalhost), realClock{})
+	webhookService.allowLocalhost = allowLocalhost
+	webhookService.Subscribe(eventBus)
 
 	txnService = &TransactionService{
 		repo:       txRepo,
 		userRepo:   userRepo,
 		upiClient:  UPIclient,
 		walletRepo: walletRepo,
+		goalRepo:   goalRepo,
+		eventRepo:  eventRepo,
+		budgetRepo: budgetRepo,
+		subRepo:    subRepo,
+		events:     eventBus,
+		notifRepo:  notifRepo,
+		hookRepo:   hookRepo,
+		mailer:     mailer,
+		clock:      realClock{},
+		db:         db,
 	}
 
+	// retries events whose subscribers failed, including any left over from before a restart
+	go eventBus.RunDispatcher(OutboxPollInterval)
+	go webhookService.RunRetries(WebhookPollInterval)
+
 	router := gin.Default()
 
 	// public routes
+	router.GET("/.well-known/jwks.json", jwksHandler)
 	router.POST("/api/v1/auth/register", registerHandler)
 	router.POST("/api/v1/auth/login", loginHandler)
+	router.POST("/api/v1/auth/verify-email", verifyEmailHandler)
 	router.POST("/api/v1/upi/verify", verifyUPIHandler)
 	router.POST("/api/v1/transaction/type", getTransactionTypeHandler)
 
@@ -47,19 +106,82 @@ func main() {
 		authorized.GET("/transactions", getTransactionsHandler)
 		authorized.POST("/transaction", addTransactionHandler)
 		authorized.GET("/transactions/:id", getTransactionByIDHandler)
+		authorized.POST("/roundup/simulate", simulateRoundupHandler)
 
 		authorized.GET("/preferences", getPreferencesHandler)
 		authorized.PUT("/preferences", updatePreferencesHandler)
 
-		authorized.GET("/preferences/goal", getGoalHandler)
-		authorized.POST("/preferences/goal", addGoalHandler)
-		authorized.PUT("/preferences/goal", changeGoalHandler)
+		authorized.GET("/goals", listGoalsHandler)
+		authorized.POST("/goals", createGoalHandler)
+		authorized.GET("/goals/:id", getGoalHandler)
+		authorized.PUT("/goals/:id", updateGoalHandler)
+		authorized.PUT("/goals/:id/status", changeGoalStatusHandler)
+		authorized.GET("/goals/:id/progress", getGoalProgressHandler)
+		authorized.DELETE("/goals/:id", deleteGoalHandler)
 
 		authorized.GET("/wallet/balance", getWalletBalanceHandler)
 		authorized.GET("/wallet/transactions", getWalletTransactionsHandler)
 		authorized.POST("/wallet/add", addToWalletHandler)
 		authorized.POST("/wallet/withdraw", withdrawFromWalletHandler)
 
+		authorized.GET("/budgets", listBudgetsHandler)
+		authorized.POST("/budgets", createBudgetHandler)
+		authorized.GET("/budgets/:id", getBudgetHandler)
+		authorized.PUT("/budgets/:id", updateBudgetHandler)
+		authorized.DELETE("/budgets/:id", deleteBudgetHandler)
+
+		authorized.GET("/subscriptions", listSubscriptionsHandler)
+		authorized.PUT("/subscriptions/:id/status", changeSubscriptionStatusHandler)
+
+		authorized.GET("/stream", streamHandler)
+
+		authorized.GET("/notifications", listNotificationsHandler)
+		authorized.POST("/notifications/read-all", markAllNotificationsReadHandler)
+		authorized.PUT("/notifications/:id/read", markNotificationReadHandler)
+		authorized.DELETE("/notifications/:id", deleteNotificationHandler)
+
+		authorized.GET("/webhooks", listWebhooksHandler)
+		authorized.POST("/webhooks", createWebhookHandler)
+		authorized.PUT("/webhooks/:id", updateWebhookHandler)
+		authorized.DELETE("/webhooks/:id", deleteWebhookHandler)
+		authorized.GET("/webhooks/:id/deliveries", listWebhookDeliveriesHandler)
+		authorized.POST("/webhooks/:id/deliveries/:delivery_id/replay", replayWebhookDeliveryHandler)
+
+		authorized.GET("/analytics/spending", spendingAnalyticsHandler)
+		authorized.GET("/analytics/merchants", merchantAnalyticsHandler)
+		authorized.GET("/analytics/roundups", roundupAnalyticsHandler)
+
+		authorized.GET("/me", getProfileHandler)
+		authorized.PATCH("/me", updateProfileHandler)
+		authorized.POST("/me/password", changePasswordHandler)
+		authorized.GET("/me/export", exportUserDataHandler)
+		authorized.DELETE("/me", deleteAccountHandler)
+		authorized.POST("/me/devices", registerDeviceHandler)
+		authorized.DELETE("/me/devices/:token", deleteDeviceHandler)
+
+	}
+
+	// admin routes
+	admin := router.Group("/api/v1/admin")
+	admin.Use(authMiddleware(), requireRole(RoleAdmin))
+	{
+		admin.GET("/users", adminListUsersHandler)
+		admin.GET("/users/:id/wallet", adminGetUserWalletHandler)
+		admin.GET("/users/:id/transactions", adminGetUserTransactionsHandler)
+		admin.PUT("/users/:id/freeze", adminFreezeUserHandler)
+		admin.PUT("/merchants/:merchant/category", adminUpdateMerchantCategoryHandler)
+	}
+
+	// webhooks that get every user's events, managed with the same handlers
+	tenant := router.Group("/api/v1/admin/webhooks")
+	tenant.Use(authMiddleware(), requireRole(RoleAdmin), tenantWebhooks())
+	{
+		tenant.GET("", listWebhooksHandler)
+		tenant.POST("", createWebhookHandler)
+		tenant.PUT("/:id", updateWebhookHandler)
+		tenant.DELETE("/:id", deleteWebhookHandler)
+		tenant.GET("/:id/deliveries", listWebhookDeliveriesHandler)
+		tenant.POST("/:id/deliveries/:delivery_id/replay", replayWebhookDeliveryHandler)
 	}
 
 	router.Run(":8082")
@@ -0,0 +1,2 @@
+-- marks accounts anonymized through DELETE /api/v1/me
+ALTER TABLE users ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMP;
@@ -0,0 +1,5 @@
+-- email changes wait here until the new address is verified
+ALTER TABLE users ADD COLUMN IF NOT EXISTS pending_email TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_token_hash TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS email_token_expires_at TIMESTAMP;
+CREATE UNIQUE INDEX IF NOT EXISTS users_email_token_hash_idx ON users (email_token_hash);
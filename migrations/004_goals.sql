@@ -0,0 +1,24 @@
+-- many savings goals per user, replacing the single goal on user_preferences
+CREATE TABLE IF NOT EXISTS goals (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    name TEXT NOT NULL,
+    amount DOUBLE PRECISION NOT NULL,
+    target_date TIMESTAMP NOT NULL,
+    current_savings DOUBLE PRECISION NOT NULL DEFAULT 0,
+    priority INTEGER NOT NULL DEFAULT 0,
+    weight DOUBLE PRECISION NOT NULL DEFAULT 1,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+CREATE INDEX IF NOT EXISTS goals_user_id_idx ON goals (user_id);
+
+-- carry over existing goals. Savings were only ever tracked against that one goal.
+INSERT INTO goals (id, user_id, name, amount, target_date, current_savings)
+SELECT gen_random_uuid()::text, user_id, COALESCE(goal_name, ''), goal_amount, target_date, LEAST(current_savings, goal_amount)
+FROM user_preferences
+WHERE goal_amount > 0;
+
+ALTER TABLE user_preferences ADD COLUMN IF NOT EXISTS goal_allocation TEXT NOT NULL DEFAULT 'weight';
+ALTER TABLE user_preferences DROP COLUMN IF EXISTS goal_name;
+ALTER TABLE user_preferences DROP COLUMN IF EXISTS goal_amount;
+ALTER TABLE user_preferences DROP COLUMN IF EXISTS target_date;
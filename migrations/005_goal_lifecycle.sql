@@ -0,0 +1,11 @@
+-- goal states and what happens to surplus savings once a goal is achieved
+ALTER TABLE goals ADD COLUMN IF NOT EXISTS status TEXT NOT NULL DEFAULT 'active';
+ALTER TABLE goals ADD COLUMN IF NOT EXISTS on_complete TEXT NOT NULL DEFAULT 'wallet';
+ALTER TABLE goals ADD COLUMN IF NOT EXISTS achieved_at TIMESTAMP;
+ALTER TABLE goals ADD COLUMN IF NOT EXISTS expired_at TIMESTAMP;
+ALTER TABLE goals ADD COLUMN IF NOT EXISTS abandoned_at TIMESTAMP;
+ALTER TABLE goals ADD COLUMN IF NOT EXISTS archived_at TIMESTAMP;
+
+-- goals that already finished or ran out of time before states existed
+UPDATE goals SET status = 'achieved', achieved_at = NOW() WHERE status = 'active' AND current_savings >= amount;
+UPDATE goals SET status = 'expired', expired_at = target_date WHERE status = 'active' AND target_date < NOW();
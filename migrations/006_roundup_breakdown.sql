@@ -0,0 +1,2 @@
+-- the inputs behind each roundup, see RoundupBreakdown
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS roundup_breakdown JSONB;
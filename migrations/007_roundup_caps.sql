@@ -0,0 +1,9 @@
+-- user-configured roundup limits, 0 means no limit
+ALTER TABLE user_preferences ADD COLUMN IF NOT EXISTS transaction_roundup_cap DOUBLE PRECISION NOT NULL DEFAULT 0;
+ALTER TABLE user_preferences ADD COLUMN IF NOT EXISTS daily_roundup_cap DOUBLE PRECISION NOT NULL DEFAULT 0;
+ALTER TABLE user_preferences ADD COLUMN IF NOT EXISTS weekly_roundup_cap DOUBLE PRECISION NOT NULL DEFAULT 0;
+ALTER TABLE user_preferences ADD COLUMN IF NOT EXISTS monthly_roundup_cap DOUBLE PRECISION NOT NULL DEFAULT 0;
+
+-- what the caps held back on each transaction
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS roundup_capped DOUBLE PRECISION NOT NULL DEFAULT 0;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS cap_reason TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,2 @@
+-- per-category scaling of the base roundup, e.g. {"Dining & Food": 2}. Missing categories use 1.
+ALTER TABLE user_preferences ADD COLUMN IF NOT EXISTS category_multipliers JSONB NOT NULL DEFAULT '{}';
@@ -0,0 +1,20 @@
+-- roundup history as rows instead of the roundup_history/roundup_dates arrays on user_preferences
+CREATE TABLE IF NOT EXISTS roundup_events (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    transaction_id TEXT NOT NULL DEFAULT '',
+    goal_id TEXT NOT NULL DEFAULT '',
+    amount DOUBLE PRECISION NOT NULL,
+    created_at TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS roundup_events_user_id_created_at_idx ON roundup_events (user_id, created_at);
+
+-- carry over the arrays. They were appended in step, so position i of one matches position i of the other;
+-- unnest pads the shorter with NULLs and those unmatched entries are dropped.
+INSERT INTO roundup_events (id, user_id, amount, created_at)
+SELECT gen_random_uuid()::text, p.user_id, h.amount, h.created_at
+FROM user_preferences p, unnest(p.roundup_history, p.roundup_dates) AS h(amount, created_at)
+WHERE h.amount IS NOT NULL AND h.created_at IS NOT NULL;
+
+ALTER TABLE user_preferences DROP COLUMN IF EXISTS roundup_history;
+ALTER TABLE user_preferences DROP COLUMN IF EXISTS roundup_dates;
@@ -0,0 +1,5 @@
+-- opt-in to larger roundups on categories that are over budget
+ALTER TABLE user_preferences ADD COLUMN IF NOT EXISTS budget_penalty BOOLEAN NOT NULL DEFAULT false;
+
+-- the part of a roundup the budget penalty added
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS penalty_roundup DOUBLE PRECISION NOT NULL DEFAULT 0;
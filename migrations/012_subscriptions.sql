@@ -0,0 +1,16 @@
+-- recurring payments found by the subscription detector
+CREATE TABLE IF NOT EXISTS subscriptions (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    merchant TEXT NOT NULL,
+    category TEXT NOT NULL DEFAULT '',
+    cadence TEXT NOT NULL,
+    amount DOUBLE PRECISION NOT NULL,
+    monthly_cost DOUBLE PRECISION NOT NULL,
+    payments INTEGER NOT NULL,
+    last_paid TIMESTAMP NOT NULL,
+    next_expected TIMESTAMP NOT NULL,
+    status TEXT NOT NULL DEFAULT 'detected',
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    UNIQUE (user_id, merchant, cadence)
+);
@@ -0,0 +1,3 @@
+-- transactions flagged by the anomaly detector, and why
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS anomalous BOOLEAN NOT NULL DEFAULT false;
+ALTER TABLE transactions ADD COLUMN IF NOT EXISTS anomaly_reasons TEXT[] NOT NULL DEFAULT '{}';
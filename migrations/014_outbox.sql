@@ -0,0 +1,21 @@
+-- every published event, kept until all its subscribers have handled it
+CREATE TABLE IF NOT EXISTS outbox_events (
+    id TEXT PRIMARY KEY,
+    type TEXT NOT NULL,
+    user_id TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    dispatched_at TIMESTAMP,
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT NOT NULL DEFAULT ''
+);
+
+CREATE INDEX IF NOT EXISTS outbox_events_pending_idx ON outbox_events (created_at) WHERE dispatched_at IS NULL;
+
+-- subscribers that have already handled an event, so a retry skips them
+CREATE TABLE IF NOT EXISTS outbox_deliveries (
+    event_id TEXT NOT NULL REFERENCES outbox_events (id) ON DELETE CASCADE,
+    subscriber TEXT NOT NULL,
+    delivered_at TIMESTAMP NOT NULL,
+    PRIMARY KEY (event_id, subscriber)
+);
@@ -0,0 +1,24 @@
+-- channels per notification kind, e.g. {"goal_reached": ["email", "in_app"]}. Missing kinds use the defaults.
+ALTER TABLE user_preferences ADD COLUMN IF NOT EXISTS notification_channels JSONB NOT NULL DEFAULT '{}';
+
+-- in-app notifications
+CREATE TABLE IF NOT EXISTS notifications (
+    id TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    kind TEXT NOT NULL,
+    title TEXT NOT NULL,
+    body TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW(),
+    read_at TIMESTAMP
+);
+
+CREATE INDEX IF NOT EXISTS notifications_user_idx ON notifications (user_id, created_at);
+
+-- devices that receive push notifications
+CREATE TABLE IF NOT EXISTS push_devices (
+    token TEXT PRIMARY KEY,
+    user_id TEXT NOT NULL,
+    created_at TIMESTAMP NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS push_devices_user_idx ON push_devices (user_id);
@@ -0,0 +1,6 @@
+-- highest savings milestone (25, 50, 75 or 100 percent) announced for each goal.
+-- Existing goals start at their current level, so upgrading doesn't announce old milestones.
+ALTER TABLE goals ADD COLUMN IF NOT EXISTS milestone INTEGER NOT NULL DEFAULT 0;
+UPDATE goals SET milestone = LEAST(FLOOR(current_savings / amount * 4) * 25, 100) WHERE amount > 0;
+
+CREATE INDEX IF NOT EXISTS notifications_unread_idx ON notifications (user_id) WHERE read_at IS NULL;
@@ -0,0 +1,4 @@
+-- the payment a roundup credit came from, so wallet transactions can be filtered by its category,
+-- merchant and roundup_enabled. Empty for top-ups, withdrawals and credits made before this column.
+ALTER TABLE wallet_transactions ADD COLUMN IF NOT EXISTS transaction_id TEXT NOT NULL DEFAULT '';
+CREATE INDEX IF NOT EXISTS wallet_transactions_transaction_id_idx ON wallet_transactions (transaction_id);
@@ -0,0 +1,5 @@
+-- when the dispatcher may next pick up an event: after a dispatch that claimed it has had its
+-- lease, or after the retry delay once one failed
+ALTER TABLE outbox_events ADD COLUMN IF NOT EXISTS next_attempt_at TIMESTAMP;
+
+CREATE INDEX IF NOT EXISTS outbox_events_due_idx ON outbox_events (next_attempt_at) WHERE dispatched_at IS NULL;
@@ -0,0 +1,2 @@
+-- counts balance changes, so stream clients can tell a late wallet update from a newer one
+ALTER TABLE wallets ADD COLUMN IF NOT EXISTS version BIGINT NOT NULL DEFAULT 0;
@@ -0,0 +1,5 @@
+-- the user whose event a delivery carries, so deleting an account also removes it from tenant webhook logs
+ALTER TABLE webhook_deliveries ADD COLUMN IF NOT EXISTS user_id TEXT NOT NULL DEFAULT '';
+UPDATE webhook_deliveries SET user_id = payload::jsonb ->> 'user_id' WHERE user_id = '';
+
+CREATE INDEX IF NOT EXISTS webhook_deliveries_user_idx ON webhook_deliveries (user_id);
@@ -0,0 +1,2 @@
+-- the status a subscription had when it lapsed, so a confirmed one comes back confirmed
+ALTER TABLE subscriptions ADD COLUMN IF NOT EXISTS lapsed_from TEXT NOT NULL DEFAULT '';
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/json"
 	"time"
 )
 
@@ -11,15 +13,81 @@ const MinPressure = 0.3
 const MaxPressure = 3
 const DefaultAvgTxnsPerDay = 3
 const DefaultAvgTxnRoundup = 10
+const MaxCategoryMultiplier = 5
+
+// penalty roundups: the multiplier grows by BudgetPenaltyRate for every 100% a category is over budget
+const BudgetPenaltyRate = 1
+const MaxBudgetPenalty = 3
+
+// RoundupParams are the tunables of the roundup algorithm. Production uses
+// DefaultRoundupParams; the backtest command swaps in other sets to compare them.
+type RoundupParams struct {
+	BaseRoundupPercent float64 `json:"base_roundup_percent"`
+	MinPressure        float64 `json:"min_pressure"`
+	MaxPressure        float64 `json:"max_pressure"`
+	RecentPeriodDays   int     `json:"recent_period_days"`
+}
+
+var DefaultRoundupParams = RoundupParams{
+	BaseRoundupPercent: BaseRoundupPercent,
+	MinPressure:        MinPressure,
+	MaxPressure:        MaxPressure,
+	RecentPeriodDays:   RecentPeriodDays,
+}
 
 const roundUpAccount = "meet1771.mm@okhdfcbank"
 
+// goal allocation strategies
+const AllocationWeight = "weight"     // split each roundup across goals in proportion to their weights
+const AllocationPriority = "priority" // fill goals one at a time, lowest priority number first
+
+// goal states
+const GoalActive = "active"       // collecting roundups
+const GoalAchieved = "achieved"   // savings reached the goal amount
+const GoalExpired = "expired"     // target date passed before the goal was reached
+const GoalAbandoned = "abandoned" // given up by the user
+const GoalArchived = "archived"   // hidden from the app, kept for history
+
+// savings milestones announced before a goal is reached, in percent of the goal amount
+var GoalMilestones = []int{25, 50, 75}
+
+// where savings beyond a goal's amount go once it is achieved
+const SurplusNextGoal = "next_goal"
+const SurplusWallet = "wallet"
+
+// analytics periods, named as Postgres date_trunc expects them. Weeks start on Monday.
+const PeriodDay = "day"
+const PeriodWeek = "week"
+const PeriodMonth = "month"
+
+// subscription states
+const SubscriptionDetected = "detected"   // found by the detector, not reviewed yet
+const SubscriptionConfirmed = "confirmed" // the user agrees it is recurring
+const SubscriptionDismissed = "dismissed" // the user says it isn't, hidden from now on
+const SubscriptionLapsed = "lapsed"       // no longer found by the detector, most likely cancelled
+
+// how often a subscription is paid
+const CadenceWeekly = "weekly"
+const CadenceMonthly = "monthly"
+const CadenceYearly = "yearly"
+
+// why a transaction was flagged as anomalous
+const AnomalyAmount = "amount"            // far above the user's usual amount for the category
+const AnomalyNewMerchant = "new_merchant" // a large payment to a merchant never paid before
+const AnomalyUnusualHour = "unusual_hour" // at an hour of day the user never pays at
+
+// user roles
+const RoleUser = "user"
+const RoleAdmin = "admin"
+
 // Define all structs
 type User struct {
 	ID          string          `json:"id"`
 	Name        string          `json:"name"`
 	Email       string          `json:"email"`
 	Password    string          `json:"-"` // omit from JSON responses
+	Role        string          `json:"role"`
+	Frozen      bool            `json:"frozen"` // frozen accounts cannot log in or use the API
 	Preferences UserPreferences `json:"preferences"`
 	CreatedAt   time.Time       `json:"created_at"`
 }
@@ -29,29 +97,62 @@ type VerifyUPIURIRequest struct {
 }
 
 type UserPreferences struct {
-	RoundupCategories []string    `json:"roundup_categories"` // things like "food", "clothes", "groceries"
-	GoalName          string      `json:"goal_name"`          // trip
-	GoalAmount        float64     `json:"goal_amount"`        // 5000
-	TargetDate        time.Time   `json:"target_date"`        // 4th May
-	CurrentSavings    float64     `json:"current_savings"`    // amount already saved
-	RoundupHistory    []float64   `json:"roundup_history"`    // contains all roundups done in past
-	RoundupDates      []time.Time `json:"roundup_dates"`      // stores when the roundup took place
+	RoundupCategories []string `json:"roundup_categories"` // things like "food", "clothes", "groceries"
+	GoalAllocation    string   `json:"goal_allocation"`    // "weight" or "priority"
+	CurrentSavings    float64  `json:"current_savings"`    // amount already saved across all goals
+
+	// scales the base roundup per category, e.g. {"Dining & Food": 2, "Groceries": 0.5}. Categories left out use 1.
+	CategoryMultipliers map[string]float64 `json:"category_multipliers"`
+
+	// raise roundups on categories that are over their monthly budget
+	BudgetPenalty bool `json:"budget_penalty"`
+
+	// channels to notify on per notification kind, e.g. {"goal_reached": ["email", "in_app"]}.
+	// Kinds left out use defaultNotificationChannels, an empty list turns a kind off.
+	NotificationChannels map[string][]string `json:"notification_channels"`
+
+	// roundup limits, 0 means no limit
+	TransactionRoundupCap float64 `json:"transaction_roundup_cap"` // per transaction
+	DailyRoundupCap       float64 `json:"daily_roundup_cap"`       // per calendar day
+	WeeklyRoundupCap      float64 `json:"weekly_roundup_cap"`      // per week, starting Monday
+	MonthlyRoundupCap     float64 `json:"monthly_roundup_cap"`     // per calendar month
+}
+
+type Goal struct {
+	ID             string     `json:"id"`
+	UserID         string     `json:"user_id"`
+	Name           string     `json:"name"`            // trip
+	Amount         float64    `json:"amount"`          // 5000
+	TargetDate     time.Time  `json:"target_date"`     // 4th May
+	CurrentSavings float64    `json:"current_savings"` // amount saved towards this goal
+	Priority       int        `json:"priority"`        // lower is funded first under "priority" allocation
+	Weight         float64    `json:"weight"`          // share of each roundup under "weight" allocation
+	Status         string     `json:"status"`          // active, achieved, expired, abandoned or archived
+	OnComplete     string     `json:"on_complete"`     // "next_goal" or "wallet"
+	Milestone      int        `json:"milestone"`       // highest of 25, 50, 75 or 100 percent saved so far
+	CreatedAt      time.Time  `json:"created_at"`
+	AchievedAt     *time.Time `json:"achieved_at"`
+	ExpiredAt      *time.Time `json:"expired_at"`
+	AbandonedAt    *time.Time `json:"abandoned_at"`
+	ArchivedAt     *time.Time `json:"archived_at"`
 }
 
 type Wallet struct {
 	ID          string    `json:"id"`
 	UserID      string    `json:"user_id"`
 	Balance     float64   `json:"balance"`
+	Version     int64     `json:"version"` // goes up with every balance change
 	LastUpdated time.Time `json:"last_updated"`
 }
 
 type WalletTransaction struct {
-	ID          string    `json:"id"`
-	WalletID    string    `json:"wallet_id"`
-	Amount      float64   `json:"amount"`
-	Type        string    `json:"type"` // "credit" or "debit"
-	Description string    `json:"description"`
-	CreatedAt   time.Time `json:"created_at"`
+	ID            string    `json:"id"`
+	WalletID      string    `json:"wallet_id"`
+	Amount        float64   `json:"amount"`
+	Type          string    `json:"type"` // "credit" or "debit"
+	Description   string    `json:"description"`
+	TransactionID string    `json:"transaction_id,omitempty"` // the payment a roundup credit came from
+	CreatedAt     time.Time `json:"created_at"`
 }
 
 type Transaction struct {
@@ -63,6 +164,13 @@ type Transaction struct {
 	CreatedAt      time.Time `json:"created_at"`
 	Merchant       string    `json:"merchant"` // upi id
 	RoundupEnabled bool      `json:"roundup_enabled"`
+	RoundupCapped  float64   `json:"roundup_capped"`  // amount a roundup cap held back
+	CapReason      string    `json:"cap_reason"`      // which cap applied, empty if none
+	PenaltyRoundup float64   `json:"penalty_roundup"` // part of the roundup added for being over budget
+	Anomalous      bool      `json:"anomalous"`
+	AnomalyReasons []string  `json:"anomaly_reasons"` // amount, new_merchant, unusual_hour
+
+	RoundupBreakdown *RoundupBreakdown `json:"roundup_breakdown,omitempty"` // only loaded for single transactions
 }
 
 type TransactionService struct {
@@ -70,22 +178,374 @@ type TransactionService struct {
 	userRepo   UserRepository
 	upiClient  UPIClient
 	walletRepo WalletRepository
+	goalRepo   GoalRepository
+	eventRepo  RoundupEventRepository
+	budgetRepo BudgetRepository
+	subRepo    SubscriptionRepository
+	events     *EventBus
+	notifRepo  NotificationRepository
+	hookRepo   WebhookRepository
+	mailer     Mailer
+	clock      Clock
+	db         *sql.DB // begins the transactions of inTx, nil in tests
 }
 
+// Clock is where the service reads the time, so tests can control it
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+// Repository methods taking a dbTx run in that database transaction, or on their own when it is nil
+
 type TransactionRepository interface {
-	SaveTransaction(tx Transaction) error
+	SaveTransaction(dbTx *sql.Tx, tx Transaction) error
 	GetTransactionsByUserID(userID string) ([]Transaction, error)
+	ListTransactions(userID string, filter TransactionFilter) ([]Transaction, error)
 	GetTransactionByID(id string) (*Transaction, error)
 	GetTotalRoundupInPeriod(days int) (float64, error)
+	UpdateCategoryByMerchant(merchant, category string) (int64, error)
+	GetSpendingByCategory(userID, period string, from, to time.Time) ([]CategorySpending, error)
+	GetTopMerchants(userID string, from, to time.Time, limit int) ([]MerchantSpending, error)
+	GetRoundupTotals(userID, period string, from, to time.Time) ([]RoundupTotal, error)
+	GetSpendingBaseline(userID, category, merchant string, hour int, since time.Time) (*SpendingBaseline, error)
 }
 
 type UserRepository interface {
 	FindByID(id string) (*User, error)
 	Update(user *User) error
-	CreateUserPreferences(userID string, prefs UserPreferences) error
-	UpdatePreferences(userID string, prefs UserPreferences) error
-	CreateUser(user *User) error
+	CreateUserPreferences(dbTx *sql.Tx, userID string, prefs UserPreferences) error
+	UpdatePreferences(dbTx *sql.Tx, userID string, prefs UserPreferences) error
+	CreateUser(dbTx *sql.Tx, user *User) error
 	GetUserByEmail(email string) (*User, error)
+	ListUsers() ([]User, error)
+	SetFrozen(userID string, frozen bool) error
+	GetAccess(userID string) (role string, frozen bool, err error)
+	AnonymizeUser(userID string) error
+	GetPasswordHash(userID string) (string, error)
+	UpdatePassword(userID string, passwordHash string) error
+	SetPendingEmail(userID, email, tokenHash string, expiresAt time.Time) error
+	ConfirmPendingEmail(tokenHash string) (string, error)
+}
+
+// RoundupAllocation is the part of a roundup credited to one goal
+type RoundupAllocation struct {
+	GoalID string  `json:"goal_id"`
+	Amount float64 `json:"amount"`
+}
+
+// Budget is a monthly spending limit for one category
+type Budget struct {
+	ID           string    `json:"id"`
+	UserID       string    `json:"user_id"`
+	Category     string    `json:"category"`
+	MonthlyLimit float64   `json:"monthly_limit"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// SpendingBaseline is the user's recent spending that a new transaction is compared against
+type SpendingBaseline struct {
+	CategoryCount  int     // transactions in the same category
+	CategoryMean   float64 // their mean amount
+	CategoryStdDev float64 // and its standard deviation
+	HourCount      int     // transactions in any category made in the same hour of day
+	TotalCount     int     // transactions in any category
+	MerchantSeen   bool    // the merchant has been paid before, at any time
+}
+
+// AnomalyAlert is raised when a transaction is flagged
+type AnomalyAlert struct {
+	UserID        string    `json:"user_id"`
+	TransactionID string    `json:"transaction_id"`
+	Amount        float64   `json:"amount"`
+	Merchant      string    `json:"merchant"`
+	Category      string    `json:"category"`
+	Reasons       []string  `json:"reasons"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// Subscription is a recurring payment found in a user's transactions
+type Subscription struct {
+	ID           string    `json:"id"`
+	UserID       string    `json:"user_id"`
+	Merchant     string    `json:"merchant"`
+	Category     string    `json:"category"`
+	Cadence      string    `json:"cadence"`      // weekly, monthly or yearly
+	Amount       float64   `json:"amount"`       // most recent payment
+	MonthlyCost  float64   `json:"monthly_cost"` // amount spread over a month
+	Payments     int       `json:"payments"`     // how many payments matched
+	LastPaid     time.Time `json:"last_paid"`
+	NextExpected time.Time `json:"next_expected"`
+	Status       string    `json:"status"` // detected, confirmed or dismissed
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// BudgetStatus is how much of a budget the current calendar month has used
+type BudgetStatus struct {
+	Budget
+	Month       string  `json:"month"` // YYYY-MM
+	Spent       float64 `json:"spent"`
+	Remaining   float64 `json:"remaining"` // 0 once overspent
+	PercentUsed float64 `json:"percent_used"`
+	Overspent   bool    `json:"overspent"`
+}
+
+// TransactionFilter selects one page of a transaction list, newest first. Zero values and nil
+// pointers mean no filter. On wallet transactions Category, Merchant and RoundupEnabled apply to
+// the payment a roundup came from, so they leave out top-ups and withdrawals.
+type TransactionFilter struct {
+	From           *time.Time // inclusive
+	To             *time.Time // exclusive
+	Category       string
+	Merchant       string
+	MinAmount      *float64
+	MaxAmount      *float64
+	RoundupEnabled *bool
+	After          *PageCursor // start after this item of the previous page
+	Limit          int
+}
+
+// PageCursor is the position of the last item on a page
+type PageCursor struct {
+	CreatedAt time.Time
+	ID        string
+}
+
+// CategorySpending is what a user spent in one category during one period
+type CategorySpending struct {
+	Period   time.Time `json:"period"` // start of the day, week or month
+	Category string    `json:"category"`
+	Total    float64   `json:"total"`
+	Count    int       `json:"count"`
+	Roundup  float64   `json:"roundup"`
+}
+
+type MerchantSpending struct {
+	Merchant string  `json:"merchant"`
+	Total    float64 `json:"total"`
+	Count    int     `json:"count"`
+}
+
+// RoundupTotal sums the roundups of one period
+type RoundupTotal struct {
+	Period time.Time `json:"period"`
+	Total  float64   `json:"total"`
+	Count  int       `json:"count"`  // transactions that were rounded up
+	Capped float64   `json:"capped"` // held back by the user's caps
+}
+
+// RoundupEvent records a roundup being made. A roundup split between goals is one event per goal;
+// one that went to no goal has an empty GoalID.
+type RoundupEvent struct {
+	ID            string    `json:"id"`
+	UserID        string    `json:"user_id"`
+	TransactionID string    `json:"transaction_id"` // empty for history carried over from user_preferences
+	GoalID        string    `json:"goal_id"`
+	Amount        float64   `json:"amount"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+// GoalPressure holds the intermediate values behind a goal's pressure factor
+type GoalPressure struct {
+	GoalID          string  `json:"goal_id"`
+	Name            string  `json:"name"`
+	DaysRemaining   float64 `json:"days_remaining"`
+	RemainingAmount float64 `json:"remaining_amount"`
+	RequiredTxns    float64 `json:"required_transactions"`
+	ProjectedTxns   float64 `json:"projected_transactions"`
+	Pressure        float64 `json:"pressure"`
+}
+
+// how a roundup was arrived at
+const RoundupModeDisabled = "disabled" // roundups switched off for the transaction
+const RoundupModeBase = "base"         // no active goal, flat base roundup percent
+const RoundupModeGoal = "goal"         // base roundup scaled by goal pressure
+const RoundupModeSkipped = "skipped"   // filtered out, see SkipReason
+
+// roundup caps, recorded as the CapReason of a transaction
+const CapTransaction = "transaction"
+const CapDaily = "daily"
+const CapWeekly = "weekly"
+const CapMonthly = "monthly"
+
+// RoundupBreakdown records every value that went into a roundup
+type RoundupBreakdown struct {
+	Mode               string              `json:"mode"`
+	SkipReason         string              `json:"skip_reason,omitempty"`
+	CategoryMultiplier float64             `json:"category_multiplier"`
+	BudgetPenalty      float64             `json:"budget_penalty"` // 1 unless the category is over budget
+	BaseRoundup        float64             `json:"base_roundup"`   // after the category multiplier and budget penalty
+	AverageRoundup     float64             `json:"average_roundup"`
+	AvgTxnsPerDay      float64             `json:"avg_transactions_per_day"`
+	Goals              []GoalPressure      `json:"goals"`
+	RemainingAmount    float64             `json:"remaining_amount"`
+	Pressure           float64             `json:"pressure"`
+	PressuredRoundup   float64             `json:"pressured_roundup"` // base roundup times pressure, before the remaining amount cap
+	UncappedRoundup    float64             `json:"uncapped_roundup"`  // before the user's roundup caps
+	CapReason          string              `json:"cap_reason,omitempty"`
+	Roundup            float64             `json:"roundup"`
+	PenaltyRoundup     float64             `json:"penalty_roundup"` // how much of the roundup the budget penalty added
+	Allocations        []RoundupAllocation `json:"allocations"`
+}
+
+type GoalProgress struct {
+	GoalID              string     `json:"goal_id"`
+	Name                string     `json:"name"`
+	Status              string     `json:"status"`
+	Amount              float64    `json:"amount"`
+	CurrentSavings      float64    `json:"current_savings"`
+	RemainingAmount     float64    `json:"remaining_amount"`
+	PercentComplete     float64    `json:"percent_complete"`
+	TargetDate          time.Time  `json:"target_date"`
+	DaysRemaining       float64    `json:"days_remaining"`
+	Pressure            float64    `json:"pressure"`
+	DailySavingsRate    float64    `json:"daily_savings_rate"`   // this goal's share of recent roundups per day
+	ProjectedCompletion *time.Time `json:"projected_completion"` // nil when nothing has been saved recently
+	OnTrack             bool       `json:"on_track"`
+}
+
+type GoalRepository interface {
+	CreateGoal(goal Goal) error
+	GetGoalsByUserID(userID string) ([]Goal, error)
+	GetGoalByID(id string) (*Goal, error)
+	UpdateGoal(goal Goal) error
+	DeleteGoal(id string) (bool, error)
+	AddToGoalSavings(dbTx *sql.Tx, goalID string, amount float64) error
+	UpdateGoalState(dbTx *sql.Tx, goal Goal) error
+	LockGoalsByUserID(dbTx *sql.Tx, userID string) ([]Goal, error)
+	AdvanceMilestone(dbTx *sql.Tx, goalID string, milestone int) (bool, error)
+}
+
+type BudgetRepository interface {
+	CreateBudget(budget Budget) error
+	GetBudgetsByUserID(userID string) ([]Budget, error)
+	GetBudgetByID(id string) (*Budget, error)
+	UpdateBudget(budget Budget) error
+	DeleteBudget(id string) error
+}
+
+type SubscriptionRepository interface {
+	UpsertSubscription(sub Subscription) error
+	GetSubscriptionsByUserID(userID string) ([]Subscription, error)
+	GetSubscriptionByID(id string) (*Subscription, error)
+	UpdateSubscriptionStatus(id, status string) error
+	LapseSubscription(id string) error
+}
+
+// Notification is a message for a user, kept in their in-app inbox
+type Notification struct {
+	ID        string     `json:"id"`
+	UserID    string     `json:"user_id"`
+	Kind      string     `json:"kind"` // e.g. "goal_reached"
+	Title     string     `json:"title"`
+	Body      string     `json:"body"`
+	CreatedAt time.Time  `json:"created_at"`
+	ReadAt    *time.Time `json:"read_at"`
+}
+
+// PushDevice is a device registered for push notifications
+type PushDevice struct {
+	Token     string    `json:"token"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// NotificationFilter narrows an inbox listing. A zero Limit returns every match.
+type NotificationFilter struct {
+	UnreadOnly bool
+	After      *PageCursor
+	Limit      int
+}
+
+type NotificationRepository interface {
+	AddNotification(notification Notification) error
+	ListNotifications(userID string, filter NotificationFilter) ([]Notification, error)
+	CountUnread(userID string) (int, error)
+	GetNotificationByID(id string) (*Notification, error)
+	MarkRead(id string, at time.Time) error
+	MarkAllRead(userID string, at time.Time) (int64, error)
+	DeleteNotification(id string) error
+	AddDevice(userID, token string, createdAt time.Time) error
+	DeleteDevice(userID, token string) error
+	GetDeviceTokens(userID string) ([]string, error)
+	GetDevices(userID string) ([]PushDevice, error)
+}
+
+// Webhook is a partner endpoint that is sent the event types it subscribed to
+type Webhook struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"user_id"` // TenantWebhookOwner for endpoints that get every user's events
+	URL        string    `json:"url"`
+	Secret     string    `json:"-"` // signs payloads, only shown once when the webhook is created
+	EventTypes []string  `json:"event_types"`
+	Active     bool      `json:"active"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// WebhookDelivery is one event sent, or still to be sent, to one webhook
+type WebhookDelivery struct {
+	ID             string     `json:"id"`
+	WebhookID      string     `json:"webhook_id"`
+	UserID         string     `json:"user_id"` // whose event it is, also for tenant webhooks
+	EventID        string     `json:"event_id"`
+	EventType      string     `json:"event_type"`
+	Payload        string     `json:"payload"` // the exact body posted
+	Status         string     `json:"status"`  // pending, succeeded or failed
+	Attempts       int        `json:"attempts"`
+	ResponseStatus int        `json:"response_status"` // of the last attempt, 0 if there was no response
+	LastError      string     `json:"last_error"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at"`
+	LastAttemptAt  *time.Time `json:"last_attempt_at"`
+	DeliveredAt    *time.Time `json:"delivered_at"`
+	ReplayOf       *string    `json:"replay_of"` // the delivery this one replays
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+type WebhookRepository interface {
+	CreateWebhook(webhook Webhook) error
+	GetWebhooksByUserID(userID string) ([]Webhook, error)
+	GetWebhookByID(id string) (*Webhook, error)
+	GetSubscribedWebhooks(userID, eventType string) ([]Webhook, error)
+	UpdateWebhook(webhook Webhook) error
+	DeleteWebhook(id string) error
+	AddDelivery(delivery WebhookDelivery) (bool, error)
+	GetDeliveryByID(id string) (*WebhookDelivery, error)
+	GetDeliveriesByWebhookID(webhookID string, limit int) ([]WebhookDelivery, error)
+	GetDeliveriesByUserID(userID string) ([]WebhookDelivery, error)
+	ClaimDueDeliveries(now, leaseUntil time.Time, limit int) ([]WebhookDelivery, error)
+	UpdateDelivery(delivery WebhookDelivery) error
+}
+
+// OutboxEvent is a published event as stored in the outbox table
+type OutboxEvent struct {
+	ID            string          `json:"id"`
+	Type          string          `json:"type"`
+	UserID        string          `json:"user_id"`
+	Payload       json.RawMessage `json:"payload"`
+	CreatedAt     time.Time       `json:"created_at"`
+	DispatchedAt  *time.Time      `json:"dispatched_at"` // set once every subscriber has handled it
+	Attempts      int             `json:"attempts"`      // failed dispatches so far
+	LastError     string          `json:"last_error"`
+	NextAttemptAt *time.Time      `json:"next_attempt_at"` // the dispatcher leaves it alone until then
+}
+
+type OutboxRepository interface {
+	AddEvent(dbTx *sql.Tx, event OutboxEvent) error
+	ClaimPendingEvents(now, leaseUntil time.Time, maxAttempts, limit int) ([]OutboxEvent, error)
+	GetDeliveredSubscribers(eventID string) ([]string, error)
+	RecordDelivery(eventID, subscriber string, at time.Time) error
+	RecordFailure(eventID, lastError string, retryAt time.Time) error
+	MarkDispatched(eventID string, at time.Time) error
+}
+
+type RoundupEventRepository interface {
+	AddRoundupEvents(dbTx *sql.Tx, events []RoundupEvent) error
+	GetRoundupEventsSince(userID string, since time.Time) ([]RoundupEvent, error)
+	GetRoundupEventsByUserID(userID string) ([]RoundupEvent, error)
 }
 
 type UPIClient interface {
@@ -93,11 +553,12 @@ type UPIClient interface {
 }
 
 type WalletRepository interface {
-	CreateWallet(wallet Wallet) error
+	CreateWallet(dbTx *sql.Tx, wallet Wallet) error
 	GetWalletByUserID(userID string) (*Wallet, error)
-	UpdateWalletBalance(walletID string, newBalance float64) error
-	AddWalletTransaction(tx WalletTransaction) error
+	AdjustWalletBalance(dbTx *sql.Tx, walletID string, change float64) (float64, int64, error)
+	AddWalletTransaction(dbTx *sql.Tx, tx WalletTransaction) error
 	GetWalletTransactions(walletID string) ([]WalletTransaction, error)
+	ListWalletTransactions(walletID string, filter TransactionFilter) ([]WalletTransaction, error)
 }
 
 var categories = []string{
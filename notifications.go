@@ -0,0 +1,607 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// notification channels
+const ChannelEmail = "email"
+const ChannelPush = "push"
+const ChannelInApp = "in_app"
+
+// notification kinds
+const NotifyGoalMilestone = "goal_milestone"
+const NotifyGoalReached = "goal_reached"
+const NotifyRoundupCredited = "roundup_credited"
+const NotifyRoundupFailed = "roundup_failed"
+const NotifyWalletWithdrawn = "wallet_withdrawn"
+const NotifyLargeWithdrawal = "large_withdrawal"
+
+const LargeWithdrawalAmount = 5000 // withdrawals from this amount are notified as large_withdrawal
+
+var notificationChannels = []string{ChannelEmail, ChannelPush, ChannelInApp}
+
+// events the notification service subscribes to
+var notifiedEvents = []string{EventGoalMilestone, EventGoalReached, EventRoundupCredited, EventRoundupFailed, EventWalletWithdrawn}
+
+// defaultNotificationChannels applies to kinds a user has not chosen channels for.
+// Roundups happen with most payments, so they only go to the inbox.
+var defaultNotificationChannels = map[string][]string{
+	NotifyGoalMilestone:   {ChannelPush, ChannelInApp},
+	NotifyGoalReached:     {ChannelEmail, ChannelPush, ChannelInApp},
+	NotifyRoundupCredited: {ChannelInApp},
+	NotifyRoundupFailed:   {ChannelEmail, ChannelPush, ChannelInApp},
+	NotifyWalletWithdrawn: {ChannelEmail, ChannelPush, ChannelInApp},
+	NotifyLargeWithdrawal: {ChannelEmail, ChannelPush, ChannelInApp},
+}
+
+// notificationKind is what an event is notified as, if it is notified at all
+func notificationKind(event Event) (string, bool) {
+	switch e := event.(type) {
+	case GoalMilestoneReached:
+		return NotifyGoalMilestone, true
+	case GoalReached:
+		return NotifyGoalReached, true
+	case RoundupCredited:
+		return NotifyRoundupCredited, true
+	case RoundupFailed:
+		return NotifyRoundupFailed, true
+	case WalletWithdrawn:
+		if e.Amount >= LargeWithdrawalAmount {
+			return NotifyLargeWithdrawal, true
+		}
+		return NotifyWalletWithdrawn, true
+	}
+	return "", false
+}
+
+type notificationTemplate struct {
+	title *template.Template
+	body  *template.Template
+}
+
+func newNotificationTemplate(title, body string) notificationTemplate {
+	funcs := template.FuncMap{
+		"money": func(amount float64) string { return fmt.Sprintf("₹%.2f", amount) },
+	}
+	return notificationTemplate{
+		title: template.Must(template.New("title").Funcs(funcs).Parse(title)),
+		body:  template.Must(template.New("body").Funcs(funcs).Parse(body)),
+	}
+}
+
+// templates are executed with the event as data
+var notificationTemplates = map[string]notificationTemplate{
+	NotifyGoalMilestone: newNotificationTemplate(
+		"You hit {{.Percent}}% of your {{.Goal.Name}} goal!",
+		"You've saved {{money .Goal.CurrentSavings}} of {{money .Goal.Amount}} for {{.Goal.Name}}. Keep going!",
+	),
+	NotifyGoalReached: newNotificationTemplate(
+		"You reached your {{.Goal.Name}} goal!",
+		"You've saved {{money .Goal.Amount}} for {{.Goal.Name}}. Well done!",
+	),
+	NotifyRoundupCredited: newNotificationTemplate(
+		"{{money .Amount}} saved",
+		"{{money .Amount}} from your last payment was rounded up into your RoundUp wallet.",
+	),
+	NotifyRoundupFailed: newNotificationTemplate(
+		"Your {{money .Amount}} roundup didn't go through",
+		"We couldn't save the {{money .Amount}} roundup from your last payment: {{.Reason}}. Your payment itself is not affected.",
+	),
+	NotifyWalletWithdrawn: newNotificationTemplate(
+		"{{money .Amount}} withdrawn from your wallet",
+		"{{money .Amount}} was withdrawn from your RoundUp wallet, leaving {{money .Balance}}.",
+	),
+	NotifyLargeWithdrawal: newNotificationTemplate(
+		"{{money .Amount}} withdrawn from your wallet",
+		"{{money .Amount}} was withdrawn from your RoundUp wallet, leaving {{money .Balance}}. If this wasn't you, contact support right away.",
+	),
+}
+
+// Notifier delivers a notification over one channel
+type Notifier interface {
+	Notify(user User, notification Notification) error
+}
+
+// EmailNotifier sends notifications to the user's email address
+type EmailNotifier struct {
+	mailer Mailer
+}
+
+func (n *EmailNotifier) Notify(user User, notification Notification) error {
+	return n.mailer.Send(user.Email, notification.Title, notification.Body)
+}
+
+// InAppNotifier keeps notifications in the user's inbox
+type InAppNotifier struct {
+	repo NotificationRepository
+}
+
+func (n *InAppNotifier) Notify(user User, notification Notification) error {
+	return n.repo.AddNotification(notification)
+}
+
+// PushNotifier sends notifications to the user's registered devices through an FCM style HTTP API
+type PushNotifier struct {
+	url       string
+	serverKey string
+	client    *http.Client
+	devices   NotificationRepository
+}
+
+type pushMessage struct {
+	To           string            `json:"to"`
+	Notification pushNotification  `json:"notification"`
+	Data         map[string]string `json:"data"`
+}
+
+type pushNotification struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+}
+
+// pushResponse is the push service's answer, with one result per token sent to
+type pushResponse struct {
+	Results []struct {
+		Error string `json:"error"`
+	} `json:"results"`
+}
+
+// errUnregisteredToken means the push service no longer knows the token, usually because the app was uninstalled
+var errUnregisteredToken = errors.New("push token is no longer registered")
+
+// newPushNotifier sends to PUSH_URL with PUSH_SERVER_KEY. Without PUSH_URL pushes only go to the log.
+func newPushNotifier(devices NotificationRepository) Notifier {
+	url := os.Getenv("PUSH_URL")
+	if url == "" {
+		return &LogPushNotifier{devices: devices}
+	}
+	return &PushNotifier{
+		url:       url,
+		serverKey: os.Getenv("PUSH_SERVER_KEY"),
+		client:    &http.Client{Timeout: 10 * time.Second},
+		devices:   devices,
+	}
+}
+
+func (n *PushNotifier) Notify(user User, notification Notification) error {
+	tokens, err := n.devices.GetDeviceTokens(user.ID)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve devices: %v", err)
+	}
+
+	// one bad device mustn't keep the push from the others. Unregistered tokens are dropped, so
+	// only pushes that could still go through on a retry are reported.
+	delivered := false
+	var failures []string
+	for _, token := range tokens {
+		err = n.send(token, notification)
+		switch {
+		case err == nil:
+			delivered = true
+		case errors.Is(err, errUnregisteredToken):
+			err = n.devices.DeleteDevice(user.ID, token)
+			if err != nil && !errors.Is(err, sql.ErrNoRows) {
+				log.Printf("Error removing unregistered push token: %v\n", err)
+			}
+		default:
+			failures = append(failures, err.Error())
+		}
+	}
+
+	if !delivered && len(failures) > 0 {
+		return fmt.Errorf("push failed on every device: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+func (n *PushNotifier) send(token string, notification Notification) error {
+	payload, err := json.Marshal(pushMessage{
+		To:           token,
+		Notification: pushNotification{Title: notification.Title, Body: notification.Body},
+		Data:         map[string]string{"kind": notification.Kind, "notification_id": notification.ID},
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, n.url, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "key="+n.serverKey)
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send push: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("push service returned %s", resp.Status)
+	}
+
+	// a 200 can still carry a per-token error
+	var result pushResponse
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil || len(result.Results) == 0 {
+		return nil
+	}
+	switch result.Results[0].Error {
+	case "":
+		return nil
+	case "NotRegistered", "InvalidRegistration":
+		return errUnregisteredToken
+	default:
+		return fmt.Errorf("push service returned %s", result.Results[0].Error)
+	}
+}
+
+// LogPushNotifier writes pushes to the log instead of sending them. Used until a push service is configured.
+type LogPushNotifier struct {
+	devices NotificationRepository
+}
+
+func (n *LogPushNotifier) Notify(user User, notification Notification) error {
+	tokens, err := n.devices.GetDeviceTokens(user.ID)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve devices: %v", err)
+	}
+	for _, token := range tokens {
+		log.Printf("Push to %s: %s\n%s", token, notification.Title, notification.Body)
+	}
+	return nil
+}
+
+// NotificationService turns events into notifications and delivers them on the channels each user wants
+type NotificationService struct {
+	userRepo  UserRepository
+	notifiers map[string]Notifier // by channel
+	clock     Clock
+}
+
+func NewNotificationService(userRepo UserRepository, notifiers map[string]Notifier, clock Clock) *NotificationService {
+	return &NotificationService{userRepo: userRepo, notifiers: notifiers, clock: clock}
+}
+
+// Subscribe registers one subscriber per event and channel, so a channel that fails is retried
+// without the others sending the same notification again
+func (s *NotificationService) Subscribe(bus *EventBus) {
+	for _, eventType := range notifiedEvents {
+		for _, channel := range notificationChannels {
+			if s.notifiers[channel] == nil {
+				continue
+			}
+			bus.Subscribe(eventType, "notifications."+channel, func(event Event) error {
+				return s.deliver(channel, event)
+			})
+		}
+	}
+}
+
+// deliver sends the notification for an event over one channel, if the user wants it there
+func (s *NotificationService) deliver(channel string, event Event) error {
+	kind, ok := notificationKind(event)
+	if !ok {
+		return nil
+	}
+
+	user, err := s.userRepo.FindByID(event.EventUserID())
+	if errors.Is(err, sql.ErrNoRows) {
+		// deleted since the event, nobody left to tell
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to find user: %v", err)
+	}
+
+	if !user.Preferences.wantsNotification(kind, channel) {
+		return nil
+	}
+
+	notification, err := s.render(user.ID, kind, event)
+	if err != nil {
+		return err
+	}
+
+	return s.notifiers[channel].Notify(*user, notification)
+}
+
+func (s *NotificationService) render(userID, kind string, data interface{}) (Notification, error) {
+	tmpl := notificationTemplates[kind]
+
+	var title, body strings.Builder
+	err := tmpl.title.Execute(&title, data)
+	if err != nil {
+		return Notification{}, fmt.Errorf("failed to render %s title: %v", kind, err)
+	}
+	err = tmpl.body.Execute(&body, data)
+	if err != nil {
+		return Notification{}, fmt.Errorf("failed to render %s body: %v", kind, err)
+	}
+
+	return Notification{
+		ID:        uuid.New().String(),
+		UserID:    userID,
+		Kind:      kind,
+		Title:     title.String(),
+		Body:      body.String(),
+		CreatedAt: s.clock.Now(),
+	}, nil
+}
+
+// wantsNotification reports whether the user gets notifications of this kind on this channel
+func (p UserPreferences) wantsNotification(kind, channel string) bool {
+	channels, ok := p.NotificationChannels[kind]
+	if !ok {
+		channels = defaultNotificationChannels[kind]
+	}
+	for _, c := range channels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+// normalizeNotificationChannels checks the kinds and channels a user chose and drops repeated channels
+func normalizeNotificationChannels(choices map[string][]string) (map[string][]string, error) {
+	normalized := map[string][]string{}
+	for kind, channels := range choices {
+		if _, ok := defaultNotificationChannels[kind]; !ok {
+			return nil, fmt.Errorf("unknown notification kind '%s'", kind)
+		}
+
+		seen := map[string]bool{}
+		normalized[kind] = []string{}
+		for _, channel := range channels {
+			if !isNotificationChannel(channel) {
+				return nil, fmt.Errorf("unknown channel '%s' for '%s'", channel, kind)
+			}
+			if seen[channel] {
+				continue
+			}
+			seen[channel] = true
+			normalized[kind] = append(normalized[kind], channel)
+		}
+	}
+	return normalized, nil
+}
+
+func isNotificationChannel(channel string) bool {
+	for _, c := range notificationChannels {
+		if c == channel {
+			return true
+		}
+	}
+	return false
+}
+
+func registerDeviceHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	var req struct {
+		Token string `json:"token" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+
+	err := txnService.notifRepo.AddDevice(uid, req.Token, txnService.clock.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register device"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Device registered successfully"})
+}
+
+func deleteDeviceHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	err := txnService.notifRepo.DeleteDevice(uid, c.Param("token"))
+	if errors.Is(err, sql.ErrNoRows) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Device not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete device"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Device deleted successfully"})
+}
+
+// listNotificationsHandler returns a page of the inbox as a plain array like the other lists. The
+// cursor of the next page goes in X-Next-Cursor and the number of unread notifications in X-Unread-Count.
+func listNotificationsHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	filter := NotificationFilter{Limit: DefaultPageSize}
+
+	if s := c.Query("unread"); s != "" {
+		unread, err := strconv.ParseBool(s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unread must be true or false"})
+			return
+		}
+		filter.UnreadOnly = unread
+	}
+
+	if s := c.Query("cursor"); s != "" {
+		cursor, err := decodeCursor(s)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		filter.After = &cursor
+	}
+
+	if s := c.Query("limit"); s != "" {
+		limit, err := strconv.Atoi(s)
+		if err != nil || limit < 1 || limit > MaxPageSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", MaxPageSize)})
+			return
+		}
+		filter.Limit = limit
+	}
+
+	// one extra row tells us whether there is another page
+	limit := filter.Limit
+	filter.Limit++
+
+	notifications, err := txnService.notifRepo.ListNotifications(uid, filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve notifications"})
+		return
+	}
+
+	unread, err := txnService.notifRepo.CountUnread(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to count unread notifications"})
+		return
+	}
+	c.Header("X-Unread-Count", strconv.Itoa(unread))
+
+	if len(notifications) > limit {
+		notifications = notifications[:limit]
+		setNextCursor(c, notifications[limit-1].CreatedAt, notifications[limit-1].ID)
+	}
+
+	c.JSON(http.StatusOK, notifications)
+}
+
+func markNotificationReadHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	notification, err := txnService.notifRepo.GetNotificationByID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Notification not found"})
+		return
+	}
+
+	if notification.UserID != uid {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	err = txnService.notifRepo.MarkRead(notification.ID, txnService.clock.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update notification"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Notification marked as read"})
+}
+
+func markAllNotificationsReadHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	updated, err := txnService.notifRepo.MarkAllRead(uid, txnService.clock.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update notifications"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Notifications marked as read", "updated": updated})
+}
+
+func deleteNotificationHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	notification, err := txnService.notifRepo.GetNotificationByID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Notification not found"})
+		return
+	}
+
+	if notification.UserID != uid {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	err = txnService.notifRepo.DeleteNotification(notification.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete notification"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Notification deleted successfully"})
+}
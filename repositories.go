@@ -2,27 +2,72 @@ package main
 
 import (
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/lib/pq"
 )
 
+// DBTX is what *sql.DB and *sql.Tx have in common
+type DBTX interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// conn runs statements in tx when there is one and straight on db otherwise
+func conn(db *sql.DB, tx *sql.Tx) DBTX {
+	if tx != nil {
+		return tx
+	}
+	return db
+}
+
 // PostgresTransactionRepository and its methods
 type PostgresTransactionRepository struct {
 	db *sql.DB
 }
 
-func (r *PostgresTransactionRepository) SaveTransaction(tx Transaction) error {
-	query := "INSERT INTO transactions (id, user_id, amount, category, roundup, created_at, merchant, roundup_enabled) VALUES ($1, $2, $3, $4, $5, $6, $7, $8)"
-	_, err := r.db.Exec(query, tx.ID, tx.UserID, tx.Amount, tx.Category, tx.Roundup, tx.CreatedAt, tx.Merchant, tx.RoundupEnabled)
+func (r *PostgresTransactionRepository) SaveTransaction(dbTx *sql.Tx, tx Transaction) error {
+	var breakdown []byte
+	if tx.RoundupBreakdown != nil {
+		var err error
+		breakdown, err = json.Marshal(tx.RoundupBreakdown)
+		if err != nil {
+			return err
+		}
+	}
+
+	query := "INSERT INTO transactions (id, user_id, amount, category, roundup, created_at, merchant, roundup_enabled, roundup_capped, cap_reason, penalty_roundup, anomalous, anomaly_reasons, roundup_breakdown) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)"
+	_, err := conn(r.db, dbTx).Exec(query, tx.ID, tx.UserID, tx.Amount, tx.Category, tx.Roundup, tx.CreatedAt, tx.Merchant, tx.RoundupEnabled, tx.RoundupCapped, tx.CapReason, tx.PenaltyRoundup, tx.Anomalous, pq.Array(tx.AnomalyReasons), breakdown)
 	fmt.Println(err)
 	return err
 }
 
 func (r *PostgresTransactionRepository) GetTransactionsByUserID(userID string) ([]Transaction, error) {
-	query := "SELECT id, user_id, amount, category, roundup, created_at, merchant, roundup_enabled FROM transactions WHERE user_id = $1"
-	rows, err := r.db.Query(query, userID)
+	query := "SELECT id, user_id, amount, category, roundup, created_at, merchant, roundup_enabled, roundup_capped, cap_reason, penalty_roundup, anomalous, anomaly_reasons FROM transactions WHERE user_id = $1 ORDER BY created_at DESC, id DESC"
+	return r.queryTransactions(query, userID)
+}
+
+// ListTransactions returns one page of the user's transactions, newest first
+func (r *PostgresTransactionRepository) ListTransactions(userID string, filter TransactionFilter) ([]Transaction, error) {
+	where := &whereClause{}
+	where.add("user_id = ?", userID)
+	where.addFilter(filter)
+	for _, condition := range paymentConditions(filter) {
+		where.add(condition.sql, condition.args...)
+	}
+
+	query := "SELECT id, user_id, amount, category, roundup, created_at, merchant, roundup_enabled, roundup_capped, cap_reason, penalty_roundup, anomalous, anomaly_reasons FROM transactions" +
+		where.String() + " ORDER BY created_at DESC, id DESC LIMIT " + strconv.Itoa(filter.Limit)
+	return r.queryTransactions(query, where.args...)
+}
+
+func (r *PostgresTransactionRepository) queryTransactions(query string, args ...interface{}) ([]Transaction, error) {
+	rows, err := r.db.Query(query, args...)
 
 	if err != nil {
 		fmt.Println(err)
@@ -34,7 +79,7 @@ func (r *PostgresTransactionRepository) GetTransactionsByUserID(userID string) (
 	var transactions []Transaction
 	for rows.Next() {
 		var tx Transaction
-		err := rows.Scan(&tx.ID, &tx.UserID, &tx.Amount, &tx.Category, &tx.Roundup, &tx.CreatedAt, &tx.Merchant, &tx.RoundupEnabled)
+		err := rows.Scan(&tx.ID, &tx.UserID, &tx.Amount, &tx.Category, &tx.Roundup, &tx.CreatedAt, &tx.Merchant, &tx.RoundupEnabled, &tx.RoundupCapped, &tx.CapReason, &tx.PenaltyRoundup, &tx.Anomalous, pq.Array(&tx.AnomalyReasons))
 
 		if err != nil {
 			fmt.Println(err)
@@ -48,16 +93,27 @@ func (r *PostgresTransactionRepository) GetTransactionsByUserID(userID string) (
 }
 
 func (r *PostgresTransactionRepository) GetTransactionByID(id string) (*Transaction, error) {
-	query := "SELECT id, user_id, amount, category, roundup, created_at, merchant, roundup_enabled FROM transactions WHERE id = $1"
+	query := "SELECT id, user_id, amount, category, roundup, created_at, merchant, roundup_enabled, roundup_capped, cap_reason, penalty_roundup, anomalous, anomaly_reasons, roundup_breakdown FROM transactions WHERE id = $1"
 
 	var tx Transaction
-	err := r.db.QueryRow(query, id).Scan(&tx.ID, &tx.UserID, &tx.Amount, &tx.Category, &tx.Roundup, &tx.CreatedAt, &tx.Merchant, &tx.RoundupEnabled)
+	var breakdown []byte
+	err := r.db.QueryRow(query, id).Scan(&tx.ID, &tx.UserID, &tx.Amount, &tx.Category, &tx.Roundup, &tx.CreatedAt, &tx.Merchant, &tx.RoundupEnabled, &tx.RoundupCapped, &tx.CapReason, &tx.PenaltyRoundup, &tx.Anomalous, pq.Array(&tx.AnomalyReasons), &breakdown)
 
 	if err != nil {
 		fmt.Println(err)
 		return nil, err
 	}
 
+	// transactions saved before breakdowns were recorded have none
+	if breakdown != nil {
+		tx.RoundupBreakdown = &RoundupBreakdown{}
+		err = json.Unmarshal(breakdown, tx.RoundupBreakdown)
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+	}
+
 	return &tx, nil
 }
 
@@ -68,26 +124,29 @@ type PostgresUserRepository struct {
 
 func (r *PostgresUserRepository) FindByID(id string) (*User, error) {
 	var user User
-	query := "SELECT id, name, email, created_at FROM users WHERE id = $1"
+	query := "SELECT id, name, email, role, frozen, created_at FROM users WHERE id = $1"
 
-	err := r.db.QueryRow(query, id).Scan(&user.ID, &user.Name, &user.Email, &user.CreatedAt)
+	err := r.db.QueryRow(query, id).Scan(&user.ID, &user.Name, &user.Email, &user.Role, &user.Frozen, &user.CreatedAt)
 
 	if err != nil {
 		fmt.Println(err)
 		return nil, err
 	}
 
-	var roundupDates []string // Temporarily store dates as strings
+	var multipliers, channels []byte
 	// Fetch user preferences separately
-	query = "SELECT roundup_categories, goal_name, goal_amount, target_date, current_savings, roundup_history, roundup_dates FROM user_preferences WHERE user_id = $1"
+	query = "SELECT roundup_categories, goal_allocation, current_savings, transaction_roundup_cap, daily_roundup_cap, weekly_roundup_cap, monthly_roundup_cap, category_multipliers, budget_penalty, notification_channels FROM user_preferences WHERE user_id = $1"
 	err = r.db.QueryRow(query, id).Scan(
 		pq.Array(&user.Preferences.RoundupCategories),
-		&user.Preferences.GoalName,
-		&user.Preferences.GoalAmount,
-		&user.Preferences.TargetDate,
+		&user.Preferences.GoalAllocation,
 		&user.Preferences.CurrentSavings,
-		pq.Array(&user.Preferences.RoundupHistory),
-		pq.Array(&roundupDates),
+		&user.Preferences.TransactionRoundupCap,
+		&user.Preferences.DailyRoundupCap,
+		&user.Preferences.WeeklyRoundupCap,
+		&user.Preferences.MonthlyRoundupCap,
+		&multipliers,
+		&user.Preferences.BudgetPenalty,
+		&channels,
 	)
 
 	if err != nil {
@@ -95,56 +154,108 @@ func (r *PostgresUserRepository) FindByID(id string) (*User, error) {
 		return nil, err
 	}
 
-	user.Preferences.RoundupDates = []time.Time{}
-	for _, dateStr := range roundupDates {
-		parsedTime, parseErr := time.Parse("2006-01-02 15:04:05.999999", dateStr)
-		if parseErr != nil {
-			fmt.Printf("Error parsing date '%s': %v\n", dateStr, parseErr)
-			continue
-		}
-		user.Preferences.RoundupDates = append(user.Preferences.RoundupDates, parsedTime)
+	err = json.Unmarshal(multipliers, &user.Preferences.CategoryMultipliers)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+
+	err = json.Unmarshal(channels, &user.Preferences.NotificationChannels)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
 	}
 
 	return &user, nil
 }
 
-func (r *PostgresUserRepository) CreateUserPreferences(userID string, prefs UserPreferences) error {
+func (r *PostgresUserRepository) CreateUserPreferences(dbTx *sql.Tx, userID string, prefs UserPreferences) error {
 	query := `
 		INSERT INTO user_preferences
-		(user_id, roundup_categories, goal_amount, target_date, current_savings, roundup_history, roundup_dates)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		(user_id, roundup_categories, goal_allocation, current_savings,
+		transaction_roundup_cap, daily_roundup_cap, weekly_roundup_cap, monthly_roundup_cap, category_multipliers, budget_penalty,
+		notification_channels)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
 	`
-	_, err := r.db.Exec(query,
+	multipliers, err := categoryMultipliersJSON(prefs.CategoryMultipliers)
+	if err != nil {
+		return err
+	}
+
+	channels, err := notificationChannelsJSON(prefs.NotificationChannels)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn(r.db, dbTx).Exec(query,
 		userID,
 		pq.Array(prefs.RoundupCategories),
-		prefs.GoalAmount,
-		prefs.TargetDate,
+		prefs.GoalAllocation,
 		prefs.CurrentSavings,
-		pq.Array(prefs.RoundupHistory),
-		pq.Array(prefs.RoundupDates),
+		prefs.TransactionRoundupCap,
+		prefs.DailyRoundupCap,
+		prefs.WeeklyRoundupCap,
+		prefs.MonthlyRoundupCap,
+		multipliers,
+		prefs.BudgetPenalty,
+		channels,
 	)
 	return err
 }
 
-func (r *PostgresUserRepository) UpdatePreferences(userID string, prefs UserPreferences) error {
+// categoryMultipliersJSON encodes the multipliers for the jsonb column, which is never null
+func categoryMultipliersJSON(multipliers map[string]float64) ([]byte, error) {
+	if multipliers == nil {
+		multipliers = map[string]float64{}
+	}
+	return json.Marshal(multipliers)
+}
+
+// notificationChannelsJSON encodes the channel choices for the jsonb column, which is never null
+func notificationChannelsJSON(channels map[string][]string) ([]byte, error) {
+	if channels == nil {
+		channels = map[string][]string{}
+	}
+	return json.Marshal(channels)
+}
+
+func (r *PostgresUserRepository) UpdatePreferences(dbTx *sql.Tx, userID string, prefs UserPreferences) error {
 	query := `
     UPDATE user_preferences
     SET
         roundup_categories = $1,
-        goal_amount = $2,
-        target_date = $3,
-        current_savings = $4,
-        roundup_history = $5,
-        roundup_dates = $6
-    WHERE user_id = $7
+        goal_allocation = $2,
+        current_savings = $3,
+        transaction_roundup_cap = $4,
+        daily_roundup_cap = $5,
+        weekly_roundup_cap = $6,
+        monthly_roundup_cap = $7,
+        category_multipliers = $8,
+        budget_penalty = $9,
+        notification_channels = $10
+    WHERE user_id = $11
     `
-	_, err := r.db.Exec(query,
+	multipliers, err := categoryMultipliersJSON(prefs.CategoryMultipliers)
+	if err != nil {
+		return err
+	}
+
+	channels, err := notificationChannelsJSON(prefs.NotificationChannels)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn(r.db, dbTx).Exec(query,
 		pq.Array(prefs.RoundupCategories),
-		prefs.GoalAmount,
-		prefs.TargetDate,
+		prefs.GoalAllocation,
 		prefs.CurrentSavings,
-		pq.Array(prefs.RoundupHistory),
-		pq.Array(prefs.RoundupDates),
+		prefs.TransactionRoundupCap,
+		prefs.DailyRoundupCap,
+		prefs.WeeklyRoundupCap,
+		prefs.MonthlyRoundupCap,
+		multipliers,
+		prefs.BudgetPenalty,
+		channels,
 		userID,
 	)
 	return err
@@ -177,33 +288,46 @@ func (r *PostgresUserRepository) Update(user *User) error {
 }
 
 func (r *PostgresUserRepository) updatePreferences(tx *sql.Tx, userID string, prefs UserPreferences) error {
-	query := "UPDATE user_preferences SET roundup_categories = $1, goal_name = $2, goal_amount = $3, target_date = $4, current_savings = $5, roundup_history = $6, roundup_dates = $7 WHERE user_id = $8"
+	query := "UPDATE user_preferences SET roundup_categories = $1, goal_allocation = $2, current_savings = $3, transaction_roundup_cap = $4, daily_roundup_cap = $5, weekly_roundup_cap = $6, monthly_roundup_cap = $7, category_multipliers = $8, budget_penalty = $9, notification_channels = $10 WHERE user_id = $11"
+
+	multipliers, err := categoryMultipliersJSON(prefs.CategoryMultipliers)
+	if err != nil {
+		return err
+	}
+
+	channels, err := notificationChannelsJSON(prefs.NotificationChannels)
+	if err != nil {
+		return err
+	}
 
-	_, err := tx.Exec(query,
+	_, err = tx.Exec(query,
 		pq.Array(prefs.RoundupCategories),
-		prefs.GoalName,
-		prefs.GoalAmount,
-		prefs.TargetDate,
+		prefs.GoalAllocation,
 		prefs.CurrentSavings,
-		pq.Array(prefs.RoundupHistory),
-		pq.Array(prefs.RoundupDates),
+		prefs.TransactionRoundupCap,
+		prefs.DailyRoundupCap,
+		prefs.WeeklyRoundupCap,
+		prefs.MonthlyRoundupCap,
+		multipliers,
+		prefs.BudgetPenalty,
+		channels,
 		userID,
 	)
 	fmt.Println(err)
 	return err
 }
 
-func (r *PostgresUserRepository) CreateUser(user *User) error {
-	query := "INSERT INTO users (id, name, email, password, created_at) VALUES ($1, $2, $3, $4, $5)"
-	_, err := r.db.Exec(query, user.ID, user.Name, user.Email, user.Password, user.CreatedAt)
+func (r *PostgresUserRepository) CreateUser(dbTx *sql.Tx, user *User) error {
+	query := "INSERT INTO users (id, name, email, password, role, created_at) VALUES ($1, $2, $3, $4, $5, $6)"
+	_, err := conn(r.db, dbTx).Exec(query, user.ID, user.Name, user.Email, user.Password, user.Role, user.CreatedAt)
 	fmt.Println(err)
 	return err
 }
 
 func (r *PostgresUserRepository) GetUserByEmail(email string) (*User, error) {
 	var user User
-	query := "SELECT id, name, email, password, created_at FROM users WHERE email = $1"
-	err := r.db.QueryRow(query, email).Scan(&user.ID, &user.Name, &user.Email, &user.Password, &user.CreatedAt)
+	query := "SELECT id, name, email, password, role, frozen, created_at FROM users WHERE email = $1"
+	err := r.db.QueryRow(query, email).Scan(&user.ID, &user.Name, &user.Email, &user.Password, &user.Role, &user.Frozen, &user.CreatedAt)
 	if err != nil {
 		fmt.Println(err)
 		return nil, err
@@ -211,41 +335,203 @@ func (r *PostgresUserRepository) GetUserByEmail(email string) (*User, error) {
 	return &user, nil
 }
 
+func (r *PostgresUserRepository) ListUsers() ([]User, error) {
+	query := "SELECT id, name, email, role, frozen, created_at FROM users ORDER BY created_at"
+	rows, err := r.db.Query(query)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var user User
+		err := rows.Scan(&user.ID, &user.Name, &user.Email, &user.Role, &user.Frozen, &user.CreatedAt)
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (r *PostgresUserRepository) SetFrozen(userID string, frozen bool) error {
+	result, err := r.db.Exec("UPDATE users SET frozen = $1 WHERE id = $2", frozen, userID)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+// GetAccess returns what the user may currently do, checked on every request rather than trusted from the token
+func (r *PostgresUserRepository) GetAccess(userID string) (string, bool, error) {
+	var role string
+	var frozen bool
+	err := r.db.QueryRow("SELECT role, frozen FROM users WHERE id = $1", userID).Scan(&role, &frozen)
+	if err != nil {
+		fmt.Println(err)
+		return "", false, err
+	}
+	return role, frozen, nil
+}
+
+func (r *PostgresUserRepository) GetPasswordHash(userID string) (string, error) {
+	var hash string
+	err := r.db.QueryRow("SELECT password FROM users WHERE id = $1", userID).Scan(&hash)
+	if err != nil {
+		fmt.Println(err)
+		return "", err
+	}
+	return hash, nil
+}
+
+func (r *PostgresUserRepository) UpdatePassword(userID string, passwordHash string) error {
+	_, err := r.db.Exec("UPDATE users SET password = $1 WHERE id = $2", passwordHash, userID)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+func (r *PostgresUserRepository) SetPendingEmail(userID, email, tokenHash string, expiresAt time.Time) error {
+	query := "UPDATE users SET pending_email = $1, email_token_hash = $2, email_token_expires_at = $3 WHERE id = $4"
+	_, err := r.db.Exec(query, email, tokenHash, expiresAt, userID)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+// ConfirmPendingEmail swaps in the pending email for the token's owner and returns their ID
+func (r *PostgresUserRepository) ConfirmPendingEmail(tokenHash string) (string, error) {
+	query := `
+		UPDATE users
+		SET email = pending_email, pending_email = NULL, email_token_hash = NULL, email_token_expires_at = NULL
+		WHERE email_token_hash = $1 AND email_token_expires_at > NOW() AND pending_email IS NOT NULL
+		RETURNING id
+	`
+	var userID string
+	err := r.db.QueryRow(query, tokenHash).Scan(&userID)
+	if err != nil {
+		fmt.Println(err)
+		return "", err
+	}
+	return userID, nil
+}
+
+// AnonymizeUser strips personal data from a user in a single database transaction.
+// Transactions, the wallet and its ledger are kept so money already moved still adds up,
+// but merchants and free-text descriptions are redacted and preferences and goals are dropped.
+func (r *PostgresUserRepository) AnonymizeUser(userID string) error {
+	tx, err := r.db.Begin()
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+
+	statements := []string{
+		"UPDATE users SET name = 'Deleted user', email = 'deleted-' || id || '@deleted.invalid', password = '', pending_email = NULL, email_token_hash = NULL, frozen = true, deleted_at = NOW() WHERE id = $1",
+		"DELETE FROM user_preferences WHERE user_id = $1",
+		"DELETE FROM goals WHERE user_id = $1",
+		"DELETE FROM budgets WHERE user_id = $1",
+		"DELETE FROM subscriptions WHERE user_id = $1",
+		"DELETE FROM outbox_events WHERE user_id = $1",
+		"DELETE FROM notifications WHERE user_id = $1",
+		"DELETE FROM push_devices WHERE user_id = $1",
+		"DELETE FROM webhook_deliveries WHERE user_id = $1", // their payloads hold the user's events, tenant webhooks' too
+		"DELETE FROM webhooks WHERE user_id = $1",
+		"UPDATE transactions SET merchant = 'redacted' WHERE user_id = $1",
+		"UPDATE wallet_transactions SET description = 'redacted' WHERE wallet_id IN (SELECT id FROM wallets WHERE user_id = $1)",
+	}
+
+	for _, stmt := range statements {
+		_, err = tx.Exec(stmt, userID)
+		if err != nil {
+			tx.Rollback()
+			fmt.Println(err)
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
 type PostgresWalletRepository struct {
 	db *sql.DB
 }
 
-func (r *PostgresWalletRepository) CreateWallet(wallet Wallet) error {
+func (r *PostgresWalletRepository) CreateWallet(dbTx *sql.Tx, wallet Wallet) error {
 	query := "INSERT INTO wallets (id, user_id, balance, last_updated) VALUES ($1, $2, $3, $4)"
-	_, err := r.db.Exec(query, wallet.ID, wallet.UserID, wallet.Balance, wallet.LastUpdated)
+	_, err := conn(r.db, dbTx).Exec(query, wallet.ID, wallet.UserID, wallet.Balance, wallet.LastUpdated)
 	return err
 }
 
 func (r *PostgresWalletRepository) GetWalletByUserID(userID string) (*Wallet, error) {
-	query := "SELECT id, user_id, balance, last_updated FROM wallets WHERE user_id = $1"
+	query := "SELECT id, user_id, balance, version, last_updated FROM wallets WHERE user_id = $1"
 	var wallet Wallet
-	err := r.db.QueryRow(query, userID).Scan(&wallet.ID, &wallet.UserID, &wallet.Balance, &wallet.LastUpdated)
+	err := r.db.QueryRow(query, userID).Scan(&wallet.ID, &wallet.UserID, &wallet.Balance, &wallet.Version, &wallet.LastUpdated)
 	if err != nil {
 		return nil, err
 	}
 	return &wallet, nil
 }
 
-func (r *PostgresWalletRepository) UpdateWalletBalance(walletID string, newBalance float64) error {
-	query := "UPDATE wallets SET balance = $1, last_updated = $2 WHERE id = $3"
-	_, err := r.db.Exec(query, newBalance, time.Now(), walletID)
-	return err
+// AdjustWalletBalance adds change to the balance in SQL, so concurrent updates don't overwrite each other,
+// and returns the new balance and version. It fails with sql.ErrNoRows rather than go below zero.
+func (r *PostgresWalletRepository) AdjustWalletBalance(dbTx *sql.Tx, walletID string, change float64) (float64, int64, error) {
+	query := "UPDATE wallets SET balance = balance + $1, version = version + 1, last_updated = $2 WHERE id = $3 AND balance + $1 >= 0 RETURNING balance, version"
+	var balance float64
+	var version int64
+	err := conn(r.db, dbTx).QueryRow(query, change, time.Now(), walletID).Scan(&balance, &version)
+	return balance, version, err
 }
 
-func (r *PostgresWalletRepository) AddWalletTransaction(tx WalletTransaction) error {
-	query := "INSERT INTO wallet_transactions (id, wallet_id, amount, type, description, created_at) VALUES ($1, $2, $3, $4, $5, $6)"
-	_, err := r.db.Exec(query, tx.ID, tx.WalletID, tx.Amount, tx.Type, tx.Description, tx.CreatedAt)
+func (r *PostgresWalletRepository) AddWalletTransaction(dbTx *sql.Tx, tx WalletTransaction) error {
+	query := "INSERT INTO wallet_transactions (id, wallet_id, amount, type, description, transaction_id, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7)"
+	_, err := conn(r.db, dbTx).Exec(query, tx.ID, tx.WalletID, tx.Amount, tx.Type, tx.Description, tx.TransactionID, tx.CreatedAt)
 	return err
 }
 
 func (r *PostgresWalletRepository) GetWalletTransactions(walletID string) ([]WalletTransaction, error) {
-	query := "SELECT id, wallet_id, amount, type, description, created_at FROM wallet_transactions WHERE wallet_id = $1 ORDER BY created_at DESC"
-	rows, err := r.db.Query(query, walletID)
+	query := "SELECT id, wallet_id, amount, type, description, transaction_id, created_at FROM wallet_transactions WHERE wallet_id = $1 ORDER BY created_at DESC, id DESC"
+	return r.queryWalletTransactions(query, walletID)
+}
+
+// ListWalletTransactions returns one page of the wallet's transactions, newest first
+func (r *PostgresWalletRepository) ListWalletTransactions(walletID string, filter TransactionFilter) ([]WalletTransaction, error) {
+	where := &whereClause{}
+	where.add("wallet_id = ?", walletID)
+	where.addFilter(filter)
+
+	// payment filters go through the transaction a roundup credit came from
+	var paymentSQL []string
+	var paymentArgs []interface{}
+	for _, condition := range paymentConditions(filter) {
+		paymentSQL = append(paymentSQL, condition.sql)
+		paymentArgs = append(paymentArgs, condition.args...)
+	}
+	if len(paymentSQL) > 0 {
+		where.add("transaction_id IN (SELECT id FROM transactions WHERE "+strings.Join(paymentSQL, " AND ")+")", paymentArgs...)
+	}
+
+	query := "SELECT id, wallet_id, amount, type, description, transaction_id, created_at FROM wallet_transactions" +
+		where.String() + " ORDER BY created_at DESC, id DESC LIMIT " + strconv.Itoa(filter.Limit)
+	return r.queryWalletTransactions(query, where.args...)
+}
+
+func (r *PostgresWalletRepository) queryWalletTransactions(query string, args ...interface{}) ([]WalletTransaction, error) {
+	rows, err := r.db.Query(query, args...)
 	if err != nil {
 		return nil, err
 	}
@@ -254,7 +540,7 @@ func (r *PostgresWalletRepository) GetWalletTransactions(walletID string) ([]Wal
 	var transactions []WalletTransaction
 	for rows.Next() {
 		var tx WalletTransaction
-		err := rows.Scan(&tx.ID, &tx.WalletID, &tx.Amount, &tx.Type, &tx.Description, &tx.CreatedAt)
+		err := rows.Scan(&tx.ID, &tx.WalletID, &tx.Amount, &tx.Type, &tx.Description, &tx.TransactionID, &tx.CreatedAt)
 		if err != nil {
 			return nil, err
 		}
@@ -274,3 +560,979 @@ func (r *PostgresTransactionRepository) GetTotalRoundupInPeriod(days int) (float
 
 	return totalRoundup, nil
 }
+
+func (r *PostgresTransactionRepository) UpdateCategoryByMerchant(merchant, category string) (int64, error) {
+	query := "UPDATE transactions SET category = $1 WHERE merchant = $2"
+	result, err := r.db.Exec(query, category, merchant)
+	if err != nil {
+		fmt.Println(err)
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// GetSpendingByCategory totals the transactions made between from (inclusive) and to (exclusive)
+// per category and per period
+func (r *PostgresTransactionRepository) GetSpendingByCategory(userID, period string, from, to time.Time) ([]CategorySpending, error) {
+	query := `
+		SELECT date_trunc($2, created_at) AS period, category, SUM(amount), COUNT(*), COALESCE(SUM(roundup), 0)
+		FROM transactions
+		WHERE user_id = $1 AND created_at >= $3 AND created_at < $4
+		GROUP BY period, category
+		ORDER BY period, SUM(amount) DESC
+	`
+	rows, err := r.db.Query(query, userID, period, from, to)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	spending := []CategorySpending{}
+	for rows.Next() {
+		var s CategorySpending
+		err := rows.Scan(&s.Period, &s.Category, &s.Total, &s.Count, &s.Roundup)
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+		spending = append(spending, s)
+	}
+	return spending, nil
+}
+
+func (r *PostgresTransactionRepository) GetTopMerchants(userID string, from, to time.Time, limit int) ([]MerchantSpending, error) {
+	query := `
+		SELECT merchant, SUM(amount), COUNT(*)
+		FROM transactions
+		WHERE user_id = $1 AND created_at >= $2 AND created_at < $3
+		GROUP BY merchant
+		ORDER BY SUM(amount) DESC, merchant
+		LIMIT $4
+	`
+	rows, err := r.db.Query(query, userID, from, to, limit)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	merchants := []MerchantSpending{}
+	for rows.Next() {
+		var m MerchantSpending
+		err := rows.Scan(&m.Merchant, &m.Total, &m.Count)
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+		merchants = append(merchants, m)
+	}
+	return merchants, nil
+}
+
+func (r *PostgresTransactionRepository) GetRoundupTotals(userID, period string, from, to time.Time) ([]RoundupTotal, error) {
+	query := `
+		SELECT date_trunc($2, created_at) AS period, SUM(roundup), COUNT(*) FILTER (WHERE roundup > 0), SUM(roundup_capped)
+		FROM transactions
+		WHERE user_id = $1 AND created_at >= $3 AND created_at < $4 AND roundup_enabled
+		GROUP BY period
+		ORDER BY period
+	`
+	rows, err := r.db.Query(query, userID, period, from, to)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	totals := []RoundupTotal{}
+	for rows.Next() {
+		var t RoundupTotal
+		err := rows.Scan(&t.Period, &t.Total, &t.Count, &t.Capped)
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+		totals = append(totals, t)
+	}
+	return totals, nil
+}
+
+// whereClause collects conditions written with ? placeholders and numbers them $1, $2, ... in order
+type whereClause struct {
+	conditions []string
+	args       []interface{}
+}
+
+func (w *whereClause) add(condition string, args ...interface{}) {
+	for _, arg := range args {
+		w.args = append(w.args, arg)
+		condition = strings.Replace(condition, "?", "$"+strconv.Itoa(len(w.args)), 1)
+	}
+	w.conditions = append(w.conditions, condition)
+}
+
+// addFilter adds the filters shared by transactions and wallet transactions,
+// which both have amount and created_at columns and page on (created_at, id)
+func (w *whereClause) addFilter(filter TransactionFilter) {
+	if filter.From != nil {
+		w.add("created_at >= ?", *filter.From)
+	}
+	if filter.To != nil {
+		w.add("created_at < ?", *filter.To)
+	}
+	if filter.MinAmount != nil {
+		w.add("amount >= ?", *filter.MinAmount)
+	}
+	if filter.MaxAmount != nil {
+		w.add("amount <= ?", *filter.MaxAmount)
+	}
+	if filter.After != nil {
+		w.add("(created_at, id) < (?, ?)", filter.After.CreatedAt, filter.After.ID)
+	}
+}
+
+type sqlCondition struct {
+	sql  string
+	args []interface{}
+}
+
+// paymentConditions are the filters on columns only the transactions table has, with ? placeholders
+func paymentConditions(filter TransactionFilter) []sqlCondition {
+	var conditions []sqlCondition
+	if filter.Category != "" {
+		conditions = append(conditions, sqlCondition{"category = ?", []interface{}{filter.Category}})
+	}
+	if filter.Merchant != "" {
+		conditions = append(conditions, sqlCondition{"merchant = ?", []interface{}{filter.Merchant}})
+	}
+	if filter.RoundupEnabled != nil {
+		conditions = append(conditions, sqlCondition{"roundup_enabled = ?", []interface{}{*filter.RoundupEnabled}})
+	}
+	return conditions
+}
+
+func (w *whereClause) String() string {
+	if len(w.conditions) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(w.conditions, " AND ")
+}
+
+// GetSpendingBaseline summarises the user's transactions since the given time for the anomaly detector.
+// Whether the merchant is known looks at all time.
+func (r *PostgresTransactionRepository) GetSpendingBaseline(userID, category, merchant string, hour int, since time.Time) (*SpendingBaseline, error) {
+	query := `
+		SELECT
+			COUNT(*) FILTER (WHERE category = $2),
+			COALESCE(AVG(amount) FILTER (WHERE category = $2), 0),
+			COALESCE(STDDEV_SAMP(amount) FILTER (WHERE category = $2), 0),
+			COUNT(*) FILTER (WHERE EXTRACT(HOUR FROM created_at) = $4),
+			COUNT(*),
+			EXISTS (SELECT 1 FROM transactions WHERE user_id = $1 AND merchant = $3)
+		FROM transactions
+		WHERE user_id = $1 AND created_at >= $5
+	`
+	var b SpendingBaseline
+	err := r.db.QueryRow(query, userID, category, merchant, hour, since).Scan(
+		&b.CategoryCount, &b.CategoryMean, &b.CategoryStdDev, &b.HourCount, &b.TotalCount, &b.MerchantSeen)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	return &b, nil
+}
+
+// PostgresGoalRepository and its methods
+type PostgresGoalRepository struct {
+	db *sql.DB
+}
+
+const goalColumns = "id, user_id, name, amount, target_date, current_savings, priority, weight, status, on_complete, milestone, created_at, achieved_at, expired_at, abandoned_at, archived_at"
+
+// scanGoal reads a row selected with goalColumns
+func scanGoal(row interface{ Scan(...interface{}) error }) (Goal, error) {
+	var goal Goal
+	err := row.Scan(&goal.ID, &goal.UserID, &goal.Name, &goal.Amount, &goal.TargetDate, &goal.CurrentSavings, &goal.Priority, &goal.Weight,
+		&goal.Status, &goal.OnComplete, &goal.Milestone, &goal.CreatedAt, &goal.AchievedAt, &goal.ExpiredAt, &goal.AbandonedAt, &goal.ArchivedAt)
+	return goal, err
+}
+
+func (r *PostgresGoalRepository) CreateGoal(goal Goal) error {
+	query := "INSERT INTO goals (id, user_id, name, amount, target_date, current_savings, priority, weight, status, on_complete, created_at) VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)"
+	_, err := r.db.Exec(query, goal.ID, goal.UserID, goal.Name, goal.Amount, goal.TargetDate, goal.CurrentSavings, goal.Priority, goal.Weight, goal.Status, goal.OnComplete, goal.CreatedAt)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+func (r *PostgresGoalRepository) GetGoalsByUserID(userID string) ([]Goal, error) {
+	query := "SELECT " + goalColumns + " FROM goals WHERE user_id = $1 ORDER BY priority, created_at"
+	return r.queryGoals(r.db, query, userID)
+}
+
+// LockGoalsByUserID reads the user's goals like GetGoalsByUserID and locks them until dbTx ends,
+// so savings added meanwhile wait for the caller's changes instead of being lost
+func (r *PostgresGoalRepository) LockGoalsByUserID(dbTx *sql.Tx, userID string) ([]Goal, error) {
+	query := "SELECT " + goalColumns + " FROM goals WHERE user_id = $1 ORDER BY priority, created_at FOR UPDATE"
+	return r.queryGoals(conn(r.db, dbTx), query, userID)
+}
+
+func (r *PostgresGoalRepository) queryGoals(db DBTX, query string, args ...interface{}) ([]Goal, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	goals := []Goal{}
+	for rows.Next() {
+		goal, err := scanGoal(rows)
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+		goals = append(goals, goal)
+	}
+	return goals, nil
+}
+
+func (r *PostgresGoalRepository) GetGoalByID(id string) (*Goal, error) {
+	query := "SELECT " + goalColumns + " FROM goals WHERE id = $1"
+
+	goal, err := scanGoal(r.db.QueryRow(query, id))
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	return &goal, nil
+}
+
+func (r *PostgresGoalRepository) UpdateGoal(goal Goal) error {
+	query := "UPDATE goals SET name = $1, amount = $2, target_date = $3, priority = $4, weight = $5, on_complete = $6 WHERE id = $7"
+	_, err := r.db.Exec(query, goal.Name, goal.Amount, goal.TargetDate, goal.Priority, goal.Weight, goal.OnComplete, goal.ID)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+// DeleteGoal removes a goal nothing has been saved towards yet and reports whether it did.
+// The check is part of the DELETE so a roundup landing meanwhile can't be deleted with it.
+func (r *PostgresGoalRepository) DeleteGoal(id string) (bool, error) {
+	result, err := r.db.Exec("DELETE FROM goals WHERE id = $1 AND current_savings = 0", id)
+	if err != nil {
+		fmt.Println(err)
+		return false, err
+	}
+	deleted, err := result.RowsAffected()
+	return deleted > 0, err
+}
+
+// AddToGoalSavings increments in SQL so concurrent roundups don't overwrite each other
+func (r *PostgresGoalRepository) AddToGoalSavings(dbTx *sql.Tx, goalID string, amount float64) error {
+	_, err := conn(r.db, dbTx).Exec("UPDATE goals SET current_savings = current_savings + $1 WHERE id = $2", amount, goalID)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+// UpdateGoalState persists a status transition together with its timestamps. Savings only ever
+// change through AddToGoalSavings, so a goal read a moment ago can't overwrite a newer amount.
+func (r *PostgresGoalRepository) UpdateGoalState(dbTx *sql.Tx, goal Goal) error {
+	query := "UPDATE goals SET status = $1, milestone = $2, achieved_at = $3, expired_at = $4, abandoned_at = $5, archived_at = $6 WHERE id = $7"
+	_, err := conn(r.db, dbTx).Exec(query, goal.Status, goal.Milestone, goal.AchievedAt, goal.ExpiredAt, goal.AbandonedAt, goal.ArchivedAt, goal.ID)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+// AdvanceMilestone raises the goal's milestone, reporting false if it was already there.
+// Only the refresh that moves it announces the milestone, however many run at once.
+func (r *PostgresGoalRepository) AdvanceMilestone(dbTx *sql.Tx, goalID string, milestone int) (bool, error) {
+	result, err := conn(r.db, dbTx).Exec("UPDATE goals SET milestone = $1 WHERE id = $2 AND milestone < $1", milestone, goalID)
+	if err != nil {
+		fmt.Println(err)
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected == 1, nil
+}
+
+// PostgresBudgetRepository and its methods
+type PostgresBudgetRepository struct {
+	db *sql.DB
+}
+
+func (r *PostgresBudgetRepository) CreateBudget(budget Budget) error {
+	query := "INSERT INTO budgets (id, user_id, category, monthly_limit, created_at) VALUES ($1, $2, $3, $4, $5)"
+	_, err := r.db.Exec(query, budget.ID, budget.UserID, budget.Category, budget.MonthlyLimit, budget.CreatedAt)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+func (r *PostgresBudgetRepository) GetBudgetsByUserID(userID string) ([]Budget, error) {
+	query := "SELECT id, user_id, category, monthly_limit, created_at FROM budgets WHERE user_id = $1 ORDER BY category"
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	budgets := []Budget{}
+	for rows.Next() {
+		var budget Budget
+		err := rows.Scan(&budget.ID, &budget.UserID, &budget.Category, &budget.MonthlyLimit, &budget.CreatedAt)
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+		budgets = append(budgets, budget)
+	}
+	return budgets, nil
+}
+
+func (r *PostgresBudgetRepository) GetBudgetByID(id string) (*Budget, error) {
+	query := "SELECT id, user_id, category, monthly_limit, created_at FROM budgets WHERE id = $1"
+
+	var budget Budget
+	err := r.db.QueryRow(query, id).Scan(&budget.ID, &budget.UserID, &budget.Category, &budget.MonthlyLimit, &budget.CreatedAt)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	return &budget, nil
+}
+
+func (r *PostgresBudgetRepository) UpdateBudget(budget Budget) error {
+	_, err := r.db.Exec("UPDATE budgets SET monthly_limit = $1 WHERE id = $2", budget.MonthlyLimit, budget.ID)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+func (r *PostgresBudgetRepository) DeleteBudget(id string) error {
+	_, err := r.db.Exec("DELETE FROM budgets WHERE id = $1", id)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+// PostgresSubscriptionRepository and its methods
+type PostgresSubscriptionRepository struct {
+	db *sql.DB
+}
+
+const subscriptionColumns = "id, user_id, merchant, category, cadence, amount, monthly_cost, payments, last_paid, next_expected, status, created_at"
+
+// scanSubscription reads a row selected with subscriptionColumns
+func scanSubscription(row interface{ Scan(...interface{}) error }) (Subscription, error) {
+	var sub Subscription
+	err := row.Scan(&sub.ID, &sub.UserID, &sub.Merchant, &sub.Category, &sub.Cadence, &sub.Amount, &sub.MonthlyCost,
+		&sub.Payments, &sub.LastPaid, &sub.NextExpected, &sub.Status, &sub.CreatedAt)
+	return sub, err
+}
+
+// UpsertSubscription records a detection. A subscription already known for the merchant and cadence
+// gets the latest figures but keeps its id and status, so confirming or dismissing sticks. A lapsed one
+// goes back to confirmed if it was confirmed when it lapsed, and to the detected status otherwise.
+func (r *PostgresSubscriptionRepository) UpsertSubscription(sub Subscription) error {
+	query := `
+		INSERT INTO subscriptions (` + subscriptionColumns + `)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		ON CONFLICT (user_id, merchant, cadence) DO UPDATE SET
+			category = EXCLUDED.category,
+			amount = EXCLUDED.amount,
+			monthly_cost = EXCLUDED.monthly_cost,
+			payments = EXCLUDED.payments,
+			last_paid = EXCLUDED.last_paid,
+			next_expected = EXCLUDED.next_expected,
+			status = CASE
+				WHEN subscriptions.status <> 'lapsed' THEN subscriptions.status
+				WHEN subscriptions.lapsed_from = 'confirmed' THEN 'confirmed'
+				ELSE EXCLUDED.status
+			END,
+			lapsed_from = ''
+	`
+	_, err := r.db.Exec(query, sub.ID, sub.UserID, sub.Merchant, sub.Category, sub.Cadence, sub.Amount, sub.MonthlyCost,
+		sub.Payments, sub.LastPaid, sub.NextExpected, sub.Status, sub.CreatedAt)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+func (r *PostgresSubscriptionRepository) GetSubscriptionsByUserID(userID string) ([]Subscription, error) {
+	query := "SELECT " + subscriptionColumns + " FROM subscriptions WHERE user_id = $1 ORDER BY next_expected"
+	rows, err := r.db.Query(query, userID)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := []Subscription{}
+	for rows.Next() {
+		sub, err := scanSubscription(rows)
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+func (r *PostgresSubscriptionRepository) GetSubscriptionByID(id string) (*Subscription, error) {
+	query := "SELECT " + subscriptionColumns + " FROM subscriptions WHERE id = $1"
+
+	sub, err := scanSubscription(r.db.QueryRow(query, id))
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	return &sub, nil
+}
+
+func (r *PostgresSubscriptionRepository) UpdateSubscriptionStatus(id, status string) error {
+	_, err := r.db.Exec("UPDATE subscriptions SET status = $1 WHERE id = $2", status, id)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+// LapseSubscription marks a subscription lapsed and remembers the status it had for UpsertSubscription
+func (r *PostgresSubscriptionRepository) LapseSubscription(id string) error {
+	_, err := r.db.Exec("UPDATE subscriptions SET lapsed_from = status, status = 'lapsed' WHERE id = $1", id)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+// PostgresNotificationRepository and its methods
+type PostgresNotificationRepository struct {
+	db *sql.DB
+}
+
+func (r *PostgresNotificationRepository) AddNotification(notification Notification) error {
+	query := "INSERT INTO notifications (id, user_id, kind, title, body, created_at) VALUES ($1, $2, $3, $4, $5, $6)"
+	_, err := r.db.Exec(query, notification.ID, notification.UserID, notification.Kind, notification.Title, notification.Body, notification.CreatedAt)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+const notificationColumns = "id, user_id, kind, title, body, created_at, read_at"
+
+func scanNotification(row interface{ Scan(...interface{}) error }) (Notification, error) {
+	var n Notification
+	err := row.Scan(&n.ID, &n.UserID, &n.Kind, &n.Title, &n.Body, &n.CreatedAt, &n.ReadAt)
+	return n, err
+}
+
+// ListNotifications returns the newest notifications first, continuing after the cursor if one is given
+func (r *PostgresNotificationRepository) ListNotifications(userID string, filter NotificationFilter) ([]Notification, error) {
+	var where whereClause
+	where.add("user_id = ?", userID)
+	if filter.UnreadOnly {
+		where.add("read_at IS NULL")
+	}
+	if filter.After != nil {
+		where.add("(created_at, id) < (?, ?)", filter.After.CreatedAt, filter.After.ID)
+	}
+
+	query := "SELECT " + notificationColumns + " FROM notifications" + where.String() + " ORDER BY created_at DESC, id DESC"
+	if filter.Limit > 0 {
+		query += " LIMIT " + strconv.Itoa(filter.Limit)
+	}
+
+	rows, err := r.db.Query(query, where.args...)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	notifications := []Notification{}
+	for rows.Next() {
+		n, err := scanNotification(rows)
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+		notifications = append(notifications, n)
+	}
+	return notifications, nil
+}
+
+func (r *PostgresNotificationRepository) CountUnread(userID string) (int, error) {
+	var count int
+	err := r.db.QueryRow("SELECT COUNT(*) FROM notifications WHERE user_id = $1 AND read_at IS NULL", userID).Scan(&count)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return count, err
+}
+
+func (r *PostgresNotificationRepository) GetNotificationByID(id string) (*Notification, error) {
+	n, err := scanNotification(r.db.QueryRow("SELECT "+notificationColumns+" FROM notifications WHERE id = $1", id))
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	return &n, nil
+}
+
+// MarkRead keeps the first read time if the notification was already read
+func (r *PostgresNotificationRepository) MarkRead(id string, at time.Time) error {
+	_, err := r.db.Exec("UPDATE notifications SET read_at = COALESCE(read_at, $1) WHERE id = $2", at, id)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+func (r *PostgresNotificationRepository) MarkAllRead(userID string, at time.Time) (int64, error) {
+	result, err := r.db.Exec("UPDATE notifications SET read_at = $1 WHERE user_id = $2 AND read_at IS NULL", at, userID)
+	if err != nil {
+		fmt.Println(err)
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func (r *PostgresNotificationRepository) DeleteNotification(id string) error {
+	_, err := r.db.Exec("DELETE FROM notifications WHERE id = $1", id)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+// AddDevice registers a push token. Registering it again, for example after the app reinstalls, moves it to this user.
+func (r *PostgresNotificationRepository) AddDevice(userID, token string, createdAt time.Time) error {
+	query := `
+		INSERT INTO push_devices (token, user_id, created_at) VALUES ($1, $2, $3)
+		ON CONFLICT (token) DO UPDATE SET user_id = EXCLUDED.user_id, created_at = EXCLUDED.created_at
+	`
+	_, err := r.db.Exec(query, token, userID, createdAt)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+func (r *PostgresNotificationRepository) DeleteDevice(userID, token string) error {
+	result, err := r.db.Exec("DELETE FROM push_devices WHERE user_id = $1 AND token = $2", userID, token)
+	if err != nil {
+		fmt.Println(err)
+		return err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return sql.ErrNoRows
+	}
+	return nil
+}
+
+func (r *PostgresNotificationRepository) GetDeviceTokens(userID string) ([]string, error) {
+	rows, err := r.db.Query("SELECT token FROM push_devices WHERE user_id = $1 ORDER BY created_at", userID)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var tokens []string
+	for rows.Next() {
+		var token string
+		err := rows.Scan(&token)
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+		tokens = append(tokens, token)
+	}
+	return tokens, nil
+}
+
+func (r *PostgresNotificationRepository) GetDevices(userID string) ([]PushDevice, error) {
+	rows, err := r.db.Query("SELECT token, created_at FROM push_devices WHERE user_id = $1 ORDER BY created_at", userID)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	devices := []PushDevice{}
+	for rows.Next() {
+		var device PushDevice
+		err := rows.Scan(&device.Token, &device.CreatedAt)
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// PostgresWebhookRepository and its methods
+type PostgresWebhookRepository struct {
+	db *sql.DB
+}
+
+const webhookColumns = "id, user_id, url, secret, event_types, active, created_at"
+
+func scanWebhook(row interface{ Scan(...interface{}) error }) (Webhook, error) {
+	var w Webhook
+	err := row.Scan(&w.ID, &w.UserID, &w.URL, &w.Secret, pq.Array(&w.EventTypes), &w.Active, &w.CreatedAt)
+	return w, err
+}
+
+func (r *PostgresWebhookRepository) CreateWebhook(webhook Webhook) error {
+	query := "INSERT INTO webhooks (" + webhookColumns + ") VALUES ($1, $2, $3, $4, $5, $6, $7)"
+	_, err := r.db.Exec(query, webhook.ID, webhook.UserID, webhook.URL, webhook.Secret, pq.Array(webhook.EventTypes), webhook.Active, webhook.CreatedAt)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+func (r *PostgresWebhookRepository) queryWebhooks(query string, args ...interface{}) ([]Webhook, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	webhooks := []Webhook{}
+	for rows.Next() {
+		w, err := scanWebhook(rows)
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+		webhooks = append(webhooks, w)
+	}
+	return webhooks, nil
+}
+
+func (r *PostgresWebhookRepository) GetWebhooksByUserID(userID string) ([]Webhook, error) {
+	return r.queryWebhooks("SELECT "+webhookColumns+" FROM webhooks WHERE user_id = $1 ORDER BY created_at", userID)
+}
+
+func (r *PostgresWebhookRepository) GetWebhookByID(id string) (*Webhook, error) {
+	w, err := scanWebhook(r.db.QueryRow("SELECT "+webhookColumns+" FROM webhooks WHERE id = $1", id))
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	return &w, nil
+}
+
+// GetSubscribedWebhooks returns the active webhooks of the user and of the tenant that want this event type
+func (r *PostgresWebhookRepository) GetSubscribedWebhooks(userID, eventType string) ([]Webhook, error) {
+	query := "SELECT " + webhookColumns + " FROM webhooks WHERE active AND user_id IN ($1, $2) AND $3 = ANY(event_types)"
+	return r.queryWebhooks(query, userID, TenantWebhookOwner, eventType)
+}
+
+func (r *PostgresWebhookRepository) UpdateWebhook(webhook Webhook) error {
+	query := "UPDATE webhooks SET url = $1, event_types = $2, active = $3 WHERE id = $4"
+	_, err := r.db.Exec(query, webhook.URL, pq.Array(webhook.EventTypes), webhook.Active, webhook.ID)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+func (r *PostgresWebhookRepository) DeleteWebhook(id string) error {
+	_, err := r.db.Exec("DELETE FROM webhooks WHERE id = $1", id)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+const deliveryColumns = "id, webhook_id, user_id, event_id, event_type, payload, status, attempts, response_status, last_error, next_attempt_at, last_attempt_at, delivered_at, replay_of, created_at"
+
+func scanDelivery(row interface{ Scan(...interface{}) error }) (WebhookDelivery, error) {
+	var d WebhookDelivery
+	err := row.Scan(&d.ID, &d.WebhookID, &d.UserID, &d.EventID, &d.EventType, &d.Payload, &d.Status, &d.Attempts, &d.ResponseStatus,
+		&d.LastError, &d.NextAttemptAt, &d.LastAttemptAt, &d.DeliveredAt, &d.ReplayOf, &d.CreatedAt)
+	return d, err
+}
+
+func (r *PostgresWebhookRepository) queryDeliveries(query string, args ...interface{}) ([]WebhookDelivery, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	deliveries := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanDelivery(rows)
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, nil
+}
+
+// AddDelivery queues a delivery. It returns false if the event was already queued for the webhook,
+// which happens when the outbox dispatches an event again.
+func (r *PostgresWebhookRepository) AddDelivery(d WebhookDelivery) (bool, error) {
+	query := `
+		INSERT INTO webhook_deliveries (id, webhook_id, user_id, event_id, event_type, payload, status, next_attempt_at, replay_of, created_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		ON CONFLICT DO NOTHING
+	`
+	result, err := r.db.Exec(query, d.ID, d.WebhookID, d.UserID, d.EventID, d.EventType, d.Payload, d.Status, d.NextAttemptAt, d.ReplayOf, d.CreatedAt)
+	if err != nil {
+		fmt.Println(err)
+		return false, err
+	}
+
+	affected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return affected > 0, nil
+}
+
+func (r *PostgresWebhookRepository) GetDeliveryByID(id string) (*WebhookDelivery, error) {
+	d, err := scanDelivery(r.db.QueryRow("SELECT "+deliveryColumns+" FROM webhook_deliveries WHERE id = $1", id))
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	return &d, nil
+}
+
+func (r *PostgresWebhookRepository) GetDeliveriesByWebhookID(webhookID string, limit int) ([]WebhookDelivery, error) {
+	query := "SELECT " + deliveryColumns + " FROM webhook_deliveries WHERE webhook_id = $1 ORDER BY created_at DESC, id DESC LIMIT $2"
+	return r.queryDeliveries(query, webhookID, limit)
+}
+
+// GetDeliveriesByUserID returns every delivery of the user's events, the same ones AnonymizeUser deletes
+func (r *PostgresWebhookRepository) GetDeliveriesByUserID(userID string) ([]WebhookDelivery, error) {
+	query := "SELECT " + deliveryColumns + " FROM webhook_deliveries WHERE user_id = $1 ORDER BY created_at, id"
+	return r.queryDeliveries(query, userID)
+}
+
+// ClaimDueDeliveries returns pending deliveries whose next attempt is due and pushes that attempt
+// back to leaseUntil, so other instances polling at the same time skip them
+func (r *PostgresWebhookRepository) ClaimDueDeliveries(now, leaseUntil time.Time, limit int) ([]WebhookDelivery, error) {
+	query := `
+		UPDATE webhook_deliveries SET next_attempt_at = $2
+		WHERE id IN (
+			SELECT id FROM webhook_deliveries
+			WHERE status = 'pending' AND next_attempt_at <= $1
+			ORDER BY next_attempt_at
+			LIMIT $3
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING ` + deliveryColumns
+	return r.queryDeliveries(query, now, leaseUntil, limit)
+}
+
+func (r *PostgresWebhookRepository) UpdateDelivery(d WebhookDelivery) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = $1, attempts = $2, response_status = $3, last_error = $4, next_attempt_at = $5, last_attempt_at = $6, delivered_at = $7
+		WHERE id = $8
+	`
+	_, err := r.db.Exec(query, d.Status, d.Attempts, d.ResponseStatus, d.LastError, d.NextAttemptAt, d.LastAttemptAt, d.DeliveredAt, d.ID)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+// PostgresOutboxRepository and its methods
+type PostgresOutboxRepository struct {
+	db *sql.DB
+}
+
+func (r *PostgresOutboxRepository) AddEvent(dbTx *sql.Tx, event OutboxEvent) error {
+	query := "INSERT INTO outbox_events (id, type, user_id, payload, created_at, next_attempt_at) VALUES ($1, $2, $3, $4, $5, $6)"
+	_, err := conn(r.db, dbTx).Exec(query, event.ID, event.Type, event.UserID, []byte(event.Payload), event.CreatedAt, event.NextAttemptAt)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+// ClaimPendingEvents returns undispatched events that are due and have not used up their attempts,
+// leaving them alone for everyone else until leaseUntil. Rows another claim has locked are skipped.
+func (r *PostgresOutboxRepository) ClaimPendingEvents(now, leaseUntil time.Time, maxAttempts, limit int) ([]OutboxEvent, error) {
+	query := `
+		UPDATE outbox_events SET next_attempt_at = $2
+		WHERE id IN (
+			SELECT id FROM outbox_events
+			WHERE dispatched_at IS NULL AND attempts < $3 AND (next_attempt_at IS NULL OR next_attempt_at <= $1)
+			ORDER BY created_at
+			LIMIT $4
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, type, user_id, payload, created_at, dispatched_at, attempts, last_error, next_attempt_at
+	`
+	rows, err := r.db.Query(query, now, leaseUntil, maxAttempts, limit)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []OutboxEvent{}
+	for rows.Next() {
+		var event OutboxEvent
+		var payload []byte
+		err := rows.Scan(&event.ID, &event.Type, &event.UserID, &payload, &event.CreatedAt, &event.DispatchedAt, &event.Attempts, &event.LastError, &event.NextAttemptAt)
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+		event.Payload = payload
+		events = append(events, event)
+	}
+	return events, nil
+}
+
+func (r *PostgresOutboxRepository) GetDeliveredSubscribers(eventID string) ([]string, error) {
+	rows, err := r.db.Query("SELECT subscriber FROM outbox_deliveries WHERE event_id = $1", eventID)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		err := rows.Scan(&name)
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, nil
+}
+
+func (r *PostgresOutboxRepository) RecordDelivery(eventID, subscriber string, at time.Time) error {
+	query := "INSERT INTO outbox_deliveries (event_id, subscriber, delivered_at) VALUES ($1, $2, $3) ON CONFLICT DO NOTHING"
+	_, err := r.db.Exec(query, eventID, subscriber, at)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+func (r *PostgresOutboxRepository) RecordFailure(eventID, lastError string, retryAt time.Time) error {
+	_, err := r.db.Exec("UPDATE outbox_events SET attempts = attempts + 1, last_error = $1, next_attempt_at = $2 WHERE id = $3", lastError, retryAt, eventID)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+func (r *PostgresOutboxRepository) MarkDispatched(eventID string, at time.Time) error {
+	_, err := r.db.Exec("UPDATE outbox_events SET dispatched_at = $1, next_attempt_at = NULL WHERE id = $2", at, eventID)
+	if err != nil {
+		fmt.Println(err)
+	}
+	return err
+}
+
+// PostgresRoundupEventRepository and its methods
+type PostgresRoundupEventRepository struct {
+	db *sql.DB
+}
+
+// AddRoundupEvents inserts the events of one roundup together, in a transaction of its own if dbTx is nil
+func (r *PostgresRoundupEventRepository) AddRoundupEvents(dbTx *sql.Tx, events []RoundupEvent) error {
+	tx := dbTx
+	if tx == nil {
+		var err error
+		tx, err = r.db.Begin()
+		if err != nil {
+			fmt.Println(err)
+			return err
+		}
+	}
+
+	query := "INSERT INTO roundup_events (id, user_id, transaction_id, goal_id, amount, created_at) VALUES ($1, $2, $3, $4, $5, $6)"
+	for _, event := range events {
+		_, err := tx.Exec(query, event.ID, event.UserID, event.TransactionID, event.GoalID, event.Amount, event.CreatedAt)
+		if err != nil {
+			if dbTx == nil {
+				tx.Rollback()
+			}
+			fmt.Println(err)
+			return err
+		}
+	}
+
+	if dbTx != nil {
+		return nil
+	}
+	return tx.Commit()
+}
+
+// GetRoundupEventsSince returns the user's roundups from since onwards, oldest first
+func (r *PostgresRoundupEventRepository) GetRoundupEventsSince(userID string, since time.Time) ([]RoundupEvent, error) {
+	query := "SELECT id, user_id, transaction_id, goal_id, amount, created_at FROM roundup_events WHERE user_id = $1 AND created_at >= $2 ORDER BY created_at"
+	return r.queryRoundupEvents(query, userID, since)
+}
+
+func (r *PostgresRoundupEventRepository) GetRoundupEventsByUserID(userID string) ([]RoundupEvent, error) {
+	query := "SELECT id, user_id, transaction_id, goal_id, amount, created_at FROM roundup_events WHERE user_id = $1 ORDER BY created_at"
+	return r.queryRoundupEvents(query, userID)
+}
+
+func (r *PostgresRoundupEventRepository) queryRoundupEvents(query string, args ...interface{}) ([]RoundupEvent, error) {
+	rows, err := r.db.Query(query, args...)
+	if err != nil {
+		fmt.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	events := []RoundupEvent{}
+	for rows.Next() {
+		var event RoundupEvent
+		err := rows.Scan(&event.ID, &event.UserID, &event.TransactionID, &event.GoalID, &event.Amount, &event.CreatedAt)
+		if err != nil {
+			fmt.Println(err)
+			return nil, err
+		}
+		events = append(events, event)
+	}
+	return events, nil
+}
@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"fmt"
 	"log"
 	"math"
 	"net/url"
+	"sort"
 	"strings"
 	"time"
 
@@ -78,7 +81,13 @@ func (s *TransactionService) ProcessRoundup(userID string, transaction Transacti
 
 	if !transaction.RoundupEnabled {
 
-		transaction.Roundup = 0.0
+		transaction = withoutRoundup(transaction)
+		err := s.savePayment(transaction)
+		if err != nil {
+			log.Printf("Error saving transaction: %v\n", err)
+			return 0.0, "", "", err
+		}
+
 		uri1, _, err := s.generateUPIURIs(transaction)
 		if err != nil {
 			log.Printf("Error generating UPI URIs: %v\n", err)
@@ -95,100 +104,253 @@ func (s *TransactionService) ProcessRoundup(userID string, transaction Transacti
 		return 0.0, "", "", fmt.Errorf("User not found: %v", err)
 	}
 
+	goals, err := s.RefreshGoals(userID)
+	if err != nil {
+		log.Printf("Error finding goals: %v\n", err)
+		return 0.0, "", "", fmt.Errorf("failed to retrieve goals: %v", err)
+	}
+
+	now := s.clock.Now()
+
+	history, err := s.eventRepo.GetRoundupEventsSince(userID, roundupHistoryStart(now, DefaultRoundupParams.RecentPeriodDays))
+	if err != nil {
+		log.Printf("Error finding roundup history: %v\n", err)
+		return 0.0, "", "", fmt.Errorf("failed to retrieve roundup history: %v", err)
+	}
+
+	penalty, err := s.budgetPenaltyFor(userID, user.Preferences, transaction)
+	if err != nil {
+		// a missing penalty is better than a failed payment
+		log.Printf("Error checking budget penalty: %v\n", err)
+		penalty = 1
+	}
+
 	// Validate goal details
-	if user.Preferences.GoalAmount == 0 || user.Preferences.TargetDate.IsZero() || user.Preferences.TargetDate.Before(time.Now()) {
+	activeGoals := filterActiveGoals(goals, now)
+	if len(activeGoals) == 0 {
 		log.Println("No valid goal. Falling back to base roundup.")
-		RoundUp, uri1, uri2, err := s.processBaseRoundup(userID, transaction)
+		RoundUp, uri1, uri2, err := s.processBaseRoundup(userID, transaction, user.Preferences, history, penalty)
 		if err != nil {
 			return 0.0, "", "", err
 		}
 		return RoundUp, uri1, uri2, nil
 	}
 
-	// Check if transaction category matches user preferences
-	if len(user.Preferences.RoundupCategories) > 0 && !contains(user.Preferences.RoundupCategories, transaction.Category) {
-		log.Printf("Transaction category '%s' does not match user preferences. Skipping.\n", transaction.Category)
+	breakdown := calculateRoundup(transaction, user.Preferences, history, penalty, activeGoals, s.calculateAvgRoundup(), now, DefaultRoundupParams)
+	breakdown.logValues()
+
+	if breakdown.Mode == RoundupModeSkipped {
+		log.Printf("%s. Skipping.\n", breakdown.SkipReason)
+		err = s.savePayment(withoutRoundup(transaction))
+		if err != nil {
+			log.Printf("Error saving transaction: %v\n", err)
+			return 0.0, "", "", err
+		}
 		return 0.0, "", "", nil
 	}
 
-	// Calculate raw base roundup
-	rawBaseRoundup := (transaction.Amount * BaseRoundupPercent)
-	baseRoundup := math.Max(rawBaseRoundup, 0)
+	Roundup := breakdown.Roundup
+	transaction.Roundup = Roundup
+	transaction.RoundupCapped = breakdown.UncappedRoundup - Roundup
+	transaction.CapReason = breakdown.CapReason
+	transaction.PenaltyRoundup = breakdown.PenaltyRoundup
+	transaction.RoundupBreakdown = &breakdown
+
+	// the roundup is kept only together with its wallet credit
+	walletFailed := false
+	err = s.inTx(func(u *unitOfWork) error {
+		err := s.saveTransactionAndPreferences(u, userID, transaction, Roundup, breakdown.Allocations)
+		if err != nil || Roundup <= 0 {
+			return err
+		}
 
-	// Calculate days remaining until the target date
-	daysRemaining := math.Floor(time.Until(user.Preferences.TargetDate).Hours() / 24)
-	daysRemaining = math.Max(1, daysRemaining) // Ensure minimum of 1 day
+		// Add roundup amount to user's wallet
+		err = s.creditWallet(u, userID, Roundup, fmt.Sprintf("Roundup from %s transaction of ₹%.2f", transaction.Category, transaction.Amount), transaction.ID)
+		if err != nil {
+			walletFailed = true
+			return err
+		}
 
-	averageRoundup := s.calculateAvgRoundup()
+		return u.publish(RoundupCredited{
+			UserID:        userID,
+			TransactionID: transaction.ID,
+			Amount:        Roundup,
+			Allocations:   breakdown.Allocations,
+		})
+	})
+	if walletFailed {
+		log.Printf("Error adding roundup to wallet: %v\n", err)
+		failed := RoundupFailed{
+			UserID:        userID,
+			TransactionID: transaction.ID,
+			Amount:        Roundup,
+			Reason:        "the roundup could not be added to your wallet",
+		}
 
-	remainingAmount := user.Preferences.GoalAmount - user.Preferences.CurrentSavings
+		Roundup = 0
+		transaction = withoutRoundup(transaction)
+		err = s.savePayment(transaction, failed)
+		if err != nil {
+			log.Printf("Error saving transaction: %v\n", err)
+			return 0.0, "", "", err
+		}
 
-	if remainingAmount < 0 {
-		RoundUp, uri1, uri2, err := s.processBaseRoundup(userID, transaction)
+		uri1, _, err := s.generateUPIURIs(transaction)
 		if err != nil {
+			log.Printf("Error generating UPI URIs: %v\n", err)
 			return 0.0, "", "", err
 		}
-		return RoundUp, uri1, uri2, nil
+		return 0.0, uri1, "", nil
+	}
+	if err != nil {
+		log.Printf("Error saving transaction and preferences: %v\n", err)
+		return 0.0, "", "", err
 	}
 
-	requiredTxns := math.Floor(remainingAmount / averageRoundup)
+	// goals this roundup completed move on to achieved right away
+	_, err = s.RefreshGoals(userID)
+	if err != nil {
+		log.Printf("Error updating goal states: %v\n", err)
+	}
 
-	recentDates := filterRecentDates(user.Preferences.RoundupDates, RecentPeriodDays)
+	uri1, uri2, err := s.generateUPIURIs(transaction)
+	if err != nil {
+		log.Printf("Error generating UPI URIs: %v\n", err)
+		return 0.0, "", "", err
+	}
 
-	avgTxnsPerDay := calculateAvgTxnsPerDay(recentDates, RecentPeriodDays)
+	return Roundup, uri1, uri2, nil
+}
 
-	projectedTxns := avgTxnsPerDay * daysRemaining
+// calculateRoundup runs the roundup algorithm without side effects. ProcessRoundup acts on
+// the result and the simulation endpoint returns it as is.
+func calculateRoundup(transaction Transaction, prefs UserPreferences, history []RoundupEvent, budgetPenalty float64, activeGoals []Goal, averageRoundup float64, now time.Time, params RoundupParams) RoundupBreakdown {
+	breakdown := roundupBreakdown(transaction, prefs, history, budgetPenalty, activeGoals, averageRoundup, now, params)
 
-	pressure := calculatePressure(requiredTxns, projectedTxns)
+	// the bonus is whatever the penalty still adds once pressure, the remaining amount and caps have had their say
+	if budgetPenalty > 1 {
+		unpenalized := roundupBreakdown(transaction, prefs, history, 1, activeGoals, averageRoundup, now, params)
+		breakdown.PenaltyRoundup = math.Max(breakdown.Roundup-unpenalized.Roundup, 0)
+	}
 
-	Roundup := math.Min(baseRoundup*pressure, remainingAmount)
+	return breakdown
+}
 
-	log.Printf("Base Roundup: %.2f", baseRoundup)
-	log.Printf("Days Remaining: %.2f", daysRemaining)
-	log.Printf("Average Roundup: %.2f", averageRoundup)
-	log.Printf("Remaining Amount: %.2f", remainingAmount)
-	log.Printf("Required Transactions: %.2f", requiredTxns)
-	log.Printf("Projected Transactions: %.2f", projectedTxns)
-	log.Printf("Pressure: %.2f", pressure)
+func roundupBreakdown(transaction Transaction, prefs UserPreferences, history []RoundupEvent, budgetPenalty float64, activeGoals []Goal, averageRoundup float64, now time.Time, params RoundupParams) RoundupBreakdown {
+	var breakdown RoundupBreakdown
 
-	if Roundup < 1 {
-		log.Printf("Calculated roundup %.2f is below threshold. Skipping.\n", Roundup)
-		return 0.0, "", "", nil
+	if !transaction.RoundupEnabled {
+		breakdown.Mode = RoundupModeDisabled
+		return breakdown
 	}
 
-	transaction.Roundup = Roundup
+	// Calculate raw base roundup, scaled by the user's multiplier for the category and any budget penalty
+	breakdown.CategoryMultiplier = prefs.categoryMultiplier(transaction.Category)
+	breakdown.BudgetPenalty = budgetPenalty
+	rawBaseRoundup := (transaction.Amount * params.BaseRoundupPercent) * breakdown.CategoryMultiplier * budgetPenalty
+	breakdown.BaseRoundup = math.Max(rawBaseRoundup, 0)
+
+	// Without a goal there is nothing to apply pressure towards
+	if len(activeGoals) == 0 {
+		breakdown.Mode = RoundupModeBase
+		breakdown.UncappedRoundup = breakdown.BaseRoundup
+		breakdown.Roundup, breakdown.CapReason = applyRoundupCaps(breakdown.BaseRoundup, prefs, history, now)
+		return breakdown
+	}
+
+	// Check if transaction category matches user preferences
+	if len(prefs.RoundupCategories) > 0 && !contains(prefs.RoundupCategories, transaction.Category) {
+		breakdown.Mode = RoundupModeSkipped
+		breakdown.SkipReason = fmt.Sprintf("Transaction category '%s' does not match user preferences", transaction.Category)
+		return breakdown
+	}
+
+	breakdown.Mode = RoundupModeGoal
+	breakdown.AverageRoundup = averageRoundup
+
+	recentDates := filterRecentDates(roundupDates(history), params.RecentPeriodDays, now)
+
+	breakdown.AvgTxnsPerDay = calculateAvgTxnsPerDay(recentDates, params.RecentPeriodDays)
+
+	// every active goal adds the pressure it needs to make its own deadline
+	rawPressure := 0.0
+	for _, goal := range activeGoals {
+		gp := calculateGoalPressure(goal, averageRoundup, breakdown.AvgTxnsPerDay, now, params)
 
-	err = s.saveTransactionAndPreferences(userID, transaction, Roundup)
+		rawPressure += gp.RequiredTxns / gp.ProjectedTxns
+		breakdown.RemainingAmount += gp.RemainingAmount
+		breakdown.Goals = append(breakdown.Goals, gp)
+	}
+
+	breakdown.Pressure = params.clampPressure(rawPressure)
+	breakdown.PressuredRoundup = breakdown.BaseRoundup * breakdown.Pressure
+
+	roundup := math.Min(breakdown.PressuredRoundup, breakdown.RemainingAmount)
+
+	if roundup < 1 {
+		breakdown.Mode = RoundupModeSkipped
+		breakdown.SkipReason = fmt.Sprintf("Calculated roundup %.2f is below threshold", roundup)
+		return breakdown
+	}
+
+	// caps can take the roundup below the threshold, even to zero. It is still recorded
+	// so the transaction shows which cap held it back.
+	breakdown.UncappedRoundup = roundup
+	breakdown.Roundup, breakdown.CapReason = applyRoundupCaps(roundup, prefs, history, now)
+	breakdown.Allocations = allocateRoundup(breakdown.Roundup, activeGoals, prefs.GoalAllocation)
+
+	return breakdown
+}
+
+// SimulateRoundups is a dry run of calculateRoundup over hypothetical transactions. Nothing is persisted,
+// and each transaction is calculated against the same starting state.
+func (s *TransactionService) SimulateRoundups(userID string, prefs UserPreferences, goals []Goal, transactions []Transaction) ([]RoundupBreakdown, error) {
+	now := s.clock.Now()
+	averageRoundup := s.calculateAvgRoundup()
+	activeGoals := filterActiveGoals(goals, now)
+
+	history, err := s.eventRepo.GetRoundupEventsSince(userID, roundupHistoryStart(now, DefaultRoundupParams.RecentPeriodDays))
 	if err != nil {
-		log.Printf("Error saving transaction and preferences: %v\n", err)
-		return 0.0, "", "", err
+		return nil, fmt.Errorf("failed to retrieve roundup history: %v", err)
 	}
 
-	if Roundup > 0 {
-		// Add roundup amount to user's wallet
-		err = s.AddToWallet(userID, Roundup, fmt.Sprintf("Roundup from %s transaction of ₹%.2f", transaction.Category, transaction.Amount))
+	results := []RoundupBreakdown{}
+	for _, transaction := range transactions {
+		penalty, err := s.budgetPenaltyFor(userID, prefs, transaction)
 		if err != nil {
-			log.Printf("Error adding roundup to wallet: %v\n", err)
+			return nil, err
 		}
+		results = append(results, calculateRoundup(transaction, prefs, history, penalty, activeGoals, averageRoundup, now, DefaultRoundupParams))
 	}
+	return results, nil
+}
 
-	uri1, uri2, err := s.generateUPIURIs(transaction)
-	if err != nil {
-		log.Printf("Error generating UPI URIs: %v\n", err)
-		return 0.0, "", "", err
+func (b RoundupBreakdown) logValues() {
+	log.Printf("Base Roundup: %.2f", b.BaseRoundup)
+	log.Printf("Average Roundup: %.2f", b.AverageRoundup)
+	for _, gp := range b.Goals {
+		log.Printf("Goal '%s': Days Remaining: %.2f, Remaining Amount: %.2f, Required Transactions: %.2f, Projected Transactions: %.2f",
+			gp.Name, gp.DaysRemaining, gp.RemainingAmount, gp.RequiredTxns, gp.ProjectedTxns)
 	}
-
-	return Roundup, uri1, uri2, nil
+	log.Printf("Remaining Amount: %.2f", b.RemainingAmount)
+	log.Printf("Pressure: %.2f", b.Pressure)
 }
 
-func (s *TransactionService) processBaseRoundup(userID string, transaction Transaction) (float64, string, string, error) {
+func (s *TransactionService) processBaseRoundup(userID string, transaction Transaction, prefs UserPreferences, history []RoundupEvent, penalty float64) (float64, string, string, error) {
 
-	Roundup := transaction.Amount * BaseRoundupPercent
-	Roundup = math.Max(0, Roundup)
+	breakdown := calculateRoundup(transaction, prefs, history, penalty, nil, 0, s.clock.Now(), DefaultRoundupParams)
 
-	transaction.Roundup = Roundup
+	Roundup := breakdown.Roundup
 
-	err := s.saveTransactionAndPreferences(userID, transaction, Roundup)
+	transaction.Roundup = Roundup
+	transaction.RoundupCapped = breakdown.UncappedRoundup - Roundup
+	transaction.CapReason = breakdown.CapReason
+	transaction.PenaltyRoundup = breakdown.PenaltyRoundup
+	transaction.RoundupBreakdown = &breakdown
+
+	err := s.inTx(func(u *unitOfWork) error {
+		return s.saveTransactionAndPreferences(u, userID, transaction, Roundup, nil)
+	})
 	if err != nil {
 		return 0.0, "", "", err
 	}
@@ -198,11 +360,84 @@ func (s *TransactionService) processBaseRoundup(userID string, transaction Trans
 		return 0.0, "", "", err
 	}
 
+	// a capped roundup is reported as is rather than lifted to the minimum
+	if breakdown.CapReason != "" {
+		return Roundup, uri1, uri2, nil
+	}
+
 	return math.Max(Roundup, 1), uri1, uri2, nil
 }
 
-func filterRecentDates(dates []time.Time, recentDays int) []time.Time {
-	cutoff := time.Now().Add(-time.Duration(recentDays) * 24 * time.Hour)
+// applyRoundupCaps lowers a roundup to fit the user's caps, counting the roundups already
+// made this day, week and month. Returns the capped roundup and the cap that bound it.
+func applyRoundupCaps(roundup float64, prefs UserPreferences, history []RoundupEvent, now time.Time) (float64, string) {
+	reason := ""
+
+	limit := func(capAmount float64, name string, since time.Time) {
+		if capAmount <= 0 {
+			return
+		}
+		allowed := capAmount
+		if !since.IsZero() {
+			allowed = math.Max(capAmount-roundupTotalSince(history, since), 0)
+		}
+		if roundup > allowed {
+			roundup = allowed
+			reason = name
+		}
+	}
+
+	day, week, month := capPeriodStarts(now)
+
+	limit(prefs.TransactionRoundupCap, CapTransaction, time.Time{})
+	limit(prefs.DailyRoundupCap, CapDaily, day)
+	limit(prefs.WeeklyRoundupCap, CapWeekly, week)
+	limit(prefs.MonthlyRoundupCap, CapMonthly, month)
+
+	return roundup, reason
+}
+
+// capPeriodStarts returns the start of the day, week (Monday) and month that now falls in
+func capPeriodStarts(now time.Time) (time.Time, time.Time, time.Time) {
+	day := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	week := day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7)) // back to Monday
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, now.Location())
+	return day, week, month
+}
+
+// roundupHistoryStart is how far back calculateRoundup needs roundup events: the recent period
+// for transaction frequency, and the current week and month for the caps
+func roundupHistoryStart(now time.Time, recentDays int) time.Time {
+	_, week, month := capPeriodStarts(now)
+	start := now.Add(-time.Duration(recentDays) * 24 * time.Hour)
+	if week.Before(start) {
+		start = week
+	}
+	if month.Before(start) {
+		start = month
+	}
+	return start
+}
+
+// roundupDates returns when each roundup was made. A roundup split between goals is
+// several events but still one transaction, so it only counts once.
+func roundupDates(events []RoundupEvent) []time.Time {
+	var dates []time.Time
+	seen := map[string]bool{}
+	for _, event := range events {
+		if event.TransactionID != "" {
+			if seen[event.TransactionID] {
+				continue
+			}
+			seen[event.TransactionID] = true
+		}
+		dates = append(dates, event.CreatedAt)
+	}
+	return dates
+}
+
+func filterRecentDates(dates []time.Time, recentDays int, now time.Time) []time.Time {
+	cutoff := now.Add(-time.Duration(recentDays) * 24 * time.Hour)
 	var recentDates []time.Time
 	for _, date := range dates {
 		if date.After(cutoff) {
@@ -231,12 +466,327 @@ func (s *TransactionService) calculateAvgRoundup() float64 {
 	return totalRoundup / 7
 }
 
-func calculatePressure(requiredTxns, projectedTxns float64) float64 {
-	pressure := MinPressure
+func (p RoundupParams) calculatePressure(requiredTxns, projectedTxns float64) float64 {
+	pressure := p.MinPressure
 	if projectedTxns > 0 {
-		pressure = math.Max(requiredTxns/projectedTxns, MinPressure)
+		pressure = requiredTxns / projectedTxns
+	}
+	return p.clampPressure(pressure)
+}
+
+// calculateGoalPressure works out how hard roundups have to push for one goal to make its deadline
+func calculateGoalPressure(goal Goal, averageRoundup, avgTxnsPerDay float64, now time.Time, params RoundupParams) GoalPressure {
+	// Calculate days remaining until the target date
+	daysRemaining := math.Floor(goal.TargetDate.Sub(now).Hours() / 24)
+	daysRemaining = math.Max(1, daysRemaining) // Ensure minimum of 1 day
+
+	remainingAmount := math.Max(goal.Amount-goal.CurrentSavings, 0)
+
+	requiredTxns := math.Floor(remainingAmount / averageRoundup)
+
+	projectedTxns := avgTxnsPerDay * daysRemaining
+
+	return GoalPressure{
+		GoalID:          goal.ID,
+		Name:            goal.Name,
+		DaysRemaining:   daysRemaining,
+		RemainingAmount: remainingAmount,
+		RequiredTxns:    requiredTxns,
+		ProjectedTxns:   projectedTxns,
+		Pressure:        params.calculatePressure(requiredTxns, projectedTxns),
+	}
+}
+
+func (p RoundupParams) clampPressure(pressure float64) float64 {
+	pressure = math.Max(pressure, p.MinPressure)
+	return math.Min(pressure, p.MaxPressure)
+}
+
+// filterActiveGoals keeps active goals that still need money and haven't passed their target date
+func filterActiveGoals(goals []Goal, now time.Time) []Goal {
+	var active []Goal
+	for _, goal := range goals {
+		if goal.Status == GoalActive && goal.Amount > goal.CurrentSavings && goal.TargetDate.After(now) {
+			active = append(active, goal)
+		}
+	}
+	return active
+}
+
+// RefreshGoals applies the automatic transitions and returns the user's goals in priority order.
+// Active goals become achieved once their savings reach the amount, or expired once the target
+// date passes. Savings beyond the amount of an achieved goal either roll into the next active goal
+// or, for "wallet", are released so they sit in the wallet without being earmarked.
+func (s *TransactionService) RefreshGoals(userID string) ([]Goal, error) {
+	var goals []Goal
+	err := s.inTx(func(u *unitOfWork) error {
+		var err error
+		goals, err = s.refreshGoals(u, userID)
+		return err
+	})
+	return goals, err
+}
+
+func (s *TransactionService) refreshGoals(u *unitOfWork, userID string) ([]Goal, error) {
+	stored, err := s.goalRepo.LockGoalsByUserID(u.tx, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve goals: %v", err)
+	}
+
+	goals := settleGoals(stored, s.clock.Now())
+
+	for i := range goals {
+		goal := &goals[i]
+
+		moved := goal.CurrentSavings - stored[i].CurrentSavings
+		if moved != 0 {
+			err = s.goalRepo.AddToGoalSavings(u.tx, goal.ID, moved)
+			if err != nil {
+				return nil, fmt.Errorf("failed to move goal surplus: %v", err)
+			}
+		}
+		if moved > 0 {
+			log.Printf("Rolled ₹%.2f of surplus into '%s'", moved, goal.Name)
+		}
+
+		if goal.Status == stored[i].Status {
+			if goal.Status == GoalActive {
+				err = s.updateMilestone(u, goal)
+				if err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+
+		err = s.goalRepo.UpdateGoalState(u.tx, *goal)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update goal state: %v", err)
+		}
+		if goal.Status == GoalAchieved {
+			err = u.publish(GoalReached{Goal: *goal})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return goals, nil
+}
+
+// settleGoals returns a copy of goals with the automatic transitions of RefreshGoals applied,
+// without saving anything
+func settleGoals(stored []Goal, now time.Time) []Goal {
+	goals := make([]Goal, len(stored))
+	copy(goals, stored)
+
+	// rolled-over surplus can complete the next goal too, so go until nothing changes
+	for changed := true; changed; {
+		changed = false
+		for i := range goals {
+			goal := &goals[i]
+			if goal.Status != GoalActive {
+				continue
+			}
+
+			switch {
+			case goal.CurrentSavings >= goal.Amount:
+				goal.Status = GoalAchieved
+				goal.AchievedAt = &now
+				goal.Milestone = 100
+
+				surplus := goal.CurrentSavings - goal.Amount
+				goal.CurrentSavings = goal.Amount
+				if surplus > 0 && goal.OnComplete == SurplusNextGoal {
+					next := nextActiveGoal(goals, goal.ID)
+					if next != nil {
+						next.CurrentSavings += surplus
+					}
+				}
+			case !goal.TargetDate.After(now):
+				goal.Status = GoalExpired
+				goal.ExpiredAt = &now
+			default:
+				continue
+			}
+			changed = true
+		}
+	}
+
+	return goals
+}
+
+// updateMilestone records which of GoalMilestones an active goal has reached and announces new ones.
+// Raising the goal amount can move it back down, so the milestone is announced again when reached.
+func (s *TransactionService) updateMilestone(u *unitOfWork, goal *Goal) error {
+	milestone := savingsMilestone(*goal)
+	if milestone == goal.Milestone {
+		return nil
+	}
+
+	if milestone < goal.Milestone {
+		goal.Milestone = milestone
+		err := s.goalRepo.UpdateGoalState(u.tx, *goal)
+		if err != nil {
+			return fmt.Errorf("failed to update goal milestone: %v", err)
+		}
+		return nil
+	}
+
+	advanced, err := s.goalRepo.AdvanceMilestone(u.tx, goal.ID, milestone)
+	if err != nil {
+		return fmt.Errorf("failed to update goal milestone: %v", err)
+	}
+	goal.Milestone = milestone
+
+	// a refresh running at the same time got there first and announced it
+	if !advanced {
+		return nil
+	}
+	return u.publish(GoalMilestoneReached{Goal: *goal, Percent: milestone})
+}
+
+// savingsMilestone is the highest of GoalMilestones the goal's savings have passed, or 0
+func savingsMilestone(goal Goal) int {
+	reached := 0
+	for _, percent := range GoalMilestones {
+		if goal.CurrentSavings >= goal.Amount*float64(percent)/100 {
+			reached = percent
+		}
+	}
+	return reached
+}
+
+// nextActiveGoal returns the highest priority active goal other than the one given
+func nextActiveGoal(goals []Goal, excludeID string) *Goal {
+	for i := range goals {
+		if goals[i].ID != excludeID && goals[i].Status == GoalActive {
+			return &goals[i]
+		}
+	}
+	return nil
+}
+
+// ChangeGoalStatus handles the transitions users make themselves
+func (s *TransactionService) ChangeGoalStatus(goal *Goal, status string) error {
+	now := s.clock.Now()
+
+	switch status {
+	case GoalAbandoned:
+		if goal.Status != GoalActive && goal.Status != GoalExpired {
+			return fmt.Errorf("only active or expired goals can be abandoned")
+		}
+		goal.AbandonedAt = &now
+	case GoalArchived:
+		if goal.Status == GoalActive || goal.Status == GoalArchived {
+			return fmt.Errorf("only achieved, expired or abandoned goals can be archived")
+		}
+		goal.ArchivedAt = &now
+	case GoalActive:
+		if goal.Status != GoalExpired && goal.Status != GoalAbandoned {
+			return fmt.Errorf("only expired or abandoned goals can be reactivated")
+		}
+		if !goal.TargetDate.After(now) {
+			return fmt.Errorf("move the target date into the future before reactivating the goal")
+		}
+		if goal.CurrentSavings >= goal.Amount {
+			return fmt.Errorf("goal is already fully funded")
+		}
+	default:
+		return fmt.Errorf("status must be abandoned, archived or active")
+	}
+
+	goal.Status = status
+	return s.goalRepo.UpdateGoalState(nil, *goal)
+}
+
+// allocateRoundup splits a roundup across goals. No goal is given more than it still needs;
+// callers cap the roundup at the total remaining so the whole amount always finds a home.
+func allocateRoundup(roundup float64, goals []Goal, strategy string) []RoundupAllocation {
+	if strategy == AllocationPriority {
+		return allocateByPriority(roundup, goals)
+	}
+	return allocateByWeight(roundup, goals)
+}
+
+func allocateByPriority(roundup float64, goals []Goal) []RoundupAllocation {
+	ordered := make([]Goal, len(goals))
+	copy(ordered, goals)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Priority < ordered[j].Priority
+	})
+
+	var allocations []RoundupAllocation
+	left := roundup
+	for _, goal := range ordered {
+		if left <= 0 {
+			break
+		}
+		amount := math.Min(left, goal.Amount-goal.CurrentSavings)
+		if amount <= 0 {
+			continue
+		}
+		allocations = append(allocations, RoundupAllocation{GoalID: goal.ID, Amount: amount})
+		left -= amount
 	}
-	return math.Min(pressure, MaxPressure)
+	return allocations
+}
+
+func allocateByWeight(roundup float64, goals []Goal) []RoundupAllocation {
+	amounts := make([]float64, len(goals))
+	open := map[int]bool{}
+	for i, goal := range goals {
+		if goal.Amount-goal.CurrentSavings > 0 {
+			open[i] = true
+		}
+	}
+
+	// hand out shares by weight; a goal whose share would overshoot is filled and
+	// dropped, and the rest is re-split among the goals still open
+	left := roundup
+	for left > 0 && len(open) > 0 {
+		totalWeight := 0.0
+		for i := range open {
+			totalWeight += goalWeight(goals[i])
+		}
+
+		pool := left
+		capped := false
+		for i := range open {
+			share := pool * goalWeight(goals[i]) / totalWeight
+			need := goals[i].Amount - goals[i].CurrentSavings - amounts[i]
+			if share >= need {
+				amounts[i] += need
+				left -= need
+				delete(open, i)
+				capped = true
+			}
+		}
+
+		if capped {
+			continue
+		}
+
+		for i := range open {
+			amounts[i] += pool * goalWeight(goals[i]) / totalWeight
+		}
+		left = 0
+	}
+
+	var allocations []RoundupAllocation
+	for i, goal := range goals {
+		if amounts[i] > 0 {
+			allocations = append(allocations, RoundupAllocation{GoalID: goal.ID, Amount: amounts[i]})
+		}
+	}
+	return allocations
+}
+
+func goalWeight(goal Goal) float64 {
+	if goal.Weight <= 0 {
+		return 1
+	}
+	return goal.Weight
 }
 
 func contains(categories []string, target string) bool {
@@ -248,66 +798,219 @@ func contains(categories []string, target string) bool {
 	return false
 }
 
-func (s *TransactionService) saveTransactionAndPreferences(userID string, transaction Transaction, roundup float64) error {
-	transaction.CreatedAt = time.Now()
-	err := s.repo.SaveTransaction(transaction)
+// inTx runs fn in one database transaction and dispatches the events fn published once it has
+// committed. Without a database, as in tests, every write runs on its own.
+func (s *TransactionService) inTx(fn func(u *unitOfWork) error) error {
+	u := &unitOfWork{bus: s.events}
+	if s.db != nil {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin transaction: %v", err)
+		}
+		u.tx = tx
+	}
+
+	err := fn(u)
+	if err != nil {
+		if u.tx != nil {
+			u.tx.Rollback()
+		}
+		return err
+	}
+
+	if u.tx != nil {
+		err = u.tx.Commit()
+		if err != nil {
+			return fmt.Errorf("failed to commit transaction: %v", err)
+		}
+	}
+
+	s.events.Dispatch(u.events...)
+	return nil
+}
+
+// savePayment stores a transaction that got no roundup, along with any further events about it.
+// Budgets, subscriptions and anomaly baselines are computed from saved transactions, so every
+// payment is kept, not just roundups.
+func (s *TransactionService) savePayment(transaction Transaction, events ...Event) error {
+	transaction.CreatedAt = s.clock.Now()
+	return s.inTx(func(u *unitOfWork) error {
+		err := s.saveTransaction(u, transaction)
+		if err != nil {
+			return err
+		}
+
+		for _, event := range events {
+			err = u.publish(event)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// saveTransaction stores a payment and announces it, with an alert if it was flagged as anomalous
+func (s *TransactionService) saveTransaction(u *unitOfWork, transaction Transaction) error {
+	err := s.repo.SaveTransaction(u.tx, transaction)
 	if err != nil {
 		return fmt.Errorf("failed to save transaction: %v", err)
 	}
 
+	err = u.publish(TransactionCreated{Transaction: transaction})
+	if err != nil {
+		return err
+	}
+
+	if transaction.Anomalous {
+		return u.publish(anomalyAlert(transaction, s.clock.Now()))
+	}
+	return nil
+}
+
+// withoutRoundup clears the roundup fields of a payment that gets no roundup, whether a roundup
+// that was not kept set them or the client sent them
+func withoutRoundup(transaction Transaction) Transaction {
+	transaction.Roundup = 0
+	transaction.RoundupCapped = 0
+	transaction.CapReason = ""
+	transaction.PenaltyRoundup = 0
+	transaction.RoundupBreakdown = nil
+	return transaction
+}
+
+func (s *TransactionService) saveTransactionAndPreferences(u *unitOfWork, userID string, transaction Transaction, roundup float64, allocations []RoundupAllocation) error {
+	now := s.clock.Now()
+	transaction.CreatedAt = now
+	err := s.saveTransaction(u, transaction)
+	if err != nil {
+		return err
+	}
+
 	user, err := s.userRepo.FindByID(userID)
 	if err != nil {
 		return fmt.Errorf("failed to retrieve user: %v", err)
 	}
 
 	user.Preferences.CurrentSavings += roundup
-	user.Preferences.RoundupHistory = append(user.Preferences.RoundupHistory, roundup)
-	user.Preferences.RoundupDates = append(user.Preferences.RoundupDates, time.Now())
 
-	err = s.userRepo.UpdatePreferences(userID, user.Preferences)
+	err = s.userRepo.UpdatePreferences(u.tx, userID, user.Preferences)
 	if err != nil {
 		return fmt.Errorf("failed to update user preferences: %v", err)
 	}
 
+	err = s.eventRepo.AddRoundupEvents(u.tx, roundupEvents(userID, transaction.ID, roundup, allocations, now))
+	if err != nil {
+		return fmt.Errorf("failed to record roundup: %v", err)
+	}
+
+	for _, allocation := range allocations {
+		err = s.goalRepo.AddToGoalSavings(u.tx, allocation.GoalID, allocation.Amount)
+		if err != nil {
+			return fmt.Errorf("failed to update goal savings: %v", err)
+		}
+	}
+
 	return nil
 }
 
-func (s *TransactionService) CreateUserWallet(userID string) error {
-	wallet := Wallet{
-		ID:          uuid.New().String(),
-		UserID:      userID,
-		Balance:     0.0,
-		LastUpdated: time.Now(),
+// roundupEvents turns a roundup into one event per goal it was allocated to, or a single event
+// without a goal. Roundups capped to zero are still recorded, they count towards transaction frequency.
+func roundupEvents(userID, transactionID string, roundup float64, allocations []RoundupAllocation, now time.Time) []RoundupEvent {
+	newEvent := func(goalID string, amount float64) RoundupEvent {
+		return RoundupEvent{
+			ID:            uuid.New().String(),
+			UserID:        userID,
+			TransactionID: transactionID,
+			GoalID:        goalID,
+			Amount:        amount,
+			CreatedAt:     now,
+		}
 	}
-	return s.walletRepo.CreateWallet(wallet)
+
+	if len(allocations) == 0 {
+		return []RoundupEvent{newEvent("", roundup)}
+	}
+
+	var events []RoundupEvent
+	for _, allocation := range allocations {
+		events = append(events, newEvent(allocation.GoalID, allocation.Amount))
+	}
+	return events
 }
 
-func (s *TransactionService) AddToWallet(userID string, amount float64, description string) error {
+// RegisterUser creates the user with their preferences and an empty wallet, all or nothing
+func (s *TransactionService) RegisterUser(user *User, prefs UserPreferences) error {
+	return s.inTx(func(u *unitOfWork) error {
+		err := s.userRepo.CreateUser(u.tx, user)
+		if err != nil {
+			return fmt.Errorf("failed to create user: %v", err)
+		}
+
+		err = s.userRepo.CreateUserPreferences(u.tx, user.ID, prefs)
+		if err != nil {
+			return fmt.Errorf("failed to create user preferences: %v", err)
+		}
+
+		wallet := Wallet{
+			ID:          uuid.New().String(),
+			UserID:      user.ID,
+			Balance:     0.0,
+			LastUpdated: s.clock.Now(),
+		}
+		err = s.walletRepo.CreateWallet(u.tx, wallet)
+		if err != nil {
+			return fmt.Errorf("failed to create user wallet: %v", err)
+		}
+
+		return u.publish(UserRegistered{UserID: user.ID, Name: user.Name, Email: user.Email})
+	})
+}
+
+// AddToWallet credits the wallet. transactionID is the payment a roundup came from, empty for top-ups.
+func (s *TransactionService) AddToWallet(userID string, amount float64, description, transactionID string) error {
+	return s.inTx(func(u *unitOfWork) error {
+		return s.creditWallet(u, userID, amount, description, transactionID)
+	})
+}
+
+func (s *TransactionService) creditWallet(u *unitOfWork, userID string, amount float64, description, transactionID string) error {
 	wallet, err := s.walletRepo.GetWalletByUserID(userID)
 	if err != nil {
 		return fmt.Errorf("failed to get wallet: %v", err)
 	}
 
 	// Update wallet balance
-	newBalance := wallet.Balance + amount
-	err = s.walletRepo.UpdateWalletBalance(wallet.ID, newBalance)
+	newBalance, version, err := s.walletRepo.AdjustWalletBalance(u.tx, wallet.ID, amount)
 	if err != nil {
 		return fmt.Errorf("failed to update wallet balance: %v", err)
 	}
 
 	// Record transaction
 	tx := WalletTransaction{
-		ID:          uuid.New().String(),
-		WalletID:    wallet.ID,
-		Amount:      amount,
-		Type:        "credit",
-		Description: description,
-		CreatedAt:   time.Now(),
+		ID:            uuid.New().String(),
+		WalletID:      wallet.ID,
+		Amount:        amount,
+		Type:          "credit",
+		Description:   description,
+		TransactionID: transactionID,
+		CreatedAt:     s.clock.Now(),
+	}
+	err = s.walletRepo.AddWalletTransaction(u.tx, tx)
+	if err != nil {
+		return err
 	}
-	return s.walletRepo.AddWalletTransaction(tx)
+
+	return u.publish(WalletCredited{UserID: userID, WalletID: wallet.ID, Amount: amount, Balance: newBalance, Version: version})
 }
 
 func (s *TransactionService) WithdrawFromWallet(userID string, amount float64, description string) error {
+	return s.inTx(func(u *unitOfWork) error {
+		return s.withdraw(u, userID, amount, description)
+	})
+}
+
+func (s *TransactionService) withdraw(u *unitOfWork, userID string, amount float64, description string) error {
 	wallet, err := s.walletRepo.GetWalletByUserID(userID)
 	if err != nil {
 		return fmt.Errorf("failed to get wallet: %v", err)
@@ -318,9 +1021,11 @@ func (s *TransactionService) WithdrawFromWallet(userID string, amount float64, d
 		return fmt.Errorf("insufficient balance")
 	}
 
-	// Update wallet balance
-	newBalance := wallet.Balance - amount
-	err = s.walletRepo.UpdateWalletBalance(wallet.ID, newBalance)
+	// Update wallet balance. The check above can be outdated by a withdrawal running at the same time.
+	newBalance, version, err := s.walletRepo.AdjustWalletBalance(u.tx, wallet.ID, -amount)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("insufficient balance")
+	}
 	if err != nil {
 		return fmt.Errorf("failed to update wallet balance: %v", err)
 	}
@@ -332,9 +1037,14 @@ func (s *TransactionService) WithdrawFromWallet(userID string, amount float64, d
 		Amount:      amount,
 		Type:        "debit",
 		Description: description,
-		CreatedAt:   time.Now(),
+		CreatedAt:   s.clock.Now(),
+	}
+	err = s.walletRepo.AddWalletTransaction(u.tx, tx)
+	if err != nil {
+		return err
 	}
-	return s.walletRepo.AddWalletTransaction(tx)
+
+	return u.publish(WalletWithdrawn{UserID: userID, WalletID: wallet.ID, Amount: amount, Balance: newBalance, Version: version})
 }
 
 func (s *TransactionService) GetWalletBalance(userID string) (float64, error) {
@@ -345,10 +1055,143 @@ func (s *TransactionService) GetWalletBalance(userID string) (float64, error) {
 	return wallet.Balance, nil
 }
 
-func (s *TransactionService) GetWalletTransactions(userID string) ([]WalletTransaction, error) {
+func (s *TransactionService) ListWalletTransactions(userID string, filter TransactionFilter) ([]WalletTransaction, error) {
 	wallet, err := s.walletRepo.GetWalletByUserID(userID)
 	if err != nil {
 		return nil, fmt.Errorf("failed to get wallet: %v", err)
 	}
-	return s.walletRepo.GetWalletTransactions(wallet.ID)
+	return s.walletRepo.ListWalletTransactions(wallet.ID, filter)
+}
+
+// categoryMultiplier is the user's multiplier for a category, 1 if they have not set one
+func (p UserPreferences) categoryMultiplier(category string) float64 {
+	multiplier, ok := p.CategoryMultipliers[category]
+	if !ok {
+		return 1
+	}
+	return multiplier
+}
+
+// normalizeCategoryMultipliers checks every category is known and its multiplier is within
+// 0 to MaxCategoryMultiplier, returning the map keyed by canonical category names
+func normalizeCategoryMultipliers(multipliers map[string]float64) (map[string]float64, error) {
+	normalized := map[string]float64{}
+	for name, multiplier := range multipliers {
+		category, ok := canonicalCategory(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown category '%s'", name)
+		}
+		if multiplier < 0 || multiplier > MaxCategoryMultiplier {
+			return nil, fmt.Errorf("multiplier for '%s' must be between 0 and %d", category, MaxCategoryMultiplier)
+		}
+		if _, exists := normalized[category]; exists {
+			return nil, fmt.Errorf("category '%s' is given more than once", category)
+		}
+		normalized[category] = multiplier
+	}
+	return normalized, nil
+}
+
+// canonicalCategory matches a category name case-insensitively and returns it as spelled in categories
+func canonicalCategory(name string) (string, bool) {
+	for _, category := range categories {
+		if strings.EqualFold(category, name) {
+			return category, true
+		}
+	}
+	return "", false
+}
+
+// GetGoalProgress reports how far along a goal is and forecasts when it will be reached,
+// based on the roundups of the recent period and how they are split between goals. It only reads:
+// goals due a transition are shown as they will be after the next refresh.
+func (s *TransactionService) GetGoalProgress(userID string, goal Goal) (*GoalProgress, error) {
+	user, err := s.userRepo.FindByID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve user: %v", err)
+	}
+
+	now := s.clock.Now()
+	params := DefaultRoundupParams
+	history, err := s.eventRepo.GetRoundupEventsSince(userID, roundupHistoryStart(now, params.RecentPeriodDays))
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve roundup history: %v", err)
+	}
+
+	goals, err := s.goalRepo.GetGoalsByUserID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve goals: %v", err)
+	}
+	goals = settleGoals(goals, now)
+
+	// use the settled copy so the status is current
+	for _, g := range goals {
+		if g.ID == goal.ID {
+			goal = g
+		}
+	}
+
+	progress := &GoalProgress{
+		GoalID:          goal.ID,
+		Name:            goal.Name,
+		Status:          goal.Status,
+		Amount:          goal.Amount,
+		CurrentSavings:  goal.CurrentSavings,
+		RemainingAmount: math.Max(goal.Amount-goal.CurrentSavings, 0),
+		TargetDate:      goal.TargetDate,
+	}
+
+	if goal.Amount > 0 {
+		progress.PercentComplete = math.Min(goal.CurrentSavings/goal.Amount*100, 100)
+	}
+
+	if progress.RemainingAmount == 0 {
+		progress.OnTrack = true
+		progress.ProjectedCompletion = goal.AchievedAt
+		return progress, nil
+	}
+
+	averageRoundup := s.calculateAvgRoundup()
+	recentDates := filterRecentDates(roundupDates(history), params.RecentPeriodDays, now)
+	avgTxnsPerDay := calculateAvgTxnsPerDay(recentDates, params.RecentPeriodDays)
+
+	gp := calculateGoalPressure(goal, averageRoundup, avgTxnsPerDay, now, params)
+	progress.DaysRemaining = gp.DaysRemaining
+	progress.Pressure = gp.Pressure
+
+	if goal.Status != GoalActive {
+		return progress, nil
+	}
+
+	// this goal's cut of a typical day's roundups under the user's allocation strategy
+	dailySavings := recentRoundupTotal(history, params.RecentPeriodDays, now) / float64(params.RecentPeriodDays)
+	for _, allocation := range allocateRoundup(dailySavings, filterActiveGoals(goals, now), user.Preferences.GoalAllocation) {
+		if allocation.GoalID == goal.ID {
+			progress.DailySavingsRate = allocation.Amount
+		}
+	}
+
+	if progress.DailySavingsRate > 0 {
+		days := math.Ceil(progress.RemainingAmount / progress.DailySavingsRate)
+		projected := now.Add(time.Duration(days) * 24 * time.Hour)
+		progress.ProjectedCompletion = &projected
+		progress.OnTrack = !projected.After(goal.TargetDate)
+	}
+
+	return progress, nil
+}
+
+// recentRoundupTotal sums the roundups made in the last recentDays
+func recentRoundupTotal(history []RoundupEvent, recentDays int, now time.Time) float64 {
+	return roundupTotalSince(history, now.Add(-time.Duration(recentDays)*24*time.Hour))
+}
+
+func roundupTotalSince(history []RoundupEvent, since time.Time) float64 {
+	total := 0.0
+	for _, event := range history {
+		if !event.CreatedAt.Before(since) {
+			total += event.Amount
+		}
+	}
+	return total
 }
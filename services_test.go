@@ -0,0 +1,2888 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+// the fakes embed their interface so only the methods the roundup engine uses need implementing
+type fakeTransactionRepo struct {
+	TransactionRepository
+	saved        []Transaction
+	totalRoundup float64
+}
+
+func (r *fakeTransactionRepo) SaveTransaction(dbTx *sql.Tx, tx Transaction) error {
+	r.saved = append(r.saved, tx)
+	return nil
+}
+
+func (r *fakeTransactionRepo) GetTotalRoundupInPeriod(days int) (float64, error) {
+	return r.totalRoundup, nil
+}
+
+// GetSpendingByCategory totals the saved transactions, ignoring the period
+func (r *fakeTransactionRepo) GetSpendingByCategory(userID, period string, from, to time.Time) ([]CategorySpending, error) {
+	var spending []CategorySpending
+	for _, tx := range r.saved {
+		if tx.CreatedAt.Before(from) || !tx.CreatedAt.Before(to) {
+			continue
+		}
+		spending = append(spending, CategorySpending{Category: tx.Category, Total: tx.Amount, Count: 1})
+	}
+	return spending, nil
+}
+
+type fakeBudgetRepo struct {
+	BudgetRepository
+	budgets []Budget
+}
+
+func (r *fakeBudgetRepo) GetBudgetsByUserID(userID string) ([]Budget, error) {
+	return r.budgets, nil
+}
+
+type fakeUserRepo struct {
+	UserRepository
+	user           User
+	emailLookupErr error // what GetUserByEmail fails with, sql.ErrNoRows when unset
+	pendingEmail   string
+	anonymized     bool
+}
+
+func (r *fakeUserRepo) AnonymizeUser(userID string) error {
+	r.anonymized = true
+	return nil
+}
+
+func (r *fakeUserRepo) FindByID(id string) (*User, error) {
+	user := r.user
+	return &user, nil
+}
+
+func (r *fakeUserRepo) UpdatePreferences(dbTx *sql.Tx, userID string, prefs UserPreferences) error {
+	r.user.Preferences = prefs
+	return nil
+}
+
+func (r *fakeUserRepo) GetPasswordHash(userID string) (string, error) {
+	return r.user.Password, nil
+}
+
+func (r *fakeUserRepo) GetUserByEmail(email string) (*User, error) {
+	if r.emailLookupErr != nil {
+		return nil, r.emailLookupErr
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (r *fakeUserRepo) SetPendingEmail(userID, email, tokenHash string, expiresAt time.Time) error {
+	r.pendingEmail = email
+	return nil
+}
+
+type recordingMailer struct {
+	sent []string // recipients
+}
+
+func (m *recordingMailer) Send(to, subject, body string) error {
+	m.sent = append(m.sent, to)
+	return nil
+}
+
+type fakeWalletRepo struct {
+	WalletRepository
+	wallet       Wallet
+	transactions []WalletTransaction
+}
+
+func (r *fakeWalletRepo) GetWalletTransactions(walletID string) ([]WalletTransaction, error) {
+	return r.transactions, nil
+}
+
+func (r *fakeWalletRepo) GetWalletByUserID(userID string) (*Wallet, error) {
+	wallet := r.wallet
+	return &wallet, nil
+}
+
+func (r *fakeWalletRepo) AdjustWalletBalance(dbTx *sql.Tx, walletID string, change float64) (float64, int64, error) {
+	if r.wallet.Balance+change < 0 {
+		return 0, 0, sql.ErrNoRows
+	}
+	r.wallet.Balance += change
+	r.wallet.Version++
+	return r.wallet.Balance, r.wallet.Version, nil
+}
+
+func (r *fakeWalletRepo) AddWalletTransaction(dbTx *sql.Tx, tx WalletTransaction) error {
+	return nil
+}
+
+type fakeGoalRepo struct {
+	GoalRepository
+	goals []Goal
+}
+
+func (r *fakeGoalRepo) GetGoalsByUserID(userID string) ([]Goal, error) {
+	goals := make([]Goal, len(r.goals))
+	copy(goals, r.goals)
+	return goals, nil
+}
+
+func (r *fakeGoalRepo) GetGoalByID(id string) (*Goal, error) {
+	for _, goal := range r.goals {
+		if goal.ID == id {
+			return &goal, nil
+		}
+	}
+	return nil, sql.ErrNoRows
+}
+
+func (r *fakeGoalRepo) DeleteGoal(id string) (bool, error) {
+	for i, goal := range r.goals {
+		if goal.ID == id && goal.CurrentSavings == 0 {
+			r.goals = append(r.goals[:i], r.goals[i+1:]...)
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r *fakeGoalRepo) AddToGoalSavings(dbTx *sql.Tx, goalID string, amount float64) error {
+	for i := range r.goals {
+		if r.goals[i].ID == goalID {
+			r.goals[i].CurrentSavings += amount
+		}
+	}
+	return nil
+}
+
+// UpdateGoalState leaves savings alone, like the SQL
+func (r *fakeGoalRepo) UpdateGoalState(dbTx *sql.Tx, goal Goal) error {
+	for i := range r.goals {
+		if r.goals[i].ID == goal.ID {
+			goal.CurrentSavings = r.goals[i].CurrentSavings
+			r.goals[i] = goal
+		}
+	}
+	return nil
+}
+
+func (r *fakeGoalRepo) LockGoalsByUserID(dbTx *sql.Tx, userID string) ([]Goal, error) {
+	return r.GetGoalsByUserID(userID)
+}
+
+func (r *fakeGoalRepo) AdvanceMilestone(dbTx *sql.Tx, goalID string, milestone int) (bool, error) {
+	for i := range r.goals {
+		if r.goals[i].ID == goalID && r.goals[i].Milestone < milestone {
+			r.goals[i].Milestone = milestone
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+type fakeRoundupEventRepo struct {
+	RoundupEventRepository
+	events []RoundupEvent
+}
+
+func (r *fakeRoundupEventRepo) AddRoundupEvents(dbTx *sql.Tx, events []RoundupEvent) error {
+	r.events = append(r.events, events...)
+	return nil
+}
+
+func (r *fakeRoundupEventRepo) GetRoundupEventsByUserID(userID string) ([]RoundupEvent, error) {
+	return r.events, nil
+}
+
+func (r *fakeRoundupEventRepo) GetRoundupEventsSince(userID string, since time.Time) ([]RoundupEvent, error) {
+	var events []RoundupEvent
+	for _, event := range r.events {
+		if !event.CreatedAt.Before(since) {
+			events = append(events, event)
+		}
+	}
+	return events, nil
+}
+
+// fakeOutboxRepo is shared with dispatch goroutines, hence the lock
+type fakeOutboxRepo struct {
+	mu         sync.Mutex
+	events     []OutboxEvent
+	deliveries map[string][]string
+}
+
+func (r *fakeOutboxRepo) AddEvent(dbTx *sql.Tx, event OutboxEvent) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+	return nil
+}
+
+func (r *fakeOutboxRepo) ClaimPendingEvents(now, leaseUntil time.Time, maxAttempts, limit int) ([]OutboxEvent, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var claimed []OutboxEvent
+	for i := range r.events {
+		event := &r.events[i]
+		if event.DispatchedAt != nil || event.Attempts >= maxAttempts || len(claimed) == limit {
+			continue
+		}
+		if event.NextAttemptAt != nil && event.NextAttemptAt.After(now) {
+			continue
+		}
+		lease := leaseUntil
+		event.NextAttemptAt = &lease
+		claimed = append(claimed, *event)
+	}
+	return claimed, nil
+}
+
+func (r *fakeOutboxRepo) GetDeliveredSubscribers(eventID string) ([]string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.deliveries[eventID], nil
+}
+
+func (r *fakeOutboxRepo) RecordDelivery(eventID, subscriber string, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.deliveries == nil {
+		r.deliveries = map[string][]string{}
+	}
+	r.deliveries[eventID] = append(r.deliveries[eventID], subscriber)
+	return nil
+}
+
+func (r *fakeOutboxRepo) RecordFailure(eventID, lastError string, retryAt time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.events {
+		if r.events[i].ID == eventID {
+			r.events[i].Attempts++
+			r.events[i].LastError = lastError
+			r.events[i].NextAttemptAt = &retryAt
+		}
+	}
+	return nil
+}
+
+func (r *fakeOutboxRepo) MarkDispatched(eventID string, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.events {
+		if r.events[i].ID == eventID {
+			r.events[i].DispatchedAt = &at
+		}
+	}
+	return nil
+}
+
+// publish stores the events outside any transaction, dispatches them and waits until subscribers are done
+func publish(t *testing.T, bus *EventBus, events ...Event) {
+	t.Helper()
+	for _, event := range events {
+		row, err := bus.Publish(nil, event)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bus.Dispatch(row)
+	}
+	bus.Wait()
+}
+
+var testStart = time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+// newTestService returns a service whose average roundup is 10 and, with no recent
+// roundup dates, assumes DefaultAvgTxnsPerDay transactions a day
+func newTestService(goals ...Goal) (*TransactionService, *fakeClock, *fakeGoalRepo) {
+	clock := &fakeClock{now: testStart}
+	goalRepo := &fakeGoalRepo{goals: goals}
+	service := &TransactionService{
+		repo:       &fakeTransactionRepo{totalRoundup: 70},
+		userRepo:   &fakeUserRepo{user: User{ID: "user-1", Preferences: UserPreferences{GoalAllocation: AllocationWeight}}},
+		upiClient:  &DummyUPIClient{},
+		walletRepo: &fakeWalletRepo{wallet: Wallet{ID: "wallet-1", UserID: "user-1"}},
+		goalRepo:   goalRepo,
+		eventRepo:  &fakeRoundupEventRepo{},
+		budgetRepo: &fakeBudgetRepo{},
+		events:     NewEventBus(&fakeOutboxRepo{}, clock),
+		clock:      clock,
+	}
+	return service, clock, goalRepo
+}
+
+func testGoal(id string, amount float64, targetDate time.Time) Goal {
+	return Goal{ID: id, UserID: "user-1", Name: id, Amount: amount, TargetDate: targetDate, Weight: 1, Status: GoalActive, OnComplete: SurplusWallet}
+}
+
+func testTransaction(amount float64) Transaction {
+	return Transaction{ID: "txn-1", UserID: "user-1", Amount: amount, Category: "Dining & Food", Merchant: "cafe@upi", RoundupEnabled: true}
+}
+
+func assertClose(t *testing.T, name string, got, want float64) {
+	t.Helper()
+	if math.Abs(got-want) > 1e-9 {
+		t.Errorf("%s = %.4f, want %.4f", name, got, want)
+	}
+}
+
+func TestCalculatePressureClamps(t *testing.T) {
+	params := DefaultRoundupParams
+
+	assertClose(t, "no projected transactions", params.calculatePressure(100, 0), MinPressure)
+	assertClose(t, "far ahead of schedule", params.calculatePressure(1, 100), MinPressure)
+	assertClose(t, "on schedule", params.calculatePressure(50, 50), 1)
+	assertClose(t, "far behind schedule", params.calculatePressure(1000, 10), MaxPressure)
+}
+
+func TestGoalPressureRisesAsDeadlineApproaches(t *testing.T) {
+	goal := testGoal("trip", 1000, testStart.Add(100*24*time.Hour))
+
+	// 100 transactions still needed, 3 a day for 100 days
+	far := calculateGoalPressure(goal, 10, DefaultAvgTxnsPerDay, testStart, DefaultRoundupParams)
+	assertClose(t, "days remaining", far.DaysRemaining, 100)
+	assertClose(t, "required transactions", far.RequiredTxns, 100)
+	assertClose(t, "projected transactions", far.ProjectedTxns, 300)
+	assertClose(t, "pressure", far.Pressure, 100.0/300.0)
+
+	// same goal with 20 days left: 100 needed over 60 projected
+	near := calculateGoalPressure(goal, 10, DefaultAvgTxnsPerDay, testStart.Add(80*24*time.Hour), DefaultRoundupParams)
+	assertClose(t, "days remaining", near.DaysRemaining, 20)
+	assertClose(t, "pressure", near.Pressure, 100.0/60.0)
+
+	// on the final day the pressure is capped
+	last := calculateGoalPressure(goal, 10, DefaultAvgTxnsPerDay, goal.TargetDate.Add(-time.Hour), DefaultRoundupParams)
+	assertClose(t, "days remaining", last.DaysRemaining, 1)
+	assertClose(t, "pressure", last.Pressure, MaxPressure)
+}
+
+func TestFilterRecentDates(t *testing.T) {
+	dates := []time.Time{
+		testStart.Add(-8 * 24 * time.Hour),
+		testStart.Add(-7*24*time.Hour - time.Minute),
+		testStart.Add(-6 * 24 * time.Hour),
+		testStart.Add(-time.Hour),
+	}
+
+	recent := filterRecentDates(dates, RecentPeriodDays, testStart)
+	if len(recent) != 2 {
+		t.Fatalf("got %d recent dates, want 2", len(recent))
+	}
+
+	assertClose(t, "transactions per day", calculateAvgTxnsPerDay(recent, RecentPeriodDays), 2.0/7.0)
+	assertClose(t, "default transactions per day", calculateAvgTxnsPerDay(nil, RecentPeriodDays), DefaultAvgTxnsPerDay)
+}
+
+func TestProcessRoundupAppliesGoalPressure(t *testing.T) {
+	service, _, goalRepo := newTestService(testGoal("trip", 1000, testStart.Add(100*24*time.Hour)))
+
+	roundup, _, _, err := service.ProcessRoundup("user-1", testTransaction(300))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// base roundup of 15 at a pressure of 100/300
+	assertClose(t, "roundup", roundup, 5)
+	assertClose(t, "goal savings", goalRepo.goals[0].CurrentSavings, 5)
+}
+
+func TestProcessRoundupPressureFollowsClock(t *testing.T) {
+	service, clock, _ := newTestService(testGoal("trip", 1000, testStart.Add(100*24*time.Hour)))
+
+	clock.Advance(90 * 24 * time.Hour)
+
+	roundup, _, _, err := service.ProcessRoundup("user-1", testTransaction(300))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 10 days left is behind schedule, so the base roundup of 15 gets the maximum pressure
+	assertClose(t, "roundup", roundup, 15*MaxPressure)
+}
+
+func TestProcessRoundupExpiresGoalAtDeadline(t *testing.T) {
+	target := testStart.Add(10 * 24 * time.Hour)
+	service, clock, goalRepo := newTestService(testGoal("trip", 1000, target))
+
+	clock.Advance(10*24*time.Hour + time.Minute)
+
+	roundup, _, _, err := service.ProcessRoundup("user-1", testTransaction(300))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// no active goal left, so only the base roundup applies and the goal gets nothing
+	assertClose(t, "roundup", roundup, 15)
+	assertClose(t, "goal savings", goalRepo.goals[0].CurrentSavings, 0)
+
+	goal := goalRepo.goals[0]
+	if goal.Status != GoalExpired {
+		t.Fatalf("goal status = %q, want %q", goal.Status, GoalExpired)
+	}
+	if goal.ExpiredAt == nil || !goal.ExpiredAt.Equal(clock.Now()) {
+		t.Errorf("goal expired at %v, want %v", goal.ExpiredAt, clock.Now())
+	}
+}
+
+func TestProcessRoundupRecordsClockTime(t *testing.T) {
+	service, clock, _ := newTestService(testGoal("trip", 1000, testStart.Add(100*24*time.Hour)))
+	clock.Advance(3 * time.Hour)
+
+	_, _, _, err := service.ProcessRoundup("user-1", testTransaction(300))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := service.repo.(*fakeTransactionRepo).saved
+	if len(saved) != 1 || !saved[0].CreatedAt.Equal(clock.Now()) {
+		t.Fatalf("saved transactions = %+v, want one created at %v", saved, clock.Now())
+	}
+
+	events := service.eventRepo.(*fakeRoundupEventRepo).events
+	if len(events) != 1 || !events[0].CreatedAt.Equal(clock.Now()) || events[0].GoalID != "trip" {
+		t.Errorf("roundup events = %+v, want one for goal trip at %v", events, clock.Now())
+	}
+}
+
+func TestProcessRoundupSavesPaymentsWithoutRoundup(t *testing.T) {
+	service, _, _ := newTestService(testGoal("trip", 1000, testStart.Add(30*24*time.Hour)))
+	userRepo := service.userRepo.(*fakeUserRepo)
+	userRepo.user.Preferences.RoundupCategories = []string{"Groceries"}
+
+	disabled := testTransaction(250)
+	disabled.ID = "txn-disabled"
+	disabled.RoundupEnabled = false
+	outside := testTransaction(400)
+	outside.ID = "txn-outside" // a category the user doesn't round up
+
+	for _, txn := range []Transaction{disabled, outside} {
+		roundup, _, _, err := service.ProcessRoundup("user-1", txn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if roundup != 0 {
+			t.Errorf("%s roundup = %.2f, want 0", txn.ID, roundup)
+		}
+	}
+
+	saved := service.repo.(*fakeTransactionRepo).saved
+	if len(saved) != 2 || saved[0].ID != "txn-disabled" || saved[1].ID != "txn-outside" || saved[1].Roundup != 0 {
+		t.Errorf("saved transactions = %+v, want both payments without a roundup", saved)
+	}
+	if events := service.eventRepo.(*fakeRoundupEventRepo).events; len(events) != 0 {
+		t.Errorf("roundup events = %+v, want none", events)
+	}
+}
+
+func TestProcessRoundupDropsRoundupFieldsSentWithPayments(t *testing.T) {
+	service, _, _ := newTestService(testGoal("trip", 1000, testStart.Add(30*24*time.Hour)))
+	service.userRepo.(*fakeUserRepo).user.Preferences.RoundupCategories = []string{"Groceries"}
+
+	// the fields the handler binds along with the payment
+	body := `{"amount": 400, "category": "Dining & Food", "merchant": "cafe@upi", "roundup": 99,
+		"roundup_capped": 12, "cap_reason": "daily", "penalty_roundup": 5, "roundup_breakdown": {"roundup": 99}}`
+	for _, enabled := range []bool{false, true} {
+		var txn Transaction
+		err := json.Unmarshal([]byte(body), &txn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		txn.ID = "txn-" + strconv.FormatBool(enabled)
+		txn.UserID = "user-1"
+		txn.RoundupEnabled = enabled // enabled but skipped, the category isn't rounded up
+
+		_, _, _, err = service.ProcessRoundup("user-1", txn)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, saved := range service.repo.(*fakeTransactionRepo).saved {
+		if saved.Roundup != 0 || saved.RoundupCapped != 0 || saved.CapReason != "" || saved.PenaltyRoundup != 0 || saved.RoundupBreakdown != nil {
+			t.Errorf("%s saved with the client's roundup fields: %+v", saved.ID, saved)
+		}
+	}
+}
+
+func TestSimulateRoundupsMatchesProcessRoundupAndSavesNothing(t *testing.T) {
+	trip := testGoal("trip", 1000, testStart.Add(20*24*time.Hour))
+	trip.CurrentSavings = 200
+	fund := testGoal("fund", 3000, testStart.Add(90*24*time.Hour))
+
+	service, _, goalRepo := newTestService(trip, fund)
+	service.eventRepo = &fakeRoundupEventRepo{events: []RoundupEvent{
+		{GoalID: "trip", Amount: 15, CreatedAt: testStart.Add(-2 * 24 * time.Hour)},
+		{GoalID: "fund", Amount: 25, CreatedAt: testStart.Add(-3 * 24 * time.Hour)},
+	}}
+	user, _ := service.userRepo.FindByID("user-1")
+	transaction := testTransaction(473)
+
+	goals, _ := goalRepo.GetGoalsByUserID("user-1")
+	simulated, err := service.SimulateRoundups("user-1", user.Preferences, goals, []Transaction{transaction, transaction})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(simulated) != 2 || !reflect.DeepEqual(simulated[0], simulated[1]) {
+		t.Fatalf("simulated = %+v, want the same breakdown twice", simulated)
+	}
+	if !reflect.DeepEqual(goalRepo.goals, []Goal{trip, fund}) {
+		t.Errorf("goals changed to %+v", goalRepo.goals)
+	}
+	if saved := service.repo.(*fakeTransactionRepo).saved; len(saved) != 0 {
+		t.Errorf("saved %d transactions", len(saved))
+	}
+	if events := service.eventRepo.(*fakeRoundupEventRepo).events; len(events) != 2 {
+		t.Errorf("got %d roundup events, want the 2 from before", len(events))
+	}
+	if wallet := service.walletRepo.(*fakeWalletRepo).wallet; wallet.Balance != 0 {
+		t.Errorf("wallet balance = %.2f, want 0", wallet.Balance)
+	}
+	if events := service.events.outbox.(*fakeOutboxRepo).events; len(events) != 0 {
+		t.Errorf("published %d events", len(events))
+	}
+
+	roundup, _, _, err := service.ProcessRoundup("user-1", transaction)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	saved := service.repo.(*fakeTransactionRepo).saved
+	if len(saved) != 1 || saved[0].RoundupBreakdown == nil {
+		t.Fatalf("saved = %+v, want the transaction with its breakdown", saved)
+	}
+	assertClose(t, "roundup", roundup, simulated[0].Roundup)
+	if !reflect.DeepEqual(*saved[0].RoundupBreakdown, simulated[0]) {
+		t.Errorf("processed breakdown = %+v\nsimulated = %+v", *saved[0].RoundupBreakdown, simulated[0])
+	}
+}
+
+func TestRefreshGoalsRollsSurplusIntoNextGoal(t *testing.T) {
+	first := testGoal("trip", 100, testStart.Add(30*24*time.Hour))
+	first.CurrentSavings = 130
+	first.OnComplete = SurplusNextGoal
+	second := testGoal("fund", 500, testStart.Add(60*24*time.Hour))
+	second.Priority = 1
+
+	service, clock, goalRepo := newTestService(first, second)
+
+	goals, err := service.RefreshGoals("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if goals[0].Status != GoalAchieved || goals[0].AchievedAt == nil || !goals[0].AchievedAt.Equal(clock.Now()) {
+		t.Errorf("first goal = %+v, want achieved at %v", goals[0], clock.Now())
+	}
+	assertClose(t, "first goal savings", goalRepo.goals[0].CurrentSavings, 100)
+	assertClose(t, "second goal savings", goalRepo.goals[1].CurrentSavings, 30)
+	if goals[1].Status != GoalActive {
+		t.Errorf("second goal status = %q, want %q", goals[1].Status, GoalActive)
+	}
+}
+
+func TestRefreshGoalsKeepsSurplusOutOfGoalsPayingToTheWallet(t *testing.T) {
+	first := testGoal("trip", 100, testStart.Add(30*24*time.Hour))
+	first.CurrentSavings = 130
+	second := testGoal("fund", 500, testStart.Add(60*24*time.Hour))
+	second.Priority = 1
+
+	service, _, goalRepo := newTestService(first, second)
+
+	_, err := service.RefreshGoals("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertClose(t, "first goal savings", goalRepo.goals[0].CurrentSavings, 100)
+	assertClose(t, "second goal savings", goalRepo.goals[1].CurrentSavings, 0)
+}
+
+// racingGoalRepo adds savings to the stored goals right after they are read, like a roundup
+// landing while a refresh is still working on its copy
+type racingGoalRepo struct {
+	*fakeGoalRepo
+	amount float64
+}
+
+func (r *racingGoalRepo) LockGoalsByUserID(dbTx *sql.Tx, userID string) ([]Goal, error) {
+	goals, err := r.fakeGoalRepo.LockGoalsByUserID(dbTx, userID)
+	for i := range r.goals {
+		r.goals[i].CurrentSavings += r.amount
+	}
+	return goals, err
+}
+
+func TestRefreshGoalsKeepsSavingsAddedAfterTheRead(t *testing.T) {
+	expired := testGoal("trip", 1000, testStart.Add(-time.Hour))
+	expired.CurrentSavings = 200
+	achieved := testGoal("fund", 100, testStart.Add(30*24*time.Hour))
+	achieved.CurrentSavings = 120
+	achieved.Priority = 1
+
+	service, _, goalRepo := newTestService(expired, achieved)
+	service.goalRepo = &racingGoalRepo{fakeGoalRepo: goalRepo, amount: 50}
+
+	_, err := service.RefreshGoals("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if goalRepo.goals[0].Status != GoalExpired {
+		t.Errorf("first goal status = %q, want %q", goalRepo.goals[0].Status, GoalExpired)
+	}
+	assertClose(t, "expired goal savings", goalRepo.goals[0].CurrentSavings, 250)
+	// only the surplus the refresh saw is taken off
+	assertClose(t, "achieved goal savings", goalRepo.goals[1].CurrentSavings, 150)
+}
+
+func TestGetGoalProgressWritesNothing(t *testing.T) {
+	funded := testGoal("trip", 100, testStart.Add(30*24*time.Hour))
+	funded.CurrentSavings = 130
+	funded.OnComplete = SurplusNextGoal
+	next := testGoal("fund", 500, testStart.Add(60*24*time.Hour))
+	next.Priority = 1
+	late := testGoal("bike", 500, testStart.Add(-time.Hour))
+	late.Priority = 2
+
+	service, _, goalRepo := newTestService(funded, next, late)
+	before := make([]Goal, len(goalRepo.goals))
+	copy(before, goalRepo.goals)
+
+	tests := []struct {
+		goal        Goal
+		wantStatus  string
+		wantSavings float64
+	}{
+		{funded, GoalAchieved, 100},
+		{next, GoalActive, 30},
+		{late, GoalExpired, 0},
+	}
+	for _, tt := range tests {
+		progress, err := service.GetGoalProgress("user-1", tt.goal)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if progress.Status != tt.wantStatus {
+			t.Errorf("%s status = %q, want %q", tt.goal.ID, progress.Status, tt.wantStatus)
+		}
+		assertClose(t, tt.goal.ID+" savings", progress.CurrentSavings, tt.wantSavings)
+	}
+
+	if !reflect.DeepEqual(goalRepo.goals, before) {
+		t.Errorf("goals changed to %+v", goalRepo.goals)
+	}
+	if events := service.events.outbox.(*fakeOutboxRepo).events; len(events) != 0 {
+		t.Errorf("published %d events, want none", len(events))
+	}
+}
+
+func TestGetGoalProgressForecastsFromRecentRoundups(t *testing.T) {
+	trip := testGoal("trip", 200, testStart.Add(30*24*time.Hour))
+	trip.CurrentSavings = 100
+	fund := testGoal("fund", 1000, testStart.Add(60*24*time.Hour))
+
+	service, clock, _ := newTestService(trip, fund)
+	service.eventRepo = &fakeRoundupEventRepo{events: []RoundupEvent{
+		{Amount: 70, CreatedAt: testStart.Add(-24 * time.Hour)},
+		{Amount: 70, CreatedAt: testStart.Add(-6 * 24 * time.Hour)},
+		{Amount: 500, CreatedAt: testStart.Add(-8 * 24 * time.Hour)}, // before the recent period
+	}}
+
+	progress, err := service.GetGoalProgress("user-1", trip)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 140 over 7 days, split evenly between the two goals
+	assertClose(t, "daily savings rate", progress.DailySavingsRate, 10)
+	assertClose(t, "remaining", progress.RemainingAmount, 100)
+	projected := clock.Now().Add(10 * 24 * time.Hour)
+	if progress.ProjectedCompletion == nil || !progress.ProjectedCompletion.Equal(projected) {
+		t.Errorf("projected completion = %v, want %v", progress.ProjectedCompletion, projected)
+	}
+	if !progress.OnTrack {
+		t.Error("goal reached before its target date should be on track")
+	}
+}
+
+func TestChangeGoalStatus(t *testing.T) {
+	future := testStart.Add(30 * 24 * time.Hour)
+	past := testStart.Add(-time.Hour)
+
+	tests := []struct {
+		name    string
+		from    string
+		target  time.Time
+		savings float64
+		to      string
+		wantErr bool
+	}{
+		{"abandon active", GoalActive, future, 0, GoalAbandoned, false},
+		{"abandon expired", GoalExpired, past, 0, GoalAbandoned, false},
+		{"abandon achieved", GoalAchieved, future, 1000, GoalAbandoned, true},
+		{"archive achieved", GoalAchieved, future, 1000, GoalArchived, false},
+		{"archive abandoned", GoalAbandoned, future, 0, GoalArchived, false},
+		{"archive active", GoalActive, future, 0, GoalArchived, true},
+		{"archive archived", GoalArchived, future, 0, GoalArchived, true},
+		{"reactivate abandoned", GoalAbandoned, future, 0, GoalActive, false},
+		{"reactivate expired before moving the date", GoalExpired, past, 0, GoalActive, true},
+		{"reactivate funded", GoalAbandoned, future, 1000, GoalActive, true},
+		{"reactivate achieved", GoalAchieved, future, 1000, GoalActive, true},
+		{"unknown status", GoalActive, future, 0, GoalExpired, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			goal := testGoal("trip", 1000, tt.target)
+			goal.Status = tt.from
+			goal.CurrentSavings = tt.savings
+			service, clock, goalRepo := newTestService(goal)
+
+			err := service.ChangeGoalStatus(&goal, tt.to)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("moved from %q to %q, want an error", tt.from, tt.to)
+				}
+				if goalRepo.goals[0].Status != tt.from {
+					t.Errorf("stored status = %q, want %q", goalRepo.goals[0].Status, tt.from)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			stored := goalRepo.goals[0]
+			if stored.Status != tt.to {
+				t.Errorf("stored status = %q, want %q", stored.Status, tt.to)
+			}
+			switch tt.to {
+			case GoalAbandoned:
+				if stored.AbandonedAt == nil || !stored.AbandonedAt.Equal(clock.Now()) {
+					t.Errorf("abandoned_at = %v, want %v", stored.AbandonedAt, clock.Now())
+				}
+			case GoalArchived:
+				if stored.ArchivedAt == nil || !stored.ArchivedAt.Equal(clock.Now()) {
+					t.Errorf("archived_at = %v, want %v", stored.ArchivedAt, clock.Now())
+				}
+			}
+		})
+	}
+}
+
+func TestApplyRoundupCaps(t *testing.T) {
+	// testStart is a Sunday, so the week began on Monday 23 February
+	history := []RoundupEvent{
+		{Amount: 40, CreatedAt: time.Date(2026, 2, 20, 9, 0, 0, 0, time.UTC)}, // last month, last week
+		{Amount: 30, CreatedAt: time.Date(2026, 2, 24, 9, 0, 0, 0, time.UTC)}, // this week
+		{Amount: 20, CreatedAt: time.Date(2026, 3, 1, 9, 0, 0, 0, time.UTC)},  // today
+	}
+
+	tests := []struct {
+		name       string
+		caps       func(p *UserPreferences)
+		wantAmount float64
+		wantReason string
+	}{
+		{"no caps", func(p *UserPreferences) {}, 45, ""},
+		{"transaction cap", func(p *UserPreferences) { p.TransactionRoundupCap = 25 }, 25, CapTransaction},
+		{"daily cap counts today only", func(p *UserPreferences) { p.DailyRoundupCap = 50 }, 30, CapDaily},
+		{"weekly cap counts since Monday", func(p *UserPreferences) { p.WeeklyRoundupCap = 60 }, 10, CapWeekly},
+		{"monthly cap counts since the 1st", func(p *UserPreferences) { p.MonthlyRoundupCap = 50 }, 30, CapMonthly},
+		{"spent cap allows nothing", func(p *UserPreferences) { p.DailyRoundupCap = 20 }, 0, CapDaily},
+		{"tightest cap wins", func(p *UserPreferences) { p.TransactionRoundupCap = 40; p.WeeklyRoundupCap = 60 }, 10, CapWeekly},
+		{"loose caps leave it alone", func(p *UserPreferences) { p.DailyRoundupCap = 100; p.MonthlyRoundupCap = 100 }, 45, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p UserPreferences
+			tt.caps(&p)
+
+			amount, reason := applyRoundupCaps(45, p, history, testStart)
+			assertClose(t, "roundup", amount, tt.wantAmount)
+			if reason != tt.wantReason {
+				t.Errorf("cap reason = %q, want %q", reason, tt.wantReason)
+			}
+		})
+	}
+}
+
+func TestProcessRoundupRecordsCap(t *testing.T) {
+	service, _, goalRepo := newTestService(testGoal("trip", 1000, testStart.Add(10*24*time.Hour)))
+	service.userRepo.(*fakeUserRepo).user.Preferences.TransactionRoundupCap = 20
+
+	roundup, _, _, err := service.ProcessRoundup("user-1", testTransaction(300))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 45 at full pressure, held to 20
+	assertClose(t, "roundup", roundup, 20)
+	assertClose(t, "goal savings", goalRepo.goals[0].CurrentSavings, 20)
+
+	saved := service.repo.(*fakeTransactionRepo).saved[0]
+	assertClose(t, "capped amount", saved.RoundupCapped, 25)
+	if saved.CapReason != CapTransaction {
+		t.Errorf("cap reason = %q, want %q", saved.CapReason, CapTransaction)
+	}
+}
+
+func TestCategoryMultiplierScalesBeforePressureAndCaps(t *testing.T) {
+	goals := []Goal{testGoal("trip", 1000, testStart.Add(100*24*time.Hour))}
+	prefs := UserPreferences{
+		GoalAllocation:      AllocationWeight,
+		CategoryMultipliers: map[string]float64{"Dining & Food": 2, "Groceries": 0.5},
+	}
+
+	dining := calculateRoundup(testTransaction(300), prefs, nil, 1, goals, 10, testStart, DefaultRoundupParams)
+	assertClose(t, "dining multiplier", dining.CategoryMultiplier, 2)
+	assertClose(t, "dining base roundup", dining.BaseRoundup, 30)
+	assertClose(t, "dining roundup", dining.Roundup, 30*dining.Pressure)
+
+	groceries := testTransaction(300)
+	groceries.Category = "Groceries"
+	breakdown := calculateRoundup(groceries, prefs, nil, 1, nil, 0, testStart, DefaultRoundupParams)
+	assertClose(t, "groceries base roundup", breakdown.BaseRoundup, 7.5)
+
+	transport := testTransaction(300)
+	transport.Category = "Transportation"
+	breakdown = calculateRoundup(transport, prefs, nil, 1, nil, 0, testStart, DefaultRoundupParams)
+	assertClose(t, "default multiplier", breakdown.CategoryMultiplier, 1)
+
+	// caps apply to the multiplied amount
+	prefs.TransactionRoundupCap = 20
+	breakdown = calculateRoundup(testTransaction(300), prefs, nil, 1, nil, 0, testStart, DefaultRoundupParams)
+	assertClose(t, "uncapped roundup", breakdown.UncappedRoundup, 30)
+	assertClose(t, "capped roundup", breakdown.Roundup, 20)
+}
+
+func TestNormalizeCategoryMultipliers(t *testing.T) {
+	normalized, err := normalizeCategoryMultipliers(map[string]float64{"dining & food": 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertClose(t, "multiplier", normalized["Dining & Food"], 2)
+
+	for _, invalid := range []map[string]float64{
+		{"Gambling": 2},
+		{"Groceries": -1},
+		{"Groceries": MaxCategoryMultiplier + 1},
+		{"Groceries": 1, "groceries": 2},
+	} {
+		if _, err := normalizeCategoryMultipliers(invalid); err == nil {
+			t.Errorf("expected %v to be rejected", invalid)
+		}
+	}
+}
+
+func TestReplayTransactionsFundsGoalsFromTheirCreation(t *testing.T) {
+	trip := testGoal("trip", 10000, testStart.Add(60*24*time.Hour))
+	trip.CreatedAt = testStart
+	dropped := testGoal("bike", 10000, testStart.Add(60*24*time.Hour))
+	dropped.Status = GoalAbandoned
+
+	before := testTransaction(500)
+	before.CreatedAt = testStart.Add(-24 * time.Hour)
+	after := testTransaction(500)
+	after.ID = "txn-2"
+	after.CreatedAt = testStart.Add(24 * time.Hour)
+
+	// given out of order, replayed by date
+	prefs := UserPreferences{GoalAllocation: AllocationWeight}
+	result := replayTransactions([]Transaction{after, before}, prefs, []Goal{trip, dropped}, DefaultRoundupParams)
+
+	if len(result.Goals) != 1 || result.Goals[0].Name != "trip" {
+		t.Fatalf("goals = %+v, want only the trip", result.Goals)
+	}
+	if len(result.Transactions) != 2 || !result.Transactions[0].Date.Equal(before.CreatedAt) {
+		t.Fatalf("transactions = %+v, want both in date order", result.Transactions)
+	}
+	if result.Transactions[1].Roundup <= 0 {
+		t.Fatalf("roundup after the goal was created = %.2f, want some", result.Transactions[1].Roundup)
+	}
+	// the first roundup came before the goal existed
+	assertClose(t, "trip saved", result.Goals[0].Saved, result.Transactions[1].Roundup)
+}
+
+func TestAllocateRoundup(t *testing.T) {
+	goal := func(id string, amount, savings float64, priority int, weight float64) Goal {
+		g := testGoal(id, amount, testStart.Add(100*24*time.Hour))
+		g.CurrentSavings = savings
+		g.Priority = priority
+		g.Weight = weight
+		return g
+	}
+
+	tests := []struct {
+		name     string
+		strategy string
+		roundup  float64
+		goals    []Goal
+		want     map[string]float64
+	}{
+		{"priority fills the first goal", AllocationPriority, 30,
+			[]Goal{goal("a", 100, 0, 0, 1), goal("b", 100, 0, 1, 1)}, map[string]float64{"a": 30}},
+		{"priority spills into the next goal", AllocationPriority, 30,
+			[]Goal{goal("a", 100, 80, 0, 1), goal("b", 100, 0, 1, 1)}, map[string]float64{"a": 20, "b": 10}},
+		{"priority goes by number, not order", AllocationPriority, 30,
+			[]Goal{goal("b", 100, 0, 1, 1), goal("a", 100, 0, 0, 1)}, map[string]float64{"a": 30}},
+		{"priority skips funded goals", AllocationPriority, 30,
+			[]Goal{goal("a", 100, 100, 0, 1), goal("b", 100, 0, 1, 1)}, map[string]float64{"b": 30}},
+		{"weight splits by weight", AllocationWeight, 40,
+			[]Goal{goal("a", 100, 0, 0, 1), goal("b", 100, 0, 0, 3)}, map[string]float64{"a": 10, "b": 30}},
+		{"zero weights count as one", AllocationWeight, 40,
+			[]Goal{goal("a", 100, 0, 0, 0), goal("b", 100, 0, 0, 0)}, map[string]float64{"a": 20, "b": 20}},
+		{"weight re-splits what a nearly funded goal can't take", AllocationWeight, 40,
+			[]Goal{goal("a", 100, 95, 0, 1), goal("b", 100, 0, 0, 1), goal("c", 100, 0, 0, 2)},
+			map[string]float64{"a": 5, "b": 35.0 / 3, "c": 70.0 / 3}},
+		{"weight skips funded goals", AllocationWeight, 20,
+			[]Goal{goal("a", 100, 100, 0, 1), goal("b", 100, 0, 0, 1)}, map[string]float64{"b": 20}},
+		{"no goal gets more than it needs", AllocationWeight, 40,
+			[]Goal{goal("a", 100, 90, 0, 1), goal("b", 100, 90, 0, 3)}, map[string]float64{"a": 10, "b": 10}},
+		{"no goal gets more than it needs by priority", AllocationPriority, 40,
+			[]Goal{goal("a", 100, 90, 0, 1), goal("b", 100, 90, 1, 1)}, map[string]float64{"a": 10, "b": 10}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := map[string]float64{}
+			for _, allocation := range allocateRoundup(tt.roundup, tt.goals, tt.strategy) {
+				got[allocation.GoalID] += allocation.Amount
+			}
+			if len(got) != len(tt.want) {
+				t.Errorf("allocations = %v, want %v", got, tt.want)
+			}
+			for id, want := range tt.want {
+				assertClose(t, id, got[id], want)
+			}
+		})
+	}
+}
+
+func TestDeleteGoalHandlerKeepsFundedGoals(t *testing.T) {
+	funded := testGoal("trip", 1000, testStart.Add(30*24*time.Hour))
+	funded.CurrentSavings = 10
+	empty := testGoal("fund", 1000, testStart.Add(30*24*time.Hour))
+
+	service, _, goalRepo := newTestService(funded, empty)
+	previous := txnService
+	txnService = service
+	defer func() { txnService = previous }()
+
+	gin.SetMode(gin.TestMode)
+	for _, tt := range []struct {
+		id   string
+		want int
+	}{{"trip", http.StatusConflict}, {"fund", http.StatusOK}} {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodDelete, "/goals/"+tt.id, nil)
+		c.Params = gin.Params{{Key: "id", Value: tt.id}}
+		c.Set("userID", "user-1")
+
+		deleteGoalHandler(c)
+		if w.Code != tt.want {
+			t.Errorf("deleting %s: status = %d, want %d", tt.id, w.Code, tt.want)
+		}
+	}
+
+	if len(goalRepo.goals) != 1 || goalRepo.goals[0].ID != "trip" {
+		t.Errorf("goals left = %+v, want only the funded one", goalRepo.goals)
+	}
+}
+
+func TestRoundupDatesCountsSplitRoundupsOnce(t *testing.T) {
+	goals := []Goal{testGoal("trip", 1000, testStart.Add(100*24*time.Hour)), testGoal("fund", 1000, testStart.Add(100*24*time.Hour))}
+	allocations := allocateRoundup(20, goals, AllocationWeight)
+
+	events := roundupEvents("user-1", "txn-1", 20, allocations, testStart)
+	events = append(events, roundupEvents("user-1", "txn-2", 5, nil, testStart.Add(time.Hour))...)
+
+	if len(events) != 3 {
+		t.Fatalf("got %d events, want one per goal plus one without a goal", len(events))
+	}
+	assertClose(t, "total", roundupTotalSince(events, testStart), 25)
+
+	dates := roundupDates(events)
+	if len(dates) != 2 {
+		t.Errorf("got %d roundup dates, want 2", len(dates))
+	}
+}
+
+func TestRoundupHistoryStartCoversCapPeriods(t *testing.T) {
+	// a Sunday on the 1st: the recent period reaches back past both the Monday and the 1st
+	assertTime(t, roundupHistoryStart(testStart, RecentPeriodDays), testStart.Add(-7*24*time.Hour))
+
+	// mid-month Wednesday: the month started two weeks ago
+	mid := time.Date(2026, 3, 18, 12, 0, 0, 0, time.UTC)
+	assertTime(t, roundupHistoryStart(mid, RecentPeriodDays), time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC))
+}
+
+func assertTime(t *testing.T, got, want time.Time) {
+	t.Helper()
+	if !got.Equal(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestCheckBudgetReportsTheTransactionThatCrossesTheLimit(t *testing.T) {
+	service, _, _ := newTestService()
+	service.budgetRepo.(*fakeBudgetRepo).budgets = []Budget{{ID: "budget-1", UserID: "user-1", Category: "Dining & Food", MonthlyLimit: 1000}}
+	repo := service.repo.(*fakeTransactionRepo)
+
+	// last month's spending doesn't count
+	repo.saved = append(repo.saved, Transaction{Category: "Dining & Food", Amount: 5000, CreatedAt: testStart.Add(-24 * time.Hour)})
+	repo.saved = append(repo.saved, Transaction{Category: "Dining & Food", Amount: 800, CreatedAt: testStart})
+
+	status, exceeded, err := service.CheckBudget("user-1", testTransaction(150))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if status == nil || status.Overspent || exceeded {
+		t.Fatalf("status = %+v, exceeded = %v, want within budget", status, exceeded)
+	}
+	assertClose(t, "spent", status.Spent, 950)
+	assertClose(t, "remaining", status.Remaining, 50)
+
+	status, exceeded, _ = service.CheckBudget("user-1", testTransaction(300))
+	if !status.Overspent || !exceeded {
+		t.Errorf("status = %+v, exceeded = %v, want this transaction to exceed the budget", status, exceeded)
+	}
+
+	// once over, later transactions are overspent but didn't cross the limit themselves
+	repo.saved = append(repo.saved, Transaction{Category: "Dining & Food", Amount: 300, CreatedAt: testStart})
+	status, exceeded, _ = service.CheckBudget("user-1", testTransaction(10))
+	if !status.Overspent || exceeded {
+		t.Errorf("status = %+v, exceeded = %v, want overspent without crossing", status, exceeded)
+	}
+
+	status, _, _ = service.CheckBudget("user-1", Transaction{Category: "Groceries", Amount: 10})
+	if status != nil {
+		t.Errorf("status = %+v, want nil for a category without a budget", status)
+	}
+}
+
+func TestBudgetPenaltyGrowsWithOverspend(t *testing.T) {
+	budget := Budget{Category: "Dining & Food", MonthlyLimit: 1000}
+
+	assertClose(t, "within budget", budgetPenalty(budgetStatus(budget, 900, testStart)), 1)
+	assertClose(t, "50% over", budgetPenalty(budgetStatus(budget, 1500, testStart)), 1.5)
+	assertClose(t, "far over", budgetPenalty(budgetStatus(budget, 10000, testStart)), MaxBudgetPenalty)
+}
+
+func TestProcessRoundupItemisesBudgetPenalty(t *testing.T) {
+	service, _, _ := newTestService()
+	service.userRepo.(*fakeUserRepo).user.Preferences.BudgetPenalty = true
+	service.budgetRepo.(*fakeBudgetRepo).budgets = []Budget{{ID: "budget-1", UserID: "user-1", Category: "Dining & Food", MonthlyLimit: 1000}}
+	repo := service.repo.(*fakeTransactionRepo)
+	repo.saved = append(repo.saved, Transaction{Category: "Dining & Food", Amount: 1200, CreatedAt: testStart})
+
+	roundup, _, _, err := service.ProcessRoundup("user-1", testTransaction(300))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 1500 spent on a 1000 budget gives a 1.5 penalty on the base roundup of 15
+	assertClose(t, "roundup", roundup, 22.5)
+	saved := repo.saved[len(repo.saved)-1]
+	assertClose(t, "penalty roundup", saved.PenaltyRoundup, 7.5)
+	assertClose(t, "budget penalty", saved.RoundupBreakdown.BudgetPenalty, 1.5)
+}
+
+func TestBudgetPenaltyOnlyCountsWhatCapsAllow(t *testing.T) {
+	prefs := UserPreferences{TransactionRoundupCap: 18}
+
+	breakdown := calculateRoundup(testTransaction(300), prefs, nil, 2, nil, 0, testStart, DefaultRoundupParams)
+
+	// 15 without the penalty, 30 with it, but the cap keeps it to 18
+	assertClose(t, "roundup", breakdown.Roundup, 18)
+	assertClose(t, "penalty roundup", breakdown.PenaltyRoundup, 3)
+}
+
+func TestDetectSubscriptions(t *testing.T) {
+	payment := func(merchant string, amount float64, at time.Time) Transaction {
+		return Transaction{Merchant: merchant, Amount: amount, Category: "Subscriptions & Memberships", CreatedAt: at}
+	}
+	date := func(year int, month time.Month, day int) time.Time {
+		return time.Date(year, month, day, 10, 0, 0, 0, time.UTC)
+	}
+
+	transactions := []Transaction{
+		// monthly streaming, a day or two off each time and a price rise in between
+		payment("stream@upi", 499, date(2025, 11, 3)),
+		payment("stream@upi", 499, date(2025, 12, 4)),
+		payment("stream@upi", 549, date(2026, 1, 2)),
+		payment("stream@upi", 549, date(2026, 2, 3)),
+		// weekly, but one-off large purchases at the same merchant are left out
+		payment("gym@upi", 300, testStart.Add(-21*24*time.Hour)),
+		payment("gym@upi", 300, testStart.Add(-14*24*time.Hour)),
+		payment("gym@upi", 2500, testStart.Add(-10*24*time.Hour)),
+		payment("gym@upi", 310, testStart.Add(-7*24*time.Hour)),
+		// irregular
+		payment("cafe@upi", 200, testStart.Add(-20*24*time.Hour)),
+		payment("cafe@upi", 210, testStart.Add(-17*24*time.Hour)),
+		payment("cafe@upi", 190, testStart.Add(-2*24*time.Hour)),
+		// regular but stopped months ago
+		payment("old@upi", 99, date(2025, 7, 1)),
+		payment("old@upi", 99, date(2025, 8, 1)),
+		payment("old@upi", 99, date(2025, 9, 1)),
+	}
+
+	subs := detectSubscriptions(transactions, testStart)
+	if len(subs) != 2 {
+		t.Fatalf("got %d subscriptions, want 2: %+v", len(subs), subs)
+	}
+
+	gym, stream := subs[0], subs[1]
+	if gym.Merchant != "gym@upi" || gym.Cadence != CadenceWeekly || gym.Payments != 3 {
+		t.Errorf("gym = %+v, want 3 weekly payments", gym)
+	}
+	assertClose(t, "gym monthly cost", gym.MonthlyCost, 1343.33)
+	assertTime(t, gym.NextExpected, testStart)
+
+	if stream.Merchant != "stream@upi" || stream.Cadence != CadenceMonthly || stream.Payments != 4 {
+		t.Errorf("stream = %+v, want 4 monthly payments", stream)
+	}
+	assertClose(t, "stream amount", stream.Amount, 549)
+	assertTime(t, stream.NextExpected, date(2026, 3, 3))
+}
+
+type fakeSubscriptionRepo struct {
+	SubscriptionRepository
+	subs       []Subscription
+	lapsedFrom map[string]string
+}
+
+// UpsertSubscription keeps the stored status like the database does, except that lapsed ones come back
+func (r *fakeSubscriptionRepo) UpsertSubscription(sub Subscription) error {
+	for i := range r.subs {
+		if r.subs[i].Merchant == sub.Merchant && r.subs[i].Cadence == sub.Cadence {
+			if r.subs[i].Status != SubscriptionLapsed {
+				sub.Status = r.subs[i].Status
+			} else if r.lapsedFrom[r.subs[i].ID] == SubscriptionConfirmed {
+				sub.Status = SubscriptionConfirmed
+			}
+			sub.ID = r.subs[i].ID
+			r.subs[i] = sub
+			return nil
+		}
+	}
+	r.subs = append(r.subs, sub)
+	return nil
+}
+
+func (r *fakeSubscriptionRepo) GetSubscriptionsByUserID(userID string) ([]Subscription, error) {
+	subs := make([]Subscription, len(r.subs))
+	copy(subs, r.subs)
+	return subs, nil
+}
+
+func (r *fakeSubscriptionRepo) UpdateSubscriptionStatus(id, status string) error {
+	for i := range r.subs {
+		if r.subs[i].ID == id {
+			r.subs[i].Status = status
+		}
+	}
+	return nil
+}
+
+func (r *fakeSubscriptionRepo) LapseSubscription(id string) error {
+	if r.lapsedFrom == nil {
+		r.lapsedFrom = map[string]string{}
+	}
+	for i := range r.subs {
+		if r.subs[i].ID == id {
+			r.lapsedFrom[id] = r.subs[i].Status
+			r.subs[i].Status = SubscriptionLapsed
+		}
+	}
+	return nil
+}
+
+func (r *fakeTransactionRepo) GetTransactionsByUserID(userID string) ([]Transaction, error) {
+	return r.saved, nil
+}
+
+func TestDetectSubscriptionsMarksStoppedOnesLapsed(t *testing.T) {
+	service, clock, _ := newTestService()
+	txnRepo := service.repo.(*fakeTransactionRepo)
+	subRepo := &fakeSubscriptionRepo{}
+	service.subRepo = subRepo
+
+	pay := func(merchant string, daysAgo int) {
+		txnRepo.saved = append(txnRepo.saved, Transaction{Merchant: merchant, Amount: 300, CreatedAt: clock.Now().Add(-time.Duration(daysAgo) * 24 * time.Hour)})
+	}
+	for _, daysAgo := range []int{14, 7, 0} {
+		pay("gym@upi", daysAgo)
+		pay("club@upi", daysAgo)
+	}
+
+	statuses := func() map[string]string {
+		subs, err := service.DetectSubscriptions("user-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		byMerchant := map[string]string{}
+		for _, sub := range subs {
+			byMerchant[sub.Merchant] = sub.Status
+		}
+		return byMerchant
+	}
+
+	if got := statuses(); got["gym@upi"] != SubscriptionDetected || got["club@upi"] != SubscriptionDetected {
+		t.Fatalf("statuses = %v, want both detected", got)
+	}
+	for _, sub := range subRepo.subs {
+		if sub.Merchant == "club@upi" {
+			subRepo.UpdateSubscriptionStatus(sub.ID, SubscriptionDismissed)
+		}
+	}
+
+	// both stop being paid
+	clock.Advance(30 * 24 * time.Hour)
+	if got := statuses(); got["gym@upi"] != SubscriptionLapsed || got["club@upi"] != SubscriptionDismissed {
+		t.Errorf("after a missed month statuses = %v, want gym lapsed and club still dismissed", got)
+	}
+
+	// the gym payments start again
+	for _, daysAgo := range []int{14, 7, 0} {
+		pay("gym@upi", daysAgo)
+	}
+	if got := statuses(); got["gym@upi"] != SubscriptionDetected {
+		t.Errorf("after new payments statuses = %v, want gym detected again", got)
+	}
+}
+
+func TestDetectSubscriptionsKeepsConfirmationThroughALapse(t *testing.T) {
+	service, clock, _ := newTestService()
+	txnRepo := service.repo.(*fakeTransactionRepo)
+	subRepo := &fakeSubscriptionRepo{}
+	service.subRepo = subRepo
+
+	pay := func() {
+		for _, daysAgo := range []int{14, 7, 0} {
+			txnRepo.saved = append(txnRepo.saved, Transaction{Merchant: "gym@upi", Amount: 300, CreatedAt: clock.Now().Add(-time.Duration(daysAgo) * 24 * time.Hour)})
+		}
+	}
+	status := func() string {
+		subs, err := service.DetectSubscriptions("user-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(subs) != 1 {
+			t.Fatalf("got %d subscriptions, want 1", len(subs))
+		}
+		return subs[0].Status
+	}
+
+	pay()
+	status()
+	subRepo.UpdateSubscriptionStatus(subRepo.subs[0].ID, SubscriptionConfirmed)
+
+	clock.Advance(30 * 24 * time.Hour)
+	if got := status(); got != SubscriptionLapsed {
+		t.Fatalf("after a missed month status = %q, want %q", got, SubscriptionLapsed)
+	}
+
+	pay()
+	if got := status(); got != SubscriptionConfirmed {
+		t.Errorf("after new payments status = %q, want %q", got, SubscriptionConfirmed)
+	}
+}
+
+func TestDetectAnomalies(t *testing.T) {
+	usual := SpendingBaseline{CategoryCount: 30, CategoryMean: 400, CategoryStdDev: 100, HourCount: 4, TotalCount: 90, MerchantSeen: true}
+
+	tests := []struct {
+		name     string
+		amount   float64
+		baseline func(b *SpendingBaseline)
+		want     []string
+	}{
+		{"usual payment", 550, func(b *SpendingBaseline) {}, nil},
+		{"three deviations above the mean", 700, func(b *SpendingBaseline) {}, []string{AnomalyAmount}},
+		{"too little history to judge amounts", 5000, func(b *SpendingBaseline) { b.CategoryCount = 2 }, nil},
+		{"small payment to a new merchant", 300, func(b *SpendingBaseline) { b.MerchantSeen = false }, nil},
+		{"large payment to a new merchant", 40000, func(b *SpendingBaseline) { b.MerchantSeen = false }, []string{AnomalyAmount, AnomalyNewMerchant}},
+		{"hour never used before", 400, func(b *SpendingBaseline) { b.HourCount = 0 }, []string{AnomalyUnusualHour}},
+		{"too little history to judge hours", 400, func(b *SpendingBaseline) { b.HourCount = 0; b.TotalCount = 10 }, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			baseline := usual
+			tt.baseline(&baseline)
+
+			got := detectAnomalies(testTransaction(tt.amount), baseline)
+			if len(got) != len(tt.want) {
+				t.Fatalf("reasons = %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("reasons = %v, want %v", got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+// baselineTransactionRepo returns the same baseline for every transaction
+type baselineTransactionRepo struct {
+	fakeTransactionRepo
+	baseline SpendingBaseline
+}
+
+func (r *baselineTransactionRepo) GetSpendingBaseline(userID, category, merchant string, hour int, since time.Time) (*SpendingBaseline, error) {
+	baseline := r.baseline
+	return &baseline, nil
+}
+
+func TestFlagAnomaliesIgnoresClientFlags(t *testing.T) {
+	service, _, _ := newTestService()
+	service.repo = &baselineTransactionRepo{baseline: SpendingBaseline{CategoryCount: 30, CategoryMean: 400, CategoryStdDev: 100, HourCount: 4, TotalCount: 90, MerchantSeen: true}}
+
+	txn := testTransaction(450)
+	txn.Anomalous = true
+	txn.AnomalyReasons = []string{AnomalyAmount}
+
+	err := service.FlagAnomalies("user-1", &txn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if txn.Anomalous || len(txn.AnomalyReasons) != 0 {
+		t.Errorf("usual payment kept the client's flags: anomalous %v, reasons %v", txn.Anomalous, txn.AnomalyReasons)
+	}
+}
+
+func TestEventBusRetriesOnlyFailedSubscribers(t *testing.T) {
+	clock := &fakeClock{now: testStart}
+	outbox := &fakeOutboxRepo{}
+	bus := NewEventBus(outbox, clock)
+
+	var walletCalls, mailCalls int
+	bus.Subscribe(EventWalletWithdrawn, "audit", func(event Event) error {
+		walletCalls++
+		return nil
+	})
+	bus.Subscribe(EventWalletWithdrawn, "mail", func(event Event) error {
+		mailCalls++
+		if mailCalls == 1 {
+			return errors.New("smtp down")
+		}
+		if event.(WalletWithdrawn).Amount != 250 {
+			t.Errorf("retried event = %+v, want amount 250", event)
+		}
+		return nil
+	})
+
+	publish(t, bus, WalletWithdrawn{UserID: "user-1", WalletID: "wallet-1", Amount: 250, Balance: 50})
+
+	if outbox.events[0].Attempts != 1 || outbox.events[0].DispatchedAt != nil {
+		t.Fatalf("outbox event after failure = %+v, want 1 attempt and not dispatched", outbox.events[0])
+	}
+
+	// too recent to be picked up by the dispatcher
+	bus.dispatchPending()
+	if mailCalls != 1 {
+		t.Errorf("mail subscriber called %d times before the retry delay, want 1", mailCalls)
+	}
+
+	clock.now = clock.now.Add(OutboxRetryDelay + time.Second)
+	bus.dispatchPending()
+
+	if walletCalls != 1 || mailCalls != 2 {
+		t.Errorf("calls = audit %d, mail %d, want 1 and 2", walletCalls, mailCalls)
+	}
+	if outbox.events[0].DispatchedAt == nil {
+		t.Error("event not marked dispatched after the retry succeeded")
+	}
+}
+
+func TestEventBusLeavesPublishedEventsToTheirDispatch(t *testing.T) {
+	clock := &fakeClock{now: testStart}
+	outbox := &fakeOutboxRepo{}
+	bus := NewEventBus(outbox, clock)
+
+	calls := 0
+	bus.Subscribe(EventWalletCredited, "audit", func(event Event) error {
+		calls++
+		return nil
+	})
+
+	// stored, but the process stopped before dispatching it
+	_, err := bus.Publish(nil, WalletCredited{UserID: "user-1", Amount: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bus.dispatchPending()
+	if calls != 0 {
+		t.Fatalf("dispatcher took an event still leased to its publisher, %d calls", calls)
+	}
+
+	clock.Advance(OutboxLease + time.Second)
+	bus.dispatchPending()
+	bus.dispatchPending()
+	if calls != 1 {
+		t.Errorf("subscriber called %d times once the lease ran out, want 1", calls)
+	}
+}
+
+func TestInTxDispatchesOnlyCommittedEvents(t *testing.T) {
+	service, _, _ := newTestService()
+
+	var credited []float64
+	service.events.Subscribe(EventWalletCredited, "test", func(event Event) error {
+		credited = append(credited, event.(WalletCredited).Amount)
+		return nil
+	})
+
+	err := service.inTx(func(u *unitOfWork) error {
+		err := u.publish(WalletCredited{UserID: "user-1", Amount: 10})
+		if err != nil {
+			return err
+		}
+		return errors.New("wallet update failed")
+	})
+	if err == nil {
+		t.Fatal("inTx swallowed the error")
+	}
+
+	err = service.AddToWallet("user-1", 20, "Top up", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.events.Wait()
+
+	if len(credited) != 1 || credited[0] != 20 {
+		t.Errorf("credited events = %v, want only the committed 20", credited)
+	}
+}
+
+func TestRefreshGoalsPublishesGoalReached(t *testing.T) {
+	goal := testGoal("trip", 100, testStart.Add(30*24*time.Hour))
+	goal.CurrentSavings = 100
+
+	service, _, _ := newTestService(goal)
+
+	var reached []Goal
+	service.events.Subscribe(EventGoalReached, "test", func(event Event) error {
+		reached = append(reached, event.(GoalReached).Goal)
+		return nil
+	})
+
+	_, err := service.RefreshGoals("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// already achieved, so no second event
+	_, err = service.RefreshGoals("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.events.Wait()
+
+	if len(reached) != 1 || reached[0].ID != "trip" || reached[0].Status != GoalAchieved {
+		t.Errorf("goal reached events = %+v, want one for trip", reached)
+	}
+}
+
+// recordingNotifier is called from dispatch goroutines, hence the lock
+type recordingNotifier struct {
+	mu   sync.Mutex
+	sent []Notification
+}
+
+func (n *recordingNotifier) Notify(user User, notification Notification) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.sent = append(n.sent, notification)
+	return nil
+}
+
+func TestNotificationsFollowUserChannels(t *testing.T) {
+	userRepo := &fakeUserRepo{user: User{ID: "user-1", Email: "asha@example.com", Preferences: UserPreferences{
+		// no email about goals, everything else as default
+		NotificationChannels: map[string][]string{NotifyGoalReached: {ChannelInApp}, NotifyWalletWithdrawn: {ChannelInApp}},
+	}}}
+	email, inApp := &recordingNotifier{}, &recordingNotifier{}
+	clock := &fakeClock{now: testStart}
+
+	service := NewNotificationService(userRepo, map[string]Notifier{ChannelEmail: email, ChannelInApp: inApp}, clock)
+	bus := NewEventBus(&fakeOutboxRepo{}, clock)
+	service.Subscribe(bus)
+
+	publish(t, bus,
+		GoalReached{Goal: Goal{UserID: "user-1", Name: "Goa trip", Amount: 15000}},
+		WalletWithdrawn{UserID: "user-1", Amount: 6000, Balance: 1250.5},
+		WalletWithdrawn{UserID: "user-1", Amount: 500, Balance: 750.5}, // not large, so only in the inbox
+	)
+
+	if len(email.sent) != 1 || email.sent[0].Kind != NotifyLargeWithdrawal {
+		t.Fatalf("emails = %+v, want only the large withdrawal", email.sent)
+	}
+	if want := "₹6000.00 was withdrawn from your RoundUp wallet, leaving ₹1250.50. If this wasn't you, contact support right away."; email.sent[0].Body != want {
+		t.Errorf("email body = %q, want %q", email.sent[0].Body, want)
+	}
+	if len(inApp.sent) != 3 {
+		t.Fatalf("in-app notifications = %+v, want goal and both withdrawals", inApp.sent)
+	}
+	for _, n := range inApp.sent {
+		if n.Kind == NotifyGoalReached && n.Title != "You reached your Goa trip goal!" {
+			t.Errorf("goal notification title = %q", n.Title)
+		}
+	}
+}
+
+func TestNormalizeNotificationChannels(t *testing.T) {
+	got, err := normalizeNotificationChannels(map[string][]string{NotifyGoalReached: {ChannelPush, ChannelPush}, NotifyRoundupCredited: {}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got[NotifyGoalReached]) != 1 || got[NotifyRoundupCredited] == nil || len(got[NotifyRoundupCredited]) != 0 {
+		t.Errorf("normalized = %v, want push once and roundups turned off", got)
+	}
+
+	if _, err := normalizeNotificationChannels(map[string][]string{NotifyGoalReached: {"sms"}}); err == nil {
+		t.Error("expected an error for an unknown channel")
+	}
+	if _, err := normalizeNotificationChannels(map[string][]string{"birthday": {ChannelEmail}}); err == nil {
+		t.Error("expected an error for an unknown kind")
+	}
+}
+
+// fakeSMTPServer accepts one email without authentication and sends what it received on the channel
+func fakeSMTPServer(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	received := make(chan string, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		text := textproto.NewConn(conn)
+		text.PrintfLine("220 localhost ESMTP")
+		var transcript strings.Builder
+		for {
+			line, err := text.ReadLine()
+			if err != nil {
+				return
+			}
+			transcript.WriteString(line + "\n")
+
+			switch verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); verb {
+			case "EHLO", "HELO":
+				text.PrintfLine("250 localhost")
+			case "DATA":
+				text.PrintfLine("354 go ahead")
+				data, err := text.ReadDotLines()
+				if err != nil {
+					return
+				}
+				transcript.WriteString(strings.Join(data, "\n") + "\n")
+				text.PrintfLine("250 queued")
+			case "QUIT":
+				text.PrintfLine("221 bye")
+				received <- transcript.String()
+				return
+			default:
+				text.PrintfLine("250 ok")
+			}
+		}
+	}()
+
+	return listener.Addr().String(), received
+}
+
+func TestSMTPMailerSendsThroughServer(t *testing.T) {
+	addr, received := fakeSMTPServer(t)
+	t.Setenv("SMTP_ADDR", addr)
+	t.Setenv("SMTP_FROM", "RoundUp <no-reply@roundup.test>")
+
+	mailer, err := newMailer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = mailer.Send("asha@example.com", "You reached your Goa trip goal!", "Well done!\nKeep going.")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	transcript := <-received
+	for _, want := range []string{
+		"MAIL FROM:<no-reply@roundup.test>",
+		"RCPT TO:<asha@example.com>",
+		"Subject: You reached your Goa trip goal!",
+		"Well done!",
+	} {
+		if !strings.Contains(transcript, want) {
+			t.Errorf("server transcript is missing %q:\n%s", want, transcript)
+		}
+	}
+
+	if err := mailer.Send("asha@example.com\r\nBcc: x@example.com", "hi", "body"); err == nil {
+		t.Error("expected an error for a line break in a header")
+	}
+}
+
+func TestRefreshGoalsAnnouncesEachMilestoneOnce(t *testing.T) {
+	goal := testGoal("trip", 1000, testStart.Add(30*24*time.Hour))
+	goal.CurrentSavings = 300
+
+	service, _, goalRepo := newTestService(goal)
+
+	var milestones []int
+	service.events.Subscribe(EventGoalMilestone, "test", func(event Event) error {
+		milestones = append(milestones, event.(GoalMilestoneReached).Percent)
+		return nil
+	})
+
+	refresh := func(savings float64) {
+		t.Helper()
+		goalRepo.goals[0].CurrentSavings = savings
+		_, err := service.RefreshGoals("user-1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		// events are dispatched concurrently, so wait to keep them in order
+		service.events.Wait()
+	}
+
+	refresh(300) // 25%
+	refresh(400) // still 25%
+	refresh(800) // skips 50% straight to 75%
+	refresh(1000)
+
+	if len(milestones) != 2 || milestones[0] != 25 || milestones[1] != 75 {
+		t.Errorf("milestones = %v, want [25 75]", milestones)
+	}
+	if goalRepo.goals[0].Milestone != 100 {
+		t.Errorf("achieved goal milestone = %d, want 100", goalRepo.goals[0].Milestone)
+	}
+}
+
+// staleGoalRepo hands out goals as they were before another refresh saved its milestone
+type staleGoalRepo struct {
+	*fakeGoalRepo
+	stale []Goal
+}
+
+func (r *staleGoalRepo) LockGoalsByUserID(dbTx *sql.Tx, userID string) ([]Goal, error) {
+	goals := make([]Goal, len(r.stale))
+	copy(goals, r.stale)
+	return goals, nil
+}
+
+func TestRefreshGoalsLeavesMilestoneToTheRefreshThatSavedIt(t *testing.T) {
+	goal := testGoal("trip", 1000, testStart.Add(30*24*time.Hour))
+	goal.CurrentSavings = 300
+
+	service, _, goalRepo := newTestService(goal)
+	goalRepo.goals[0].Milestone = 25
+	service.goalRepo = &staleGoalRepo{fakeGoalRepo: goalRepo, stale: []Goal{goal}}
+
+	announced := 0
+	service.events.Subscribe(EventGoalMilestone, "test", func(event Event) error {
+		announced++
+		return nil
+	})
+
+	_, err := service.RefreshGoals("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	service.events.Wait()
+
+	if announced != 0 {
+		t.Errorf("milestone announced %d times by a refresh that read stale goals, want 0", announced)
+	}
+}
+
+func TestStreamHubForwardsUpdatesToConnectedUser(t *testing.T) {
+	goal := testGoal("trip", 1000, testStart.Add(30*24*time.Hour))
+	goal.CurrentSavings = 120
+	hub := NewStreamHub(&fakeGoalRepo{goals: []Goal{goal}})
+	bus := NewEventBus(&fakeOutboxRepo{}, &fakeClock{now: testStart})
+	hub.Subscribe(bus)
+
+	mine := hub.connect("user-1")
+	other := hub.connect("user-2")
+	defer hub.disconnect("user-1", mine)
+	defer hub.disconnect("user-2", other)
+
+	publish(t, bus, WalletWithdrawn{UserID: "user-1", Amount: 50, Balance: 70})
+	publish(t, bus, RoundupCredited{UserID: "user-1", Amount: 20, Allocations: []RoundupAllocation{{GoalID: "trip", Amount: 20}}})
+
+	msg := <-mine
+	if update, ok := msg.Data.(WalletUpdate); msg.Event != "wallet" || !ok || update.Balance != 70 || update.Change != -50 {
+		t.Errorf("first message = %+v, want wallet balance 70 after -50", msg)
+	}
+	msg = <-mine
+	if g, ok := msg.Data.(Goal); msg.Event != "goal" || !ok || g.ID != "trip" {
+		t.Errorf("second message = %+v, want trip goal progress", msg)
+	}
+
+	if len(other) != 0 {
+		t.Errorf("another user's stream got %d messages", len(other))
+	}
+}
+
+func TestWalletFilterDropsUpdatesOlderThanTheLastSent(t *testing.T) {
+	filter := &walletFilter{version: 4} // the snapshot sent on connect
+	wallet := func(version int64) StreamMessage {
+		return StreamMessage{Event: "wallet", Data: WalletUpdate{Balance: float64(version), Version: version}}
+	}
+
+	var sent []int64
+	for _, version := range []int64{3, 4, 6, 5, 7} {
+		if !filter.stale(wallet(version)) {
+			sent = append(sent, version)
+		}
+	}
+	if len(sent) != 2 || sent[0] != 6 || sent[1] != 7 {
+		t.Errorf("sent versions = %v, want [6 7]", sent)
+	}
+
+	if filter.stale(wallet(0)) || filter.stale(StreamMessage{Event: "goal", Data: Goal{}}) {
+		t.Error("filter dropped an unversioned update or a goal")
+	}
+}
+
+type fakeWebhookRepo struct {
+	WebhookRepository
+	mu         sync.Mutex
+	webhooks   []Webhook
+	deliveries []WebhookDelivery
+}
+
+func (r *fakeWebhookRepo) GetWebhookByID(id string) (*Webhook, error) {
+	for _, w := range r.webhooks {
+		if w.ID == id {
+			return &w, nil
+		}
+	}
+	return nil, errors.New("not found")
+}
+
+func (r *fakeWebhookRepo) GetWebhooksByUserID(userID string) ([]Webhook, error) {
+	var owned []Webhook
+	for _, w := range r.webhooks {
+		if w.UserID == userID {
+			owned = append(owned, w)
+		}
+	}
+	return owned, nil
+}
+
+func (r *fakeWebhookRepo) GetDeliveriesByUserID(userID string) ([]WebhookDelivery, error) {
+	var deliveries []WebhookDelivery
+	for _, d := range r.deliveries {
+		if d.UserID == userID {
+			deliveries = append(deliveries, d)
+		}
+	}
+	return deliveries, nil
+}
+
+func (r *fakeWebhookRepo) GetSubscribedWebhooks(userID, eventType string) ([]Webhook, error) {
+	var subscribed []Webhook
+	for _, w := range r.webhooks {
+		if w.Active && (w.UserID == userID || w.UserID == TenantWebhookOwner) && isWebhookEventTypeIn(w.EventTypes, eventType) {
+			subscribed = append(subscribed, w)
+		}
+	}
+	return subscribed, nil
+}
+
+func isWebhookEventTypeIn(eventTypes []string, eventType string) bool {
+	for _, t := range eventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *fakeWebhookRepo) AddDelivery(delivery WebhookDelivery) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, d := range r.deliveries {
+		if d.WebhookID == delivery.WebhookID && d.EventID == delivery.EventID && d.ReplayOf == nil && delivery.ReplayOf == nil {
+			return false, nil
+		}
+	}
+	r.deliveries = append(r.deliveries, delivery)
+	return true, nil
+}
+
+func (r *fakeWebhookRepo) ClaimDueDeliveries(now, leaseUntil time.Time, limit int) ([]WebhookDelivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var due []WebhookDelivery
+	for i := range r.deliveries {
+		d := &r.deliveries[i]
+		if d.Status == DeliveryPending && d.NextAttemptAt != nil && !d.NextAttemptAt.After(now) {
+			d.NextAttemptAt = &leaseUntil
+			due = append(due, *d)
+		}
+	}
+	return due, nil
+}
+
+func (r *fakeWebhookRepo) UpdateDelivery(delivery WebhookDelivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for i := range r.deliveries {
+		if r.deliveries[i].ID == delivery.ID {
+			r.deliveries[i] = delivery
+		}
+	}
+	return nil
+}
+
+type fakeDeviceRepo struct {
+	NotificationRepository
+	tokens []string
+}
+
+func (r *fakeDeviceRepo) GetDeviceTokens(userID string) ([]string, error) {
+	return r.tokens, nil
+}
+
+func (r *fakeDeviceRepo) DeleteDevice(userID, token string) error {
+	for i, existing := range r.tokens {
+		if existing == token {
+			r.tokens = append(r.tokens[:i], r.tokens[i+1:]...)
+			return nil
+		}
+	}
+	return sql.ErrNoRows
+}
+
+func TestPushNotifierTriesEveryDevice(t *testing.T) {
+	var mu sync.Mutex
+	var sentTo []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var msg pushMessage
+		json.NewDecoder(r.Body).Decode(&msg)
+		mu.Lock()
+		sentTo = append(sentTo, msg.To)
+		mu.Unlock()
+
+		switch msg.To {
+		case "uninstalled":
+			fmt.Fprint(w, `{"failure":1,"results":[{"error":"NotRegistered"}]}`)
+		case "flaky":
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			fmt.Fprint(w, `{"success":1,"results":[{"message_id":"1"}]}`)
+		}
+	}))
+	defer server.Close()
+
+	devices := &fakeDeviceRepo{tokens: []string{"uninstalled", "flaky", "phone"}}
+	notifier := &PushNotifier{url: server.URL, client: server.Client(), devices: devices}
+	notification := Notification{ID: "n-1", Kind: NotifyGoalReached, Title: "Goal reached", Body: "Well done"}
+
+	err := notifier.Notify(User{ID: "user-1"}, notification)
+	if err != nil {
+		t.Fatalf("Notify failed although one device got the push: %v", err)
+	}
+	if len(sentTo) != 3 {
+		t.Errorf("pushed to %v, want every device", sentTo)
+	}
+	if len(devices.tokens) != 2 || devices.tokens[0] != "flaky" {
+		t.Errorf("tokens after push = %v, want the unregistered one removed", devices.tokens)
+	}
+
+	// with nothing delivered the failure is reported, so the push is retried
+	devices.tokens = []string{"flaky"}
+	err = notifier.Notify(User{ID: "user-1"}, notification)
+	if err == nil {
+		t.Error("Notify succeeded although no device got the push")
+	}
+}
+
+func TestWebhookDeliveriesAreSignedAndRetried(t *testing.T) {
+	var mu sync.Mutex
+	var requests []*http.Request
+	var bodies [][]byte
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, r)
+		bodies = append(bodies, body)
+		if len(requests) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	clock := &fakeClock{now: testStart}
+	repo := &fakeWebhookRepo{webhooks: []Webhook{
+		{ID: "hook-1", UserID: "user-1", URL: server.URL, Secret: "whsec_test", EventTypes: []string{EventRoundupCredited}, Active: true},
+		{ID: "hook-2", UserID: "user-2", URL: server.URL, Secret: "whsec_other", EventTypes: []string{EventRoundupCredited}, Active: true},
+	}}
+	service := NewWebhookService(repo, server.Client(), clock)
+	bus := NewEventBus(&fakeOutboxRepo{}, clock)
+	service.Subscribe(bus)
+
+	publish(t, bus, RoundupCredited{UserID: "user-1", TransactionID: "txn-1", Amount: 12.5})
+
+	if len(repo.deliveries) != 1 {
+		t.Fatalf("deliveries = %+v, want one for user-1's webhook", repo.deliveries)
+	}
+	d := repo.deliveries[0]
+	if d.Status != DeliveryPending || d.Attempts != 1 || d.ResponseStatus != http.StatusServiceUnavailable || d.UserID != "user-1" {
+		t.Fatalf("delivery after failure = %+v", d)
+	}
+	if want := clock.Now().Add(WebhookBaseBackoff); !d.NextAttemptAt.Equal(want) {
+		t.Errorf("next attempt = %v, want %v", d.NextAttemptAt, want)
+	}
+
+	clock.now = clock.now.Add(WebhookBaseBackoff)
+	service.retryDue()
+
+	d = repo.deliveries[0]
+	if d.Status != DeliverySucceeded || d.Attempts != 2 || d.DeliveredAt == nil {
+		t.Errorf("delivery after retry = %+v, want succeeded on the second attempt", d)
+	}
+
+	if len(requests) != 2 || string(bodies[0]) != string(bodies[1]) {
+		t.Fatalf("got %d requests, want the same body twice", len(requests))
+	}
+	last := requests[1]
+	if want := signWebhook("whsec_test", clock.Now().Unix(), bodies[1]); last.Header.Get("X-Roundup-Signature") != want {
+		t.Errorf("signature = %q, want %q", last.Header.Get("X-Roundup-Signature"), want)
+	}
+
+	var envelope webhookEnvelope
+	err := json.Unmarshal(bodies[1], &envelope)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var data RoundupCredited
+	err = json.Unmarshal(envelope.Data, &data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if envelope.Type != EventRoundupCredited || envelope.UserID != "user-1" || data.Amount != 12.5 {
+		t.Errorf("envelope = %+v with data %+v", envelope, data)
+	}
+}
+
+func TestWebhookClientOnlyReachesPublicAddresses(t *testing.T) {
+	redirected := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/moved" {
+			redirected = true
+			return
+		}
+		http.Redirect(w, r, "/moved", http.StatusFound)
+	}))
+	defer server.Close()
+
+	_, err := newWebhookClient(false).Post(server.URL, "application/json", nil)
+	if err == nil || !strings.Contains(err.Error(), "not public") {
+		t.Errorf("post to loopback = %v, want it refused", err)
+	}
+
+	// the development flag lets loopback through, but redirects are still not followed
+	resp, err := newWebhookClient(true).Post(server.URL, "application/json", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound || redirected {
+		t.Errorf("status = %d, redirected = %v, want the 302 itself", resp.StatusCode, redirected)
+	}
+
+	for _, addr := range []string{"10.0.0.8", "192.168.1.1", "169.254.169.254", "0.0.0.0", "fd00::1", "fe80::1"} {
+		if webhookAddressAllowed(net.ParseIP(addr), true) {
+			t.Errorf("%s allowed", addr)
+		}
+	}
+	if !webhookAddressAllowed(net.ParseIP("93.184.216.34"), false) {
+		t.Error("public address refused")
+	}
+
+	if validateWebhookURL("http://localhost:8080/hook", false) == nil {
+		t.Error("http to localhost accepted without the development flag")
+	}
+	if err := validateWebhookURL("http://localhost:8080/hook", true); err != nil {
+		t.Errorf("http to localhost with the development flag: %v", err)
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	cases := map[int]time.Duration{
+		1:  30 * time.Second,
+		2:  time.Minute,
+		5:  8 * time.Minute,
+		9:  128 * time.Minute,
+		10: 256 * time.Minute,
+		20: WebhookMaxBackoff,
+	}
+	for attempts, want := range cases {
+		if got := webhookBackoff(attempts); got != want {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", attempts, got, want)
+		}
+	}
+}
+
+// writeKeyPEM stores a key the way loadKeySet expects to find it and returns the path
+func writeKeyPEM(t *testing.T, name, blockType string, der []byte) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: blockType, Bytes: der}), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// testKeySet loads an RSA signing key and returns it with the PEM of its public half
+func testKeySet(t *testing.T, kid string) (*KeySet, []byte) {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pub, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Setenv("JWT_PRIVATE_KEY_FILE", writeKeyPEM(t, kid+".pem", "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key)))
+	t.Setenv("JWT_KEY_ID", kid)
+	ks, err := loadKeySet()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ks, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub})
+}
+
+func parseTestToken(ks *KeySet, token string) (*CustomClaims, error) {
+	claims := &CustomClaims{}
+	_, err := jwt.ParseWithClaims(token, claims, ks.keyFunc, jwt.WithValidMethods(ks.validMethods()))
+	return claims, err
+}
+
+func testClaims() CustomClaims {
+	return CustomClaims{
+		UserID:           "user-1",
+		Role:             RoleUser,
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour))},
+	}
+}
+
+func TestKeySetRejectsUnknownKid(t *testing.T) {
+	ks, _ := testKeySet(t, "current")
+
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, testClaims())
+	token.Header["kid"] = "retired"
+	signed, err := token.SignedString(ks.signingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := parseTestToken(ks, signed); err == nil {
+		t.Error("token with an unknown kid was accepted")
+	}
+
+	token = jwt.NewWithClaims(jwt.SigningMethodRS256, testClaims())
+	signed, err = token.SignedString(ks.signingKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseTestToken(ks, signed); err == nil {
+		t.Error("token without a kid was accepted")
+	}
+}
+
+func TestKeySetRejectsUnexpectedAlg(t *testing.T) {
+	ks, publicPEM := testKeySet(t, "current")
+
+	// the classic confusion: HMAC "signed" with the public key, which anyone can fetch from the JWKS
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, testClaims())
+	token.Header["kid"] = "current"
+	signed, err := token.SignedString(publicPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseTestToken(ks, signed); err == nil {
+		t.Error("HS256 token signed with the public key was accepted")
+	}
+
+	// keyFunc refuses on its own too, in case the allowed methods are ever widened
+	if _, err := ks.keyFunc(token); err == nil {
+		t.Error("keyFunc returned a key for an HS256 token")
+	}
+
+	// an algorithm that is allowed, but not the one the kid's key is for
+	edPub, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ks.addVerificationKey("ed", jwt.SigningMethodEdDSA, edPub)
+	token = jwt.NewWithClaims(jwt.SigningMethodEdDSA, testClaims())
+	token.Header["kid"] = "current"
+	signed, err = token.SignedString(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseTestToken(ks, signed); err == nil {
+		t.Error("EdDSA token naming an RSA key was accepted")
+	}
+}
+
+// accessUserRepo holds several users for the role and freeze checks
+type accessUserRepo struct {
+	UserRepository
+	users map[string]*User
+}
+
+func (r *accessUserRepo) GetAccess(userID string) (string, bool, error) {
+	user, ok := r.users[userID]
+	if !ok {
+		return "", false, sql.ErrNoRows
+	}
+	return user.Role, user.Frozen, nil
+}
+
+func (r *accessUserRepo) SetFrozen(userID string, frozen bool) error {
+	user, ok := r.users[userID]
+	if !ok {
+		return sql.ErrNoRows
+	}
+	user.Frozen = frozen
+	return nil
+}
+
+func testAccessService(t *testing.T) *accessUserRepo {
+	users := &accessUserRepo{users: map[string]*User{
+		"admin-1": {ID: "admin-1", Role: RoleAdmin},
+		"admin-2": {ID: "admin-2", Role: RoleAdmin},
+		"user-1":  {ID: "user-1", Role: RoleUser},
+		"frozen":  {ID: "frozen", Role: RoleUser, Frozen: true},
+	}}
+	service, _, _ := newTestService()
+	service.userRepo = users
+
+	previous := txnService
+	txnService = service
+	t.Cleanup(func() { txnService = previous })
+	gin.SetMode(gin.TestMode)
+	return users
+}
+
+func TestRequireRole(t *testing.T) {
+	tests := []struct {
+		name string
+		role interface{}
+		want int
+	}{
+		{"no role", nil, http.StatusUnauthorized},
+		{"user", RoleUser, http.StatusForbidden},
+		{"admin", RoleAdmin, http.StatusOK},
+		{"not a string", 1, http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			if tt.role != nil {
+				c.Set("role", tt.role)
+			}
+			c.Status(http.StatusOK)
+
+			requireRole(RoleAdmin)(c)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d", w.Code, tt.want)
+			}
+			if c.IsAborted() == (tt.want == http.StatusOK) {
+				t.Errorf("aborted = %v with status %d", c.IsAborted(), w.Code)
+			}
+		})
+	}
+}
+
+func TestAuthMiddlewareChecksRoleAndFreezeInTheDatabase(t *testing.T) {
+	testAccessService(t)
+	ks, _ := testKeySet(t, "current")
+	previous := keySet
+	keySet = ks
+	defer func() { keySet = previous }()
+
+	router := gin.New()
+	router.GET("/admin", authMiddleware(), requireRole(RoleAdmin), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	sign := func(userID, role string) string {
+		claims := testClaims()
+		claims.UserID = userID
+		claims.Role = role
+		token, err := ks.Sign(claims)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+
+	tests := []struct {
+		name  string
+		token string
+		want  int
+	}{
+		{"no token", "", http.StatusUnauthorized},
+		{"bad token", "not-a-token", http.StatusUnauthorized},
+		{"admin", sign("admin-1", RoleAdmin), http.StatusOK},
+		{"user claiming admin", sign("user-1", RoleAdmin), http.StatusForbidden},
+		{"frozen", sign("frozen", RoleUser), http.StatusForbidden},
+		{"deleted user", sign("gone", RoleAdmin), http.StatusUnauthorized},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/admin", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", tt.token)
+			}
+			router.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+		})
+	}
+}
+
+func TestAdminFreezeUserHandler(t *testing.T) {
+	tests := []struct {
+		name       string
+		target     string
+		body       string
+		want       int
+		wantFrozen bool
+	}{
+		{"freeze a user", "user-1", `{"frozen": true}`, http.StatusOK, true},
+		{"unfreeze a user", "frozen", `{"frozen": false}`, http.StatusOK, false},
+		{"freeze yourself", "admin-1", `{"frozen": true}`, http.StatusBadRequest, false},
+		{"freeze another admin", "admin-2", `{"frozen": true}`, http.StatusForbidden, false},
+		{"unknown user", "gone", `{"frozen": true}`, http.StatusNotFound, false},
+		{"missing frozen", "user-1", `{}`, http.StatusBadRequest, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			users := testAccessService(t)
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest(http.MethodPut, "/admin/users/"+tt.target+"/freeze", strings.NewReader(tt.body))
+			c.Request.Header.Set("Content-Type", "application/json")
+			c.Params = gin.Params{{Key: "id", Value: tt.target}}
+			c.Set("userID", "admin-1")
+			c.Set("role", RoleAdmin)
+
+			adminFreezeUserHandler(c)
+			if w.Code != tt.want {
+				t.Errorf("status = %d, want %d: %s", w.Code, tt.want, w.Body)
+			}
+			if user, ok := users.users[tt.target]; ok && user.Frozen != tt.wantFrozen {
+				t.Errorf("frozen = %v, want %v", user.Frozen, tt.wantFrozen)
+			}
+		})
+	}
+}
+
+func TestKeySetAcceptsRotatedKey(t *testing.T) {
+	old, oldPublicPEM := testKeySet(t, "2024-01")
+	oldToken, err := old.Sign(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	oldPath := filepath.Join(t.TempDir(), "old.pub.pem")
+	err = os.WriteFile(oldPath, oldPublicPEM, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("JWT_VERIFICATION_KEYS", "2024-01="+oldPath)
+	current, _ := testKeySet(t, "2024-06")
+
+	claims, err := parseTestToken(current, oldToken)
+	if err != nil {
+		t.Fatalf("token signed with the rotated key was rejected: %v", err)
+	}
+	if claims.UserID != "user-1" {
+		t.Errorf("user = %q, want user-1", claims.UserID)
+	}
+
+	newToken, err := current.Sign(testClaims())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseTestToken(current, newToken); err != nil {
+		t.Errorf("token signed with the current key was rejected: %v", err)
+	}
+	if _, err := parseTestToken(old, newToken); err == nil {
+		t.Error("old key set accepted a token from a key it doesn't know")
+	}
+
+	var kids []string
+	for _, jwk := range current.JWKS() {
+		kids = append(kids, jwk.Kid)
+	}
+	if strings.Join(kids, ",") != "2024-06,2024-01" {
+		t.Errorf("JWKS kids = %v, want the current key then the rotated one", kids)
+	}
+}
+
+func TestRequestEmailChangeNeedsPasswordAndAFreeAddress(t *testing.T) {
+	hash, err := bcrypt.GenerateFromPassword([]byte("correct horse"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	service, _, _ := newTestService()
+	userRepo := &fakeUserRepo{user: User{ID: "user-1", Password: string(hash)}}
+	mailer := &recordingMailer{}
+	service.userRepo = userRepo
+	service.mailer = mailer
+
+	err = service.RequestEmailChange("user-1", "wrong", "new@example.com")
+	if !errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+		t.Errorf("wrong password: err = %v, want a password mismatch", err)
+	}
+
+	// a failed lookup doesn't mean the address is free
+	userRepo.emailLookupErr = errors.New("connection refused")
+	err = service.RequestEmailChange("user-1", "correct horse", "new@example.com")
+	if err == nil || errors.Is(err, errEmailTaken) {
+		t.Errorf("lookup failure: err = %v, want it passed on", err)
+	}
+
+	userRepo.emailLookupErr = nil
+	err = service.RequestEmailChange("user-1", "correct horse", "new@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(mailer.sent) != 1 || mailer.sent[0] != "new@example.com" || userRepo.pendingEmail != "new@example.com" {
+		t.Errorf("mails sent to %v with pending email %q, want one to new@example.com", mailer.sent, userRepo.pendingEmail)
+	}
+}
+
+type fakeInboxRepo struct {
+	NotificationRepository
+	notifications []Notification
+	devices       []PushDevice
+}
+
+func (r *fakeInboxRepo) ListNotifications(userID string, filter NotificationFilter) ([]Notification, error) {
+	return r.notifications, nil
+}
+
+func (r *fakeInboxRepo) CountUnread(userID string) (int, error) {
+	unread := 0
+	for _, n := range r.notifications {
+		if n.ReadAt == nil {
+			unread++
+		}
+	}
+	return unread, nil
+}
+
+func (r *fakeInboxRepo) GetDevices(userID string) ([]PushDevice, error) {
+	return r.devices, nil
+}
+
+// testExportService has one of everything ExportUserData collects
+func testExportService() *TransactionService {
+	service, _, _ := newTestService(testGoal("trip", 1000, testStart.Add(30*24*time.Hour)))
+	service.repo.(*fakeTransactionRepo).saved = []Transaction{testTransaction(250)}
+	service.eventRepo = &fakeRoundupEventRepo{events: []RoundupEvent{{ID: "event-1", UserID: "user-1", Amount: 12}}}
+	service.budgetRepo = &fakeBudgetRepo{budgets: []Budget{{ID: "budget-1", UserID: "user-1"}}}
+	service.subRepo = &fakeSubscriptionRepo{subs: []Subscription{{ID: "sub-1", UserID: "user-1", Merchant: "gym@upi"}}}
+	service.notifRepo = &fakeInboxRepo{
+		notifications: []Notification{{ID: "notif-1", UserID: "user-1"}},
+		devices:       []PushDevice{{Token: "phone", CreatedAt: testStart}},
+	}
+	service.hookRepo = &fakeWebhookRepo{
+		webhooks: []Webhook{
+			{ID: "hook-1", UserID: "user-1", URL: "https://example.com/hook", Secret: "hook-secret"},
+			{ID: "tenant", UserID: TenantWebhookOwner, Secret: "tenant-secret"},
+		},
+		deliveries: []WebhookDelivery{
+			{ID: "delivery-1", WebhookID: "hook-1", UserID: "user-1"},
+			{ID: "delivery-2", WebhookID: "tenant", UserID: "user-2"},
+		},
+	}
+	service.walletRepo.(*fakeWalletRepo).transactions = []WalletTransaction{{ID: "wtx-1", WalletID: "wallet-1", Amount: 12}}
+	return service
+}
+
+func TestExportUserData(t *testing.T) {
+	service := testExportService()
+
+	export, err := service.ExportUserData("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !export.ExportedAt.Equal(testStart) || export.User.ID != "user-1" || export.Wallet == nil || export.Wallet.ID != "wallet-1" {
+		t.Errorf("export = %+v", export)
+	}
+	counts := map[string]int{
+		"goals":               len(export.Goals),
+		"roundup events":      len(export.RoundupEvents),
+		"budgets":             len(export.Budgets),
+		"subscriptions":       len(export.Subscriptions),
+		"notifications":       len(export.Notifications),
+		"transactions":        len(export.Transactions),
+		"wallet transactions": len(export.WalletTransactions),
+		"push devices":        len(export.PushDevices),
+		"webhooks":            len(export.Webhooks),
+		"webhook deliveries":  len(export.WebhookDeliveries),
+	}
+	for name, count := range counts {
+		if count != 1 {
+			t.Errorf("exported %d %s, want 1", count, name)
+		}
+	}
+	if len(export.WebhookDeliveries) == 1 && export.WebhookDeliveries[0].ID != "delivery-1" {
+		t.Errorf("exported delivery %s, want the user's own", export.WebhookDeliveries[0].ID)
+	}
+
+	body, err := json.Marshal(export)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(body), "secret") {
+		t.Errorf("export contains a webhook secret: %s", body)
+	}
+}
+
+func TestWriteExportZip(t *testing.T) {
+	export, err := testExportService().ExportUserData("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := httptest.NewRecorder()
+	err = writeExportZip(w, export)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	archive, err := zip.NewReader(strings.NewReader(w.Body.String()), int64(w.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"user.json", "goals.json", "roundup_events.json", "budgets.json", "subscriptions.json", "notifications.json",
+		"transactions.json", "wallet.json", "wallet_transactions.json", "push_devices.json", "webhooks.json", "webhook_deliveries.json"}
+	var got []string
+	for _, file := range archive.File {
+		got = append(got, file.Name)
+
+		f, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var data interface{}
+		if err := json.NewDecoder(f).Decode(&data); err != nil {
+			t.Errorf("%s is not JSON: %v", file.Name, err)
+		}
+		f.Close()
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("files = %v, want %v", got, want)
+	}
+}
+
+func TestDeleteAccountRefusesWhileTheWalletHoldsMoney(t *testing.T) {
+	service, _, _ := newTestService()
+	users := service.userRepo.(*fakeUserRepo)
+	wallets := service.walletRepo.(*fakeWalletRepo)
+	wallets.wallet.Balance = 50
+
+	err := service.DeleteAccount("user-1")
+	if err == nil || users.anonymized {
+		t.Fatalf("deleted with ₹50 in the wallet: err = %v", err)
+	}
+
+	wallets.wallet.Balance = 0
+	err = service.DeleteAccount("user-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !users.anonymized {
+		t.Error("empty wallet: user was not anonymized")
+	}
+}
+
+func testFilterContext(query string) *gin.Context {
+	gin.SetMode(gin.TestMode)
+	c, _ := gin.CreateTestContext(httptest.NewRecorder())
+	c.Request = httptest.NewRequest(http.MethodGet, "/transactions?"+query, nil)
+	return c
+}
+
+func TestParseTransactionFilter(t *testing.T) {
+	cursor := PageCursor{CreatedAt: testStart, ID: "txn-9"}
+	filter, err := parseTransactionFilter(testFilterContext("from=2026-03-01&to=2026-03-31&category=Food&merchant=Cafe" +
+		"&min_amount=10&max_amount=99.5&roundup_enabled=false&limit=20&cursor=" + encodeCursor(cursor)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertTime(t, *filter.From, time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC))
+	assertTime(t, *filter.To, time.Date(2026, 4, 1, 0, 0, 0, 0, time.UTC)) // to is inclusive
+	if filter.Category != "Food" || filter.Merchant != "Cafe" || *filter.MinAmount != 10 || *filter.MaxAmount != 99.5 ||
+		*filter.RoundupEnabled || filter.Limit != 20 || *filter.After != cursor {
+		t.Errorf("filter = %+v", filter)
+	}
+
+	filter, err = parseTransactionFilter(testFilterContext(""))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filter.Limit != DefaultPageSize || filter.From != nil || filter.RoundupEnabled != nil || filter.After != nil {
+		t.Errorf("empty query gave %+v, want no filters and the default page size", filter)
+	}
+
+	for _, query := range []string{
+		"from=01-03-2026",
+		"to=tomorrow",
+		"min_amount=ten",
+		"roundup_enabled=maybe",
+		"limit=0",
+		"limit=" + strconv.Itoa(MaxPageSize+1),
+		"cursor=not-a-cursor",
+	} {
+		if _, err := parseTransactionFilter(testFilterContext(query)); err == nil {
+			t.Errorf("%s was accepted", query)
+		}
+	}
+}
+
+func TestPageCursorRoundTrip(t *testing.T) {
+	cursor := PageCursor{CreatedAt: time.Date(2026, 3, 1, 12, 0, 0, 123456789, time.UTC), ID: "a|b"}
+	decoded, err := decodeCursor(encodeCursor(cursor))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !decoded.CreatedAt.Equal(cursor.CreatedAt) || decoded.ID != cursor.ID {
+		t.Errorf("decoded %+v, want %+v", decoded, cursor)
+	}
+
+	for _, s := range []string{"", "!!!", base64.RawURLEncoding.EncodeToString([]byte("2026-03-01T12:00:00Z")),
+		base64.RawURLEncoding.EncodeToString([]byte("yesterday|txn-1"))} {
+		if _, err := decodeCursor(s); err == nil {
+			t.Errorf("decodeCursor(%q) succeeded", s)
+		}
+	}
+}
+
+func TestWhereClauseNumbersPlaceholdersInOrder(t *testing.T) {
+	from := testStart
+	minAmount := 10.0
+	enabled := true
+	filter := TransactionFilter{
+		From:           &from,
+		MinAmount:      &minAmount,
+		Category:       "Food",
+		RoundupEnabled: &enabled,
+		After:          &PageCursor{CreatedAt: testStart, ID: "txn-9"},
+	}
+
+	where := &whereClause{}
+	where.add("user_id = ?", "user-1")
+	where.addFilter(filter)
+	for _, condition := range paymentConditions(filter) {
+		where.add(condition.sql, condition.args...)
+	}
+
+	want := " WHERE user_id = $1 AND created_at >= $2 AND amount >= $3 AND (created_at, id) < ($4, $5) AND category = $6 AND roundup_enabled = $7"
+	if where.String() != want {
+		t.Errorf("where = %q\nwant    %q", where.String(), want)
+	}
+	if len(where.args) != 7 || where.args[0] != "user-1" || where.args[4] != "txn-9" || where.args[6] != true {
+		t.Errorf("args = %v", where.args)
+	}
+
+	if (&whereClause{}).String() != "" {
+		t.Error("empty where clause is not empty")
+	}
+}
+
+func TestAnalyticsRange(t *testing.T) {
+	service, _, _ := newTestService()
+	previous := txnService
+	txnService = service
+	defer func() { txnService = previous }()
+
+	day := func(s string) time.Time {
+		d, _ := time.Parse("2006-01-02", s)
+		return d
+	}
+
+	tests := []struct {
+		query    string
+		wantFrom time.Time
+		wantTo   time.Time
+		wantErr  bool
+	}{
+		{"", day("2026-01-31"), day("2026-03-01"), false},
+		{"from=2026-02-01&to=2026-02-28", day("2026-02-01"), day("2026-02-28"), false},
+		{"from=2026-02-01&to=2026-02-01", day("2026-02-01"), day("2026-02-01"), false},
+		{"from=2025-01-01&to=2026-01-01", day("2025-01-01"), day("2026-01-01"), false}, // 366 days
+		{"from=2025-01-01&to=2026-01-02", time.Time{}, time.Time{}, true},
+		{"from=2020-01-01", time.Time{}, time.Time{}, true},
+		{"from=2026-03-02&to=2026-03-01", time.Time{}, time.Time{}, true},
+		{"from=01-02-2026", time.Time{}, time.Time{}, true},
+		{"to=tomorrow", time.Time{}, time.Time{}, true},
+	}
+
+	for _, tt := range tests {
+		from, to, err := analyticsRange(testFilterContext(tt.query))
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("%q: got %v to %v, want an error", tt.query, from, to)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.query, err)
+			continue
+		}
+		if !from.Equal(tt.wantFrom) || !to.Equal(tt.wantTo) {
+			t.Errorf("%q: got %v to %v, want %v to %v", tt.query, from, to, tt.wantFrom, tt.wantTo)
+		}
+	}
+}
+
+// cannedDriver is a database/sql connector that answers every query with the same rows and
+// remembers the arguments, for checking how repositories call and scan their SQL
+type cannedDriver struct {
+	columns []string
+	rows    [][]driver.Value
+	args    []driver.Value
+}
+
+func (d *cannedDriver) Connect(ctx context.Context) (driver.Conn, error) { return d, nil }
+
+func (d *cannedDriver) Driver() driver.Driver { return nil }
+
+func (d *cannedDriver) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("not supported")
+}
+
+func (d *cannedDriver) Close() error { return nil }
+
+func (d *cannedDriver) Begin() (driver.Tx, error) { return nil, errors.New("not supported") }
+
+func (d *cannedDriver) Query(query string, args []driver.Value) (driver.Rows, error) {
+	d.args = args
+	return &cannedRows{columns: d.columns, rows: d.rows}, nil
+}
+
+type cannedRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *cannedRows) Columns() []string { return r.columns }
+
+func (r *cannedRows) Close() error { return nil }
+
+func (r *cannedRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+// cannedDB opens a database that answers with rows, each one a value per column
+func cannedDB(t *testing.T, columns []string, rows ...[]driver.Value) (*sql.DB, *cannedDriver) {
+	d := &cannedDriver{columns: columns, rows: rows}
+	db := sql.OpenDB(d)
+	t.Cleanup(func() { db.Close() })
+	return db, d
+}
+
+func assertArgs(t *testing.T, got []driver.Value, want ...driver.Value) {
+	t.Helper()
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("query args = %v, want %v", got, want)
+	}
+}
+
+func TestGetSpendingByCategory(t *testing.T) {
+	march := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	db, d := cannedDB(t, []string{"period", "category", "sum", "count", "roundup"},
+		[]driver.Value{march, "Groceries", 1250.5, int64(7), 31.25},
+		[]driver.Value{march, "Dining & Food", 400.0, int64(2), 12.0})
+	repo := &PostgresTransactionRepository{db: db}
+
+	to := march.AddDate(0, 1, 0)
+	spending, err := repo.GetSpendingByCategory("user-1", PeriodMonth, march, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertArgs(t, d.args, "user-1", PeriodMonth, march, to)
+	want := []CategorySpending{
+		{Period: march, Category: "Groceries", Total: 1250.5, Count: 7, Roundup: 31.25},
+		{Period: march, Category: "Dining & Food", Total: 400, Count: 2, Roundup: 12},
+	}
+	if !reflect.DeepEqual(spending, want) {
+		t.Errorf("spending = %+v, want %+v", spending, want)
+	}
+}
+
+func TestGetTopMerchants(t *testing.T) {
+	db, d := cannedDB(t, []string{"merchant", "sum", "count"},
+		[]driver.Value{"grocer@upi", 900.0, int64(4)})
+	repo := &PostgresTransactionRepository{db: db}
+
+	from := time.Date(2026, 2, 1, 0, 0, 0, 0, time.UTC)
+	to := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	merchants, err := repo.GetTopMerchants("user-1", from, to, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertArgs(t, d.args, "user-1", from, to, int64(5))
+	want := []MerchantSpending{{Merchant: "grocer@upi", Total: 900, Count: 4}}
+	if !reflect.DeepEqual(merchants, want) {
+		t.Errorf("merchants = %+v, want %+v", merchants, want)
+	}
+}
+
+func TestGetRoundupTotals(t *testing.T) {
+	monday := time.Date(2026, 2, 23, 0, 0, 0, 0, time.UTC)
+	db, d := cannedDB(t, []string{"period", "sum", "count", "capped"},
+		[]driver.Value{monday, 45.5, int64(3), 10.0})
+	repo := &PostgresTransactionRepository{db: db}
+
+	to := monday.AddDate(0, 0, 7)
+	totals, err := repo.GetRoundupTotals("user-1", PeriodWeek, monday, to)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertArgs(t, d.args, "user-1", PeriodWeek, monday, to)
+	want := []RoundupTotal{{Period: monday, Total: 45.5, Count: 3, Capped: 10}}
+	if !reflect.DeepEqual(totals, want) {
+		t.Errorf("totals = %+v, want %+v", totals, want)
+	}
+}
+
+func TestListNotificationsHandlerPagesWithHeaders(t *testing.T) {
+	read := testStart
+	inbox := &fakeInboxRepo{notifications: []Notification{
+		{ID: "notif-3", UserID: "user-1", CreatedAt: testStart},
+		{ID: "notif-2", UserID: "user-1", CreatedAt: testStart.Add(-time.Hour), ReadAt: &read},
+		{ID: "notif-1", UserID: "user-1", CreatedAt: testStart.Add(-2 * time.Hour)},
+	}}
+	service, _, _ := newTestService()
+	service.notifRepo = inbox
+	previous := txnService
+	txnService = service
+	defer func() { txnService = previous }()
+	gin.SetMode(gin.TestMode)
+
+	list := func(query string) (*httptest.ResponseRecorder, []Notification) {
+		w := httptest.NewRecorder()
+		c, _ := gin.CreateTestContext(w)
+		c.Request = httptest.NewRequest(http.MethodGet, "/notifications?"+query, nil)
+		c.Set("userID", "user-1")
+
+		listNotificationsHandler(c)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status = %d: %s", w.Code, w.Body)
+		}
+		var page []Notification
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatalf("body is not an array: %v", err)
+		}
+		return w, page
+	}
+
+	w, page := list("limit=2")
+	if len(page) != 2 || page[1].ID != "notif-2" {
+		t.Errorf("first page = %+v, want the two newest", page)
+	}
+	if got, want := w.Header().Get("X-Next-Cursor"), encodeCursor(PageCursor{CreatedAt: page[1].CreatedAt, ID: "notif-2"}); got != want {
+		t.Errorf("X-Next-Cursor = %q, want %q", got, want)
+	}
+	if got := w.Header().Get("X-Unread-Count"); got != "2" {
+		t.Errorf("X-Unread-Count = %q, want 2", got)
+	}
+
+	w, page = list("limit=5")
+	if len(page) != 3 || w.Header().Get("X-Next-Cursor") != "" {
+		t.Errorf("last page has %d notifications and cursor %q, want 3 and none", len(page), w.Header().Get("X-Next-Cursor"))
+	}
+}
@@ -0,0 +1,225 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Global variable
+var streamHub *StreamHub
+
+const StreamKeepAlive = 25 * time.Second // below the idle timeout of most proxies
+const StreamBufferSize = 32              // messages held for a slow client before new ones are dropped
+
+// StreamMessage is one server-sent event. Event names are "wallet", "transaction" and "goal".
+type StreamMessage struct {
+	Event string
+	Data  interface{}
+}
+
+// WalletUpdate is sent whenever the balance changes. Updates can arrive out of order, so clients
+// should ignore one whose version is not above the last they applied.
+type WalletUpdate struct {
+	Balance float64 `json:"balance"`
+	Change  float64 `json:"change"`  // negative for withdrawals, 0 for the snapshot sent on connect
+	Version int64   `json:"version"` // the wallet's, 0 for changes made before wallets had versions
+}
+
+// walletFilter drops wallet updates older than the newest one a client has been sent. Events are
+// dispatched concurrently, and the snapshot sent on connect can be newer than updates already queued.
+type walletFilter struct {
+	version int64
+}
+
+func (f *walletFilter) stale(msg StreamMessage) bool {
+	update, ok := msg.Data.(WalletUpdate)
+	if !ok || update.Version == 0 {
+		return false
+	}
+	if update.Version <= f.version {
+		return true
+	}
+	f.version = update.Version
+	return false
+}
+
+// StreamHub forwards bus events to the connected devices of each user. Clients only get events
+// published by this process, so with several instances each device sees the events of the one it is connected to.
+type StreamHub struct {
+	goalRepo GoalRepository
+	mu       sync.Mutex
+	clients  map[string]map[chan StreamMessage]bool // by user
+}
+
+func NewStreamHub(goalRepo GoalRepository) *StreamHub {
+	return &StreamHub{goalRepo: goalRepo, clients: map[string]map[chan StreamMessage]bool{}}
+}
+
+// Subscribe forwards the events clients care about. Users who aren't connected just miss them,
+// so these subscribers never fail and nothing is retried.
+func (h *StreamHub) Subscribe(bus *EventBus) {
+	bus.Subscribe(EventTransactionCreated, "stream", func(event Event) error {
+		e := event.(TransactionCreated)
+		h.send(e.Transaction.UserID, StreamMessage{Event: "transaction", Data: e.Transaction})
+		return nil
+	})
+	bus.Subscribe(EventWalletCredited, "stream", func(event Event) error {
+		e := event.(WalletCredited)
+		h.send(e.UserID, StreamMessage{Event: "wallet", Data: WalletUpdate{Balance: e.Balance, Change: e.Amount, Version: e.Version}})
+		return nil
+	})
+	bus.Subscribe(EventWalletWithdrawn, "stream", func(event Event) error {
+		e := event.(WalletWithdrawn)
+		h.send(e.UserID, StreamMessage{Event: "wallet", Data: WalletUpdate{Balance: e.Balance, Change: -e.Amount, Version: e.Version}})
+		return nil
+	})
+	bus.Subscribe(EventRoundupCredited, "stream", func(event Event) error {
+		h.sendGoalProgress(event.(RoundupCredited))
+		return nil
+	})
+	bus.Subscribe(EventGoalReached, "stream", func(event Event) error {
+		e := event.(GoalReached)
+		h.send(e.Goal.UserID, StreamMessage{Event: "goal", Data: e.Goal})
+		return nil
+	})
+}
+
+// sendGoalProgress sends the goals a roundup went to with their new savings
+func (h *StreamHub) sendGoalProgress(e RoundupCredited) {
+	if len(e.Allocations) == 0 || !h.connected(e.UserID) {
+		return
+	}
+
+	goals, err := h.goalRepo.GetGoalsByUserID(e.UserID)
+	if err != nil {
+		log.Printf("Error fetching goals for stream: %v\n", err)
+		return
+	}
+
+	allocated := map[string]bool{}
+	for _, allocation := range e.Allocations {
+		allocated[allocation.GoalID] = true
+	}
+
+	for _, goal := range goals {
+		if allocated[goal.ID] {
+			h.send(e.UserID, StreamMessage{Event: "goal", Data: goal})
+		}
+	}
+}
+
+func (h *StreamHub) connect(userID string) chan StreamMessage {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan StreamMessage, StreamBufferSize)
+	if h.clients[userID] == nil {
+		h.clients[userID] = map[chan StreamMessage]bool{}
+	}
+	h.clients[userID][ch] = true
+	return ch
+}
+
+func (h *StreamHub) disconnect(userID string, ch chan StreamMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.clients[userID], ch)
+	if len(h.clients[userID]) == 0 {
+		delete(h.clients, userID)
+	}
+}
+
+func (h *StreamHub) connected(userID string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.clients[userID]) > 0
+}
+
+// send never blocks the bus. A client whose buffer is full misses the message, and its
+// next wallet or goal update carries the current state anyway.
+func (h *StreamHub) send(userID string, msg StreamMessage) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	for ch := range h.clients[userID] {
+		select {
+		case ch <- msg:
+		default:
+			log.Printf("Stream client of user %s is not keeping up, dropped %s event\n", userID, msg.Event)
+		}
+	}
+}
+
+// streamHandler keeps the connection open and sends the user's updates as server-sent events,
+// starting with the current balance so the client doesn't have to fetch it first. The stream
+// ends when the token that opened it expires or, at the next keepalive, once the account is frozen.
+func streamHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	// connect before reading the balance, so a change in between is sent rather than missed
+	ch := streamHub.connect(uid)
+	defer streamHub.disconnect(uid, ch)
+
+	wallet, err := txnService.walletRepo.GetWalletByUserID(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get wallet balance"})
+		return
+	}
+
+	c.Header("Cache-Control", "no-cache")
+	c.Header("X-Accel-Buffering", "no") // stop nginx from holding events back
+	c.SSEvent("wallet", WalletUpdate{Balance: wallet.Balance, Version: wallet.Version})
+	c.Writer.Flush()
+
+	filter := &walletFilter{version: wallet.Version}
+
+	keepAlive := time.NewTicker(StreamKeepAlive)
+	defer keepAlive.Stop()
+
+	var expired <-chan time.Time
+	if expiresAt, ok := c.Get("tokenExpiresAt"); ok {
+		timer := time.NewTimer(time.Until(expiresAt.(time.Time)))
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case msg := <-ch:
+			if filter.stale(msg) {
+				return true
+			}
+			c.SSEvent(msg.Event, msg.Data)
+			return true
+		case <-keepAlive.C:
+			_, frozen, err := txnService.userRepo.GetAccess(uid)
+			if frozen || errors.Is(err, sql.ErrNoRows) {
+				return false
+			}
+			c.SSEvent("ping", "")
+			return true
+		case <-expired:
+			return false
+		case <-c.Request.Context().Done():
+			return false
+		}
+	})
+}
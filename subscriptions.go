@@ -0,0 +1,295 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+const MinRecurringPayments = 3
+const SubscriptionAmountTolerance = 0.15 // payments within 15% of each other count as the same charge
+const RegularIntervalShare = 0.75        // share of gaps between payments that have to match the cadence
+
+// cadencePeriod describes one cadence the detector looks for
+type cadencePeriod struct {
+	name      string
+	days      float64 // typical gap between payments
+	tolerance float64 // how many days a gap may be off by
+	perMonth  float64 // payments in an average month
+}
+
+var cadencePeriods = []cadencePeriod{
+	{CadenceWeekly, 7, 2, 52.0 / 12},
+	{CadenceMonthly, 30.44, 5, 1},
+	{CadenceYearly, 365.25, 20, 1.0 / 12},
+}
+
+// DetectSubscriptions runs the detector over all of the user's transactions, records what it
+// finds and returns every subscription known for the user. Known subscriptions the detector no
+// longer finds are marked lapsed. If the payments start again they come back as detected, or as
+// confirmed if the user had confirmed them.
+func (s *TransactionService) DetectSubscriptions(userID string) ([]Subscription, error) {
+	transactions, err := s.repo.GetTransactionsByUserID(userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to retrieve transactions: %v", err)
+	}
+
+	now := s.clock.Now()
+	found := map[string]bool{} // by merchant and cadence
+	for _, sub := range detectSubscriptions(transactions, now) {
+		sub.ID = uuid.New().String()
+		sub.UserID = userID
+		sub.Status = SubscriptionDetected
+		sub.CreatedAt = now
+		found[sub.Merchant+"|"+sub.Cadence] = true
+
+		err = s.subRepo.UpsertSubscription(sub)
+		if err != nil {
+			return nil, fmt.Errorf("failed to save subscription: %v", err)
+		}
+	}
+
+	subs, err := s.subRepo.GetSubscriptionsByUserID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	// dismissed ones stay dismissed, the user has already said they aren't subscriptions
+	for i := range subs {
+		sub := &subs[i]
+		if found[sub.Merchant+"|"+sub.Cadence] || sub.Status == SubscriptionDismissed || sub.Status == SubscriptionLapsed {
+			continue
+		}
+
+		err = s.subRepo.LapseSubscription(sub.ID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to update subscription: %v", err)
+		}
+		sub.Status = SubscriptionLapsed
+	}
+
+	return subs, nil
+}
+
+// detectSubscriptions finds payments to the same merchant, for about the same amount, on a weekly,
+// monthly or yearly cadence. Ones that have missed more than a whole period are treated as cancelled.
+func detectSubscriptions(transactions []Transaction, now time.Time) []Subscription {
+	byMerchant := map[string][]Transaction{}
+	for _, tx := range transactions {
+		if tx.Merchant == "" || tx.Amount <= 0 {
+			continue
+		}
+		byMerchant[tx.Merchant] = append(byMerchant[tx.Merchant], tx)
+	}
+
+	merchants := make([]string, 0, len(byMerchant))
+	for merchant := range byMerchant {
+		merchants = append(merchants, merchant)
+	}
+	sort.Strings(merchants)
+
+	subs := []Subscription{}
+	for _, merchant := range merchants {
+		// one per cadence, the database keeps them unique on merchant and cadence
+		found := map[string]Subscription{}
+		for _, payments := range clusterByAmount(byMerchant[merchant]) {
+			if len(payments) < MinRecurringPayments {
+				continue
+			}
+
+			sort.Slice(payments, func(i, j int) bool {
+				return payments[i].CreatedAt.Before(payments[j].CreatedAt)
+			})
+
+			period, ok := matchCadence(payments)
+			if !ok {
+				continue
+			}
+
+			last := payments[len(payments)-1]
+			next := nextPayment(period.name, last.CreatedAt)
+			if now.After(nextPayment(period.name, next)) {
+				continue
+			}
+
+			if existing, ok := found[period.name]; ok && existing.Payments >= len(payments) {
+				continue
+			}
+
+			found[period.name] = Subscription{
+				Merchant:     merchant,
+				Category:     last.Category,
+				Cadence:      period.name,
+				Amount:       last.Amount,
+				MonthlyCost:  math.Round(last.Amount*period.perMonth*100) / 100,
+				Payments:     len(payments),
+				LastPaid:     last.CreatedAt,
+				NextExpected: next,
+			}
+		}
+
+		for _, period := range cadencePeriods {
+			if sub, ok := found[period.name]; ok {
+				subs = append(subs, sub)
+			}
+		}
+	}
+	return subs
+}
+
+// clusterByAmount groups payments whose amounts are within SubscriptionAmountTolerance of the smallest in the group
+func clusterByAmount(payments []Transaction) [][]Transaction {
+	sorted := make([]Transaction, len(payments))
+	copy(sorted, payments)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Amount < sorted[j].Amount
+	})
+
+	var clusters [][]Transaction
+	for i, tx := range sorted {
+		if i == 0 || tx.Amount > clusters[len(clusters)-1][0].Amount*(1+SubscriptionAmountTolerance) {
+			clusters = append(clusters, nil)
+		}
+		clusters[len(clusters)-1] = append(clusters[len(clusters)-1], tx)
+	}
+	return clusters
+}
+
+// matchCadence picks the cadence matching the median gap between payments, provided
+// enough of the gaps fit it. Payments must be in date order.
+func matchCadence(payments []Transaction) (cadencePeriod, bool) {
+	var gaps []float64
+	for i := 1; i < len(payments); i++ {
+		gaps = append(gaps, payments[i].CreatedAt.Sub(payments[i-1].CreatedAt).Hours()/24)
+	}
+
+	sorted := make([]float64, len(gaps))
+	copy(sorted, gaps)
+	sort.Float64s(sorted)
+	median := sorted[len(sorted)/2]
+	if len(sorted)%2 == 0 {
+		median = (sorted[len(sorted)/2-1] + sorted[len(sorted)/2]) / 2
+	}
+
+	for _, period := range cadencePeriods {
+		if math.Abs(median-period.days) > period.tolerance {
+			continue
+		}
+
+		regular := 0
+		for _, gap := range gaps {
+			if math.Abs(gap-period.days) <= period.tolerance {
+				regular++
+			}
+		}
+		return period, float64(regular) >= RegularIntervalShare*float64(len(gaps))
+	}
+	return cadencePeriod{}, false
+}
+
+func nextPayment(cadence string, from time.Time) time.Time {
+	switch cadence {
+	case CadenceWeekly:
+		return from.AddDate(0, 0, 7)
+	case CadenceYearly:
+		return from.AddDate(1, 0, 0)
+	default:
+		return from.AddDate(0, 1, 0)
+	}
+}
+
+func listSubscriptionsHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	subs, err := txnService.DetectSubscriptions(uid)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to detect subscriptions"})
+		return
+	}
+
+	// dismissed and lapsed subscriptions are hidden unless asked for with ?status=dismissed or ?status=lapsed
+	status := c.Query("status")
+	filtered := []Subscription{}
+	for _, sub := range subs {
+		if (status == "" && isCurrentSubscription(sub)) || sub.Status == status {
+			filtered = append(filtered, sub)
+		}
+	}
+
+	monthlyTotal := 0.0
+	for _, sub := range filtered {
+		if isCurrentSubscription(sub) {
+			monthlyTotal += sub.MonthlyCost
+		}
+	}
+
+	c.JSON(http.StatusOK, gin.H{"subscriptions": filtered, "monthly_total": monthlyTotal})
+}
+
+// isCurrentSubscription is whether the subscription is still being paid and counts towards the monthly total
+func isCurrentSubscription(sub Subscription) bool {
+	return sub.Status == SubscriptionDetected || sub.Status == SubscriptionConfirmed
+}
+
+func changeSubscriptionStatusHandler(c *gin.Context) {
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return
+	}
+
+	var req struct {
+		Status string `json:"status" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+
+	if req.Status != SubscriptionConfirmed && req.Status != SubscriptionDismissed {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be confirmed or dismissed"})
+		return
+	}
+
+	sub, err := txnService.subRepo.GetSubscriptionByID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Subscription not found"})
+		return
+	}
+
+	if sub.UserID != uid {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+
+	err = txnService.subRepo.UpdateSubscriptionStatus(sub.ID, req.Status)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update subscription"})
+		return
+	}
+
+	sub.Status = req.Status
+	c.JSON(http.StatusOK, gin.H{"message": "Subscription status updated successfully", "subscription": sub})
+}
@@ -0,0 +1,630 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// Global variable
+var webhookService *WebhookService
+
+// webhook delivery states
+const DeliveryPending = "pending"
+const DeliverySucceeded = "succeeded"
+const DeliveryFailed = "failed" // gave up after MaxWebhookAttempts
+
+// TenantWebhookOwner is the owner of webhooks registered by admins, which get every user's events
+const TenantWebhookOwner = ""
+
+const MaxWebhookAttempts = 10
+const WebhookBaseBackoff = 30 * time.Second // doubles after every failed attempt
+const WebhookMaxBackoff = 6 * time.Hour
+const WebhookTimeout = 10 * time.Second
+const WebhookLease = time.Minute // an attempt in progress, retries leave it alone until then
+const WebhookPollInterval = 15 * time.Second
+
+// events partners can subscribe to
+var webhookEventTypes = []string{
+	EventRoundupCredited,
+	EventGoalReached,
+	EventGoalMilestone,
+	EventTransactionCreated,
+	EventWalletCredited,
+	EventWalletWithdrawn,
+}
+
+// webhookEnvelope is the body posted to webhooks
+type webhookEnvelope struct {
+	ID        string          `json:"id"` // the event's, stays the same across retries and replays
+	Type      string          `json:"type"`
+	UserID    string          `json:"user_id"`
+	CreatedAt time.Time       `json:"created_at"`
+	Data      json.RawMessage `json:"data"`
+}
+
+// WebhookService queues events for the webhooks subscribed to them and delivers them with retries
+type WebhookService struct {
+	repo           WebhookRepository
+	client         *http.Client
+	clock          Clock
+	allowLocalhost bool // http to this machine, for developing an integration
+}
+
+// NewWebhookService delivers with client, which should come from newWebhookClient outside tests
+func NewWebhookService(repo WebhookRepository, client *http.Client, clock Clock) *WebhookService {
+	return &WebhookService{repo: repo, client: client, clock: clock}
+}
+
+// webhooksAllowLocalhost reads WEBHOOK_ALLOW_LOCALHOST, which lets webhooks point at this machine
+// over plain http while developing an integration. Never set it in production.
+func webhooksAllowLocalhost() bool {
+	allow, _ := strconv.ParseBool(os.Getenv("WEBHOOK_ALLOW_LOCALHOST"))
+	return allow
+}
+
+// newWebhookClient only connects to public addresses, so a webhook can't be used to reach our own
+// network. The check runs on the address actually dialled, after DNS, so a hostname that resolves
+// to a private address is caught too. Redirects are not followed, they count as a failed attempt.
+func newWebhookClient(allowLocalhost bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: WebhookTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil || !webhookAddressAllowed(ip, allowLocalhost) {
+				return fmt.Errorf("webhook address %s is not public", host)
+			}
+			return nil
+		},
+	}
+
+	return &http.Client{
+		Timeout: WebhookTimeout,
+		Transport: &http.Transport{
+			// no proxy, it would be the proxy's address that got checked
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: WebhookTimeout,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// webhookAddressAllowed rejects loopback, private, link-local and unspecified addresses
+func webhookAddressAllowed(ip net.IP, allowLocalhost bool) bool {
+	if ip.IsLoopback() {
+		return allowLocalhost
+	}
+	return !ip.IsPrivate() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() && !ip.IsUnspecified()
+}
+
+func (s *WebhookService) Subscribe(bus *EventBus) {
+	for _, eventType := range webhookEventTypes {
+		bus.SubscribeStored(eventType, "webhooks", s.enqueue)
+	}
+}
+
+// enqueue records a delivery for every webhook that wants the event and makes the first attempt.
+// Failed attempts are retried by RunRetries, not the outbox, so only failing to queue returns an error.
+func (s *WebhookService) enqueue(row OutboxEvent) error {
+	webhooks, err := s.repo.GetSubscribedWebhooks(row.UserID, row.Type)
+	if err != nil {
+		return fmt.Errorf("failed to retrieve webhooks: %v", err)
+	}
+	if len(webhooks) == 0 {
+		return nil
+	}
+
+	body, err := json.Marshal(webhookEnvelope{
+		ID:        row.ID,
+		Type:      row.Type,
+		UserID:    row.UserID,
+		CreatedAt: row.CreatedAt,
+		Data:      row.Payload,
+	})
+	if err != nil {
+		return err
+	}
+
+	now := s.clock.Now()
+	for _, webhook := range webhooks {
+		lease := now.Add(WebhookLease)
+		delivery := WebhookDelivery{
+			ID:            uuid.New().String(),
+			WebhookID:     webhook.ID,
+			UserID:        row.UserID,
+			EventID:       row.ID,
+			EventType:     row.Type,
+			Payload:       string(body),
+			Status:        DeliveryPending,
+			NextAttemptAt: &lease,
+			CreatedAt:     now,
+		}
+
+		created, err := s.repo.AddDelivery(delivery)
+		if err != nil {
+			return fmt.Errorf("failed to queue webhook delivery: %v", err)
+		}
+		if !created {
+			continue
+		}
+
+		s.attempt(webhook, &delivery)
+	}
+	return nil
+}
+
+// RunRetries sends deliveries whose next attempt is due. It never returns.
+func (s *WebhookService) RunRetries(interval time.Duration) {
+	for range time.Tick(interval) {
+		s.retryDue()
+	}
+}
+
+func (s *WebhookService) retryDue() {
+	now := s.clock.Now()
+	deliveries, err := s.repo.ClaimDueDeliveries(now, now.Add(WebhookLease), 100)
+	if err != nil {
+		log.Printf("Error fetching due webhook deliveries: %v\n", err)
+		return
+	}
+
+	for i := range deliveries {
+		delivery := &deliveries[i]
+
+		webhook, err := s.repo.GetWebhookByID(delivery.WebhookID)
+		if err != nil {
+			log.Printf("Error fetching webhook %s: %v\n", delivery.WebhookID, err)
+			continue
+		}
+
+		if !webhook.Active {
+			delivery.Status = DeliveryFailed
+			delivery.LastError = "webhook was disabled"
+			delivery.NextAttemptAt = nil
+			err = s.repo.UpdateDelivery(*delivery)
+			if err != nil {
+				log.Printf("Error updating webhook delivery %s: %v\n", delivery.ID, err)
+			}
+			continue
+		}
+
+		s.attempt(*webhook, delivery)
+	}
+}
+
+// Replay sends a past delivery's payload again as a new delivery, retried like any other
+func (s *WebhookService) Replay(webhook Webhook, original WebhookDelivery) (*WebhookDelivery, error) {
+	now := s.clock.Now()
+	lease := now.Add(WebhookLease)
+	delivery := WebhookDelivery{
+		ID:            uuid.New().String(),
+		WebhookID:     webhook.ID,
+		UserID:        original.UserID,
+		EventID:       original.EventID,
+		EventType:     original.EventType,
+		Payload:       original.Payload,
+		Status:        DeliveryPending,
+		NextAttemptAt: &lease,
+		ReplayOf:      &original.ID,
+		CreatedAt:     now,
+	}
+
+	_, err := s.repo.AddDelivery(delivery)
+	if err != nil {
+		return nil, fmt.Errorf("failed to queue webhook delivery: %v", err)
+	}
+
+	s.attempt(webhook, &delivery)
+	return &delivery, nil
+}
+
+// attempt posts the delivery once and records the outcome, scheduling a retry if it failed
+func (s *WebhookService) attempt(webhook Webhook, delivery *WebhookDelivery) {
+	status, err := s.post(webhook, *delivery)
+
+	now := s.clock.Now()
+	delivery.Attempts++
+	delivery.ResponseStatus = status
+	delivery.LastAttemptAt = &now
+
+	switch {
+	case err == nil:
+		delivery.Status = DeliverySucceeded
+		delivery.LastError = ""
+		delivery.DeliveredAt = &now
+		delivery.NextAttemptAt = nil
+	case delivery.Attempts >= MaxWebhookAttempts:
+		delivery.Status = DeliveryFailed
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = nil
+	default:
+		next := now.Add(webhookBackoff(delivery.Attempts))
+		delivery.LastError = err.Error()
+		delivery.NextAttemptAt = &next
+	}
+
+	err = s.repo.UpdateDelivery(*delivery)
+	if err != nil {
+		log.Printf("Error updating webhook delivery %s: %v\n", delivery.ID, err)
+	}
+}
+
+// post sends the payload and returns the response status, treating anything but 2xx as a failure
+func (s *WebhookService) post(webhook Webhook, delivery WebhookDelivery) (int, error) {
+	body := []byte(delivery.Payload)
+
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "RoundUp-Webhooks/1")
+	req.Header.Set("X-Roundup-Event", delivery.EventType)
+	req.Header.Set("X-Roundup-Delivery", delivery.ID)
+	req.Header.Set("X-Roundup-Signature", signWebhook(webhook.Secret, s.clock.Now().Unix(), body))
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10)) // lets the connection be reused
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("endpoint returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// signWebhook returns the X-Roundup-Signature header, "t=<unix time>,v1=<hex HMAC-SHA256 of "<t>.<body>">".
+// Signing the time too lets receivers reject a captured request sent again later.
+func signWebhook(secret string, timestamp int64, body []byte) string {
+	t := strconv.FormatInt(timestamp, 10)
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(t + "."))
+	mac.Write(body)
+	return "t=" + t + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff is how long to wait after the given number of failed attempts
+func webhookBackoff(attempts int) time.Duration {
+	backoff := WebhookBaseBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= WebhookMaxBackoff {
+			return WebhookMaxBackoff
+		}
+	}
+	return backoff
+}
+
+func newWebhookSecret() (string, error) {
+	raw := make([]byte, 32)
+	_, err := rand.Read(raw)
+	if err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(raw), nil
+}
+
+// validateWebhookURL requires https. With allowLocalhost, local addresses used while developing
+// an integration may use http. Where the URL may connect to is checked when delivering.
+func validateWebhookURL(raw string, allowLocalhost bool) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("url must be an absolute URL")
+	}
+
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		host := u.Hostname()
+		if allowLocalhost && (host == "localhost" || host == "127.0.0.1" || host == "::1") {
+			return nil
+		}
+		return fmt.Errorf("url must use https")
+	default:
+		return fmt.Errorf("url must use https")
+	}
+}
+
+// normalizeWebhookEventTypes checks the event types and drops repeats
+func normalizeWebhookEventTypes(eventTypes []string) ([]string, error) {
+	if len(eventTypes) == 0 {
+		return nil, fmt.Errorf("at least one event type is required")
+	}
+
+	normalized := []string{}
+	seen := map[string]bool{}
+	for _, eventType := range eventTypes {
+		if !isWebhookEventType(eventType) {
+			return nil, fmt.Errorf("unknown event type '%s'", eventType)
+		}
+		if seen[eventType] {
+			continue
+		}
+		seen[eventType] = true
+		normalized = append(normalized, eventType)
+	}
+	return normalized, nil
+}
+
+func isWebhookEventType(eventType string) bool {
+	for _, t := range webhookEventTypes {
+		if t == eventType {
+			return true
+		}
+	}
+	return false
+}
+
+// tenantWebhooks makes the webhook handlers manage tenant webhooks. Used on the admin routes.
+func tenantWebhooks() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("webhookOwner", TenantWebhookOwner)
+		c.Next()
+	}
+}
+
+// webhookOwner is whose webhooks the request manages: the tenant's on admin routes, otherwise the user's own
+func webhookOwner(c *gin.Context) (string, bool) {
+	if owner, exists := c.Get("webhookOwner"); exists {
+		return owner.(string), true
+	}
+
+	userID, exists := c.Get("userID")
+	if !exists {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "User not authenticated"})
+		return "", false
+	}
+
+	uid, ok := userID.(string)
+	if !ok {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Invalid user ID format"})
+		return "", false
+	}
+	return uid, true
+}
+
+// ownedWebhook loads the webhook in the :id parameter and checks it belongs to the owner
+func ownedWebhook(c *gin.Context, owner string) (*Webhook, bool) {
+	webhook, err := txnService.hookRepo.GetWebhookByID(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+		return nil, false
+	}
+
+	if webhook.UserID != owner {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return nil, false
+	}
+	return webhook, true
+}
+
+func listWebhooksHandler(c *gin.Context) {
+	owner, ok := webhookOwner(c)
+	if !ok {
+		return
+	}
+
+	webhooks, err := txnService.hookRepo.GetWebhooksByUserID(owner)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve webhooks"})
+		return
+	}
+
+	c.JSON(http.StatusOK, webhooks)
+}
+
+func createWebhookHandler(c *gin.Context) {
+	owner, ok := webhookOwner(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		URL        string   `json:"url" binding:"required"`
+		EventTypes []string `json:"event_types" binding:"required"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+
+	err := validateWebhookURL(req.URL, webhookService.allowLocalhost)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	eventTypes, err := normalizeWebhookEventTypes(req.EventTypes)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event_types: " + err.Error()})
+		return
+	}
+
+	secret, err := newWebhookSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate webhook secret"})
+		return
+	}
+
+	webhook := Webhook{
+		ID:         uuid.New().String(),
+		UserID:     owner,
+		URL:        req.URL,
+		Secret:     secret,
+		EventTypes: eventTypes,
+		Active:     true,
+		CreatedAt:  txnService.clock.Now(),
+	}
+
+	err = txnService.hookRepo.CreateWebhook(webhook)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create webhook"})
+		return
+	}
+
+	// the only time the secret is shown
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook added successfully", "webhook": webhook, "secret": secret})
+}
+
+func updateWebhookHandler(c *gin.Context) {
+	owner, ok := webhookOwner(c)
+	if !ok {
+		return
+	}
+
+	webhook, ok := ownedWebhook(c, owner)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		URL        *string  `json:"url"`
+		EventTypes []string `json:"event_types"`
+		Active     *bool    `json:"active"`
+	}
+
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid input: " + err.Error()})
+		return
+	}
+
+	if req.URL != nil {
+		err := validateWebhookURL(*req.URL, webhookService.allowLocalhost)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		webhook.URL = *req.URL
+	}
+
+	if req.EventTypes != nil {
+		eventTypes, err := normalizeWebhookEventTypes(req.EventTypes)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid event_types: " + err.Error()})
+			return
+		}
+		webhook.EventTypes = eventTypes
+	}
+
+	if req.Active != nil {
+		webhook.Active = *req.Active
+	}
+
+	err := txnService.hookRepo.UpdateWebhook(*webhook)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update webhook"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook updated successfully", "webhook": webhook})
+}
+
+func deleteWebhookHandler(c *gin.Context) {
+	owner, ok := webhookOwner(c)
+	if !ok {
+		return
+	}
+
+	webhook, ok := ownedWebhook(c, owner)
+	if !ok {
+		return
+	}
+
+	err := txnService.hookRepo.DeleteWebhook(webhook.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete webhook"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted successfully"})
+}
+
+func listWebhookDeliveriesHandler(c *gin.Context) {
+	owner, ok := webhookOwner(c)
+	if !ok {
+		return
+	}
+
+	webhook, ok := ownedWebhook(c, owner)
+	if !ok {
+		return
+	}
+
+	limit := DefaultPageSize
+	if s := c.Query("limit"); s != "" {
+		l, err := strconv.Atoi(s)
+		if err != nil || l < 1 || l > MaxPageSize {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", MaxPageSize)})
+			return
+		}
+		limit = l
+	}
+
+	deliveries, err := txnService.hookRepo.GetDeliveriesByWebhookID(webhook.ID, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve webhook deliveries"})
+		return
+	}
+
+	c.JSON(http.StatusOK, deliveries)
+}
+
+func replayWebhookDeliveryHandler(c *gin.Context) {
+	owner, ok := webhookOwner(c)
+	if !ok {
+		return
+	}
+
+	webhook, ok := ownedWebhook(c, owner)
+	if !ok {
+		return
+	}
+
+	original, err := txnService.hookRepo.GetDeliveryByID(c.Param("delivery_id"))
+	if err != nil || original.WebhookID != webhook.ID {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+		return
+	}
+
+	if !webhook.Active {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Webhook is disabled"})
+		return
+	}
+
+	delivery, err := webhookService.Replay(*webhook, *original)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to replay delivery"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "Delivery replayed", "delivery": delivery})
+}